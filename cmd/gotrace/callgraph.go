@@ -1,8 +1,10 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"go/types"
+	"slices"
 	"strings"
 
 	"golang.org/x/tools/go/callgraph"
@@ -13,7 +15,9 @@ import (
 )
 
 // buildCallGraph builds a call graph for the module at the given path.
-// It returns the graph and the SSA program for further analysis.
+// It returns the graph and the SSA program for further analysis. Packages
+// are loaded for the host GOOS/GOARCH, so files excluded by build
+// constraints are not part of the graph.
 func buildCallGraph(moduleRoot string) (*callgraph.Graph, *ssa.Program, error) {
 	cfg := &packages.Config{
 		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
@@ -105,7 +109,9 @@ func findCallersTo(graph *callgraph.Graph, prog *ssa.Program, target string) (ma
 }
 
 // findFunctionNodes finds all SSA function nodes matching the target name.
-// Supports formats: "funcName", "Type.Method", "pkg.funcName"
+// Supports formats: "funcName", "Type.Method", "pkg.funcName", and the
+// import-path qualified "example.com/mod/pkg.funcName" or "example.com/mod/pkg.Type.Method".
+// An interface method ("Iface.Method") matches every concrete implementation.
 func findFunctionNodes(graph *callgraph.Graph, prog *ssa.Program, target string) []*callgraph.Node {
 	var nodes []*callgraph.Node
 
@@ -118,9 +124,78 @@ func findFunctionNodes(graph *callgraph.Graph, prog *ssa.Program, target string)
 		}
 	}
 
+	for _, fn := range interfaceImplementations(prog, target) {
+		if node := graph.Nodes[fn]; node != nil && !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+
 	return nodes
 }
 
+// interfaceImplementations returns the concrete methods implementing target
+// when it names an interface method. Interface methods have no body and so
+// no call graph node of their own; CHA already links their call sites to
+// these implementations.
+func interfaceImplementations(prog *ssa.Program, target string) []*ssa.Function {
+	type ifaceMethod struct {
+		iface  *types.Interface
+		method *types.Func
+	}
+	var wanted []ifaceMethod
+	var concrete []types.Type
+	for _, pkg := range prog.AllPackages() {
+		for _, member := range pkg.Members {
+			t, ok := member.(*ssa.Type)
+			if !ok {
+				continue
+			}
+			named, ok := t.Type().(*types.Named)
+			if !ok {
+				continue
+			}
+			iface, ok := named.Underlying().(*types.Interface)
+			if !ok {
+				concrete = append(concrete, named)
+				continue
+			}
+			for m := range iface.Methods() {
+				if matchesTypeMethod(pkg.Pkg, named.Obj().Name(), m.Name(), target) {
+					wanted = append(wanted, ifaceMethod{iface, m})
+				}
+			}
+		}
+	}
+
+	var impls []*ssa.Function
+	for _, w := range wanted {
+		for _, t := range concrete {
+			// Value receivers implement on T, pointer receivers only on *T
+			recv := t
+			if !types.Implements(recv, w.iface) {
+				if recv = types.NewPointer(t); !types.Implements(recv, w.iface) {
+					continue
+				}
+			}
+			sel := prog.MethodSets.MethodSet(recv).Lookup(w.method.Pkg(), w.method.Name())
+			if sel == nil {
+				continue
+			}
+			if fn := prog.MethodValue(sel); fn != nil && !slices.Contains(impls, fn) {
+				impls = append(impls, fn)
+			}
+		}
+	}
+	return impls
+}
+
+// matchesTypeMethod reports whether target names method of the type typeName
+// declared in pkg, as "Type.Method", "pkg.Type.Method" or with the full import path.
+func matchesTypeMethod(pkg *types.Package, typeName, method, target string) bool {
+	name := typeName + "." + method
+	return target == name || target == pkg.Name()+"."+name || target == pkg.Path()+"."+name
+}
+
 // matchesFunctionName checks if an SSA function matches the target name.
 func matchesFunctionName(fn *ssa.Function, target string) bool {
 	// Get the simple name
@@ -146,13 +221,22 @@ func matchesFunctionName(fn *ssa.Function, target string) bool {
 		}
 	}
 
-	// Check with package path (pkg.funcName)
+	// Check with package name (pkg.funcName) or full import path
+	// (github.com/me/app/util.funcName, github.com/me/app/util.Type.Method)
 	if fn.Pkg != nil {
 		pkgName := fn.Pkg.Pkg.Name()
 		fullName := pkgName + "." + name
 		if fullName == target {
 			return true
 		}
+		if qualified, ok := strings.CutPrefix(target, fn.Pkg.Pkg.Path()+"."); ok {
+			if qualified == name {
+				return true
+			}
+			if recv := fn.Signature.Recv(); recv != nil && qualified == getTypeName(recv.Type())+"."+name {
+				return true
+			}
+		}
 	}
 
 	return false
@@ -178,8 +262,10 @@ func formatFuncName(fn *ssa.Function) string {
 
 	name := fn.Name()
 
-	// Skip synthetic functions
-	if strings.HasPrefix(name, "$") || name == "init" {
+	// Skip synthetic functions, including the $bound and $thunk wrappers
+	// of method values and expressions; edges through them still reach the
+	// method itself
+	if strings.HasPrefix(name, "$") || name == "init" || fn.Synthetic != "" && strings.Contains(name, "$") {
 		return ""
 	}
 
@@ -265,3 +351,149 @@ func findPathSegment(graph *callgraph.Graph, prog *ssa.Program, source, target s
 
 	return segment, nil
 }
+
+// findBoundaryFuncs finds module functions that are called from a different
+// package, i.e. the entry points of each package-to-package transition.
+// main is always included so the program entry and summary are traced.
+func findBoundaryFuncs(graph *callgraph.Graph, modulePath string) map[string]bool {
+	boundary := map[string]bool{"main": true}
+	for fn, node := range graph.Nodes {
+		if fn == nil || fn.Pkg == nil || !inModule(fn.Pkg.Pkg.Path(), modulePath) {
+			continue
+		}
+		name := formatFuncName(fn)
+		if name == "" {
+			continue
+		}
+		for _, edge := range node.In {
+			caller := edge.Caller.Func
+			if caller == nil || caller.Pkg == nil || caller.Pkg.Pkg.Path() != fn.Pkg.Pkg.Path() {
+				boundary[name] = true
+				break
+			}
+		}
+	}
+	return boundary
+}
+
+// findLeafFuncs finds module functions that call no other module function,
+// so their traced time is their own work without nested trace overhead.
+// Calls made from closures and through method value wrappers count for the
+// enclosing function, and a recursive function is not a leaf. Functions are keyed by their
+// instrumentation name, so a name is a leaf only if every function with it
+// is. main is always included so the program entry and summary are traced.
+func findLeafFuncs(graph *callgraph.Graph, modulePath string) map[string]bool {
+	leaf := make(map[string]bool)
+	for fn, node := range graph.Nodes {
+		if fn == nil || fn.Pkg == nil || fn.Parent() != nil || !inModule(fn.Pkg.Pkg.Path(), modulePath) {
+			continue
+		}
+		name := formatFuncName(fn)
+		if name == "" {
+			continue
+		}
+		isLeaf := !callsModuleFunc(node, modulePath, make(map[*callgraph.Node]bool))
+		if prev, seen := leaf[name]; !seen || prev {
+			leaf[name] = isLeaf
+		}
+	}
+	leaves := map[string]bool{"main": true}
+	for name, ok := range leaf {
+		if ok {
+			leaves[name] = true
+		}
+	}
+	return leaves
+}
+
+// callsModuleFunc reports whether node calls a named module function,
+// directly or through the closures it calls.
+func callsModuleFunc(node *callgraph.Node, modulePath string, visited map[*callgraph.Node]bool) bool {
+	visited[node] = true
+	for _, edge := range node.Out {
+		callee := edge.Callee
+		if callee == nil || callee.Func == nil {
+			continue
+		}
+		// Method value wrappers belong to no package; look through them
+		if callee.Func.Synthetic != "" {
+			if !visited[callee] && callsModuleFunc(callee, modulePath, visited) {
+				return true
+			}
+			continue
+		}
+		if callee.Func.Pkg == nil || !inModule(callee.Func.Pkg.Pkg.Path(), modulePath) {
+			continue
+		}
+		if callee.Func.Parent() == nil {
+			if formatFuncName(callee.Func) != "" {
+				return true
+			}
+			continue
+		}
+		if !visited[callee] && callsModuleFunc(callee, modulePath, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// fanIn is the number of distinct functions calling a function.
+type fanIn struct {
+	name    string
+	callers int
+}
+
+// rankByFanIn returns the module's functions ordered by how many distinct
+// functions call them, most first, to find shared choke points. Only the
+// functions in within are ranked, unless it is nil. Functions are keyed by
+// their instrumentation name, so same-named functions in different packages
+// are counted together.
+func rankByFanIn(graph *callgraph.Graph, modulePath string, within map[string]bool) []fanIn {
+	callers := make(map[string]map[string]bool)
+	for fn, node := range graph.Nodes {
+		if fn == nil || fn.Pkg == nil || !inModule(fn.Pkg.Pkg.Path(), modulePath) {
+			continue
+		}
+		name := formatFuncName(fn)
+		if name == "" || within != nil && !within[name] {
+			continue
+		}
+		if callers[name] == nil {
+			callers[name] = make(map[string]bool)
+		}
+		for _, edge := range node.In {
+			if caller := formatFuncName(edge.Caller.Func); caller != "" && caller != name {
+				callers[name][caller] = true
+			}
+		}
+	}
+
+	ranked := make([]fanIn, 0, len(callers))
+	for name, set := range callers {
+		ranked = append(ranked, fanIn{name: name, callers: len(set)})
+	}
+	slices.SortFunc(ranked, func(a, b fanIn) int {
+		return cmp.Or(cmp.Compare(b.callers, a.callers), cmp.Compare(a.name, b.name))
+	})
+	return ranked
+}
+
+// intersectFuncs narrows the selection funcs to the functions in subset.
+// A nil selection means every function is selected.
+func intersectFuncs(funcs, subset map[string]bool) map[string]bool {
+	if funcs == nil {
+		return subset
+	}
+	for name := range subset {
+		if !funcs[name] {
+			delete(subset, name)
+		}
+	}
+	return subset
+}
+
+// inModule reports whether pkgPath belongs to the module modulePath.
+func inModule(pkgPath, modulePath string) bool {
+	return pkgPath == modulePath || strings.HasPrefix(pkgPath, modulePath+"/")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lineRange is an inclusive range of line numbers in a file.
+type lineRange struct {
+	start, end int
+}
+
+// changedLines is set when --changed is used; it maps absolute file paths to
+// the line ranges modified since the given revision.
+var changedLines map[string][]lineRange
+
+// gitChangedLines runs git diff against rev in moduleRoot and returns the
+// changed line ranges of each .go file.
+func gitChangedLines(moduleRoot, rev string) (map[string][]lineRange, error) {
+	cmd := exec.Command("git", "diff", "--relative", "--no-color", "-U0", rev, "--", "*.go")
+	cmd.Dir = moduleRoot
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git diff %s: %s", rev, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git diff %s: %w", rev, err)
+	}
+	return parseDiffRanges(string(out), moduleRoot)
+}
+
+// parseDiffRanges extracts the new-side line ranges from a unified diff.
+// Paths are resolved relative to root. Pure deletions mark the line they
+// follow so the enclosing function still counts as changed.
+func parseDiffRanges(diff, root string) (map[string][]lineRange, error) {
+	ranges := make(map[string][]lineRange)
+	var file string
+	sc := bufio.NewScanner(strings.NewReader(diff))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			name := strings.TrimPrefix(line, "+++ ")
+			if name == "/dev/null" {
+				file = "" // deleted file
+				continue
+			}
+			file = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(name, "b/")))
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			// @@ -a,b +c,d @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("malformed hunk header %q", line)
+			}
+			startStr, countStr, hasCount := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+			start, err := strconv.Atoi(startStr)
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk header %q", line)
+			}
+			count := 1
+			if hasCount {
+				if count, err = strconv.Atoi(countStr); err != nil {
+					return nil, fmt.Errorf("malformed hunk header %q", line)
+				}
+			}
+			end := start + count - 1
+			if count == 0 {
+				end = start
+			}
+			ranges[file] = append(ranges[file], lineRange{start, end})
+		}
+	}
+	return ranges, sc.Err()
+}
+
+// isChanged reports whether lines start..end of filename overlap a change
+// recorded by --changed. Without --changed every function counts as changed.
+func isChanged(filename string, start, end int) bool {
+	if changedLines == nil {
+		return true
+	}
+	for _, r := range changedLines[filename] {
+		if r.start <= end && start <= r.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/napolitain/gotrace/trace"
+)
+
+// diffRunPath is where the traced program saves its traces for --diff-base
+// (GOTRACE_JSON_FILE), set by RunHot.
+var diffRunPath string
+
+// funcDiff compares one function's calls between a baseline and a run.
+type funcDiff struct {
+	name             string
+	baseAvg, curAvg  int64
+	baseCalls, calls int
+	change           float64 // Percent change of the average duration
+}
+
+// diffEntries compares the average duration of every function present in
+// both base and cur, slowest regression first.
+func diffEntries(base, cur []trace.Entry) []funcDiff {
+	type agg struct {
+		total int64
+		count int
+	}
+	sum := func(entries []trace.Entry) map[string]agg {
+		m := make(map[string]agg)
+		for _, e := range entries {
+			a := m[e.Name]
+			a.total += e.Duration
+			a.count++
+			m[e.Name] = a
+		}
+		return m
+	}
+
+	baseBy, curBy := sum(base), sum(cur)
+	var diffs []funcDiff
+	for name, c := range curBy {
+		b, ok := baseBy[name]
+		if !ok {
+			continue
+		}
+		d := funcDiff{name: name, baseAvg: b.total / int64(b.count), curAvg: c.total / int64(c.count), baseCalls: b.count, calls: c.count}
+		if d.baseAvg > 0 {
+			d.change = 100 * float64(d.curAvg-d.baseAvg) / float64(d.baseAvg)
+		}
+		diffs = append(diffs, d)
+	}
+	slices.SortFunc(diffs, func(a, b funcDiff) int {
+		return cmp.Or(cmp.Compare(b.change, a.change), cmp.Compare(a.name, b.name))
+	})
+	return diffs
+}
+
+// writeDiff prints the functions whose average got slower than in the
+// baseline, at most 10, and returns how many regressed by more than
+// threshold percent.
+func writeDiff(w io.Writer, basePath string, diffs []funcDiff, threshold float64) int {
+	var regressed []funcDiff
+	over := 0
+	for _, d := range diffs {
+		if d.change > 0 {
+			regressed = append(regressed, d)
+		}
+		if threshold > 0 && d.change > threshold {
+			over++
+		}
+	}
+
+	fmt.Fprintf(w, "\n📉 Compared with %s: %d of %d common functions slower\n", basePath, len(regressed), len(diffs))
+	for _, d := range regressed[:min(len(regressed), 10)] {
+		fmt.Fprintf(w, "  %-28.28s %10s → %-10s %+7.1f%%  (%d → %d calls)\n", d.name,
+			time.Duration(d.baseAvg).Round(time.Microsecond), time.Duration(d.curAvg).Round(time.Microsecond),
+			d.change, d.baseCalls, d.calls)
+	}
+	return over
+}
+
+// compareWithBase diffs the entries the run saved to curPath against the
+// --diff-base file. A missing baseline is created from the run instead, so
+// the first CI run records it. With --diff-threshold, regressions above it
+// are returned as an error.
+func compareWithBase(curPath string) error {
+	cur, err := readEntries(curPath)
+	if err != nil {
+		return fmt.Errorf("read run traces: %w", err)
+	}
+	base, err := readEntries(*diffBase)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err := os.ReadFile(curPath)
+		if err == nil {
+			err = os.WriteFile(*diffBase, data, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("save baseline: %w", err)
+		}
+		fmt.Printf("\n📉 No baseline at %s; saved this run as the baseline\n", *diffBase)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read baseline: %w", err)
+	}
+
+	if over := writeDiff(os.Stdout, *diffBase, diffEntries(base, cur), *diffThreshold); over > 0 {
+		return fmt.Errorf("%d function(s) regressed by more than %.1f%% against %s", over, *diffThreshold, *diffBase)
+	}
+	return nil
+}
+
+// readEntries loads a file written by trace.ExportJSON.
+func readEntries(path string) ([]trace.Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return trace.ImportJSON(f)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selectedPaths is set when --files is used; only functions in the listed
+// files, or in files under the listed directories, are instrumented.
+var selectedPaths map[string]bool
+
+// readFileList reads the --files argument: "@path" reads the list from a
+// file and "-" from stdin, one file or directory per line. Blank lines and
+// lines starting with # are ignored, so `git diff --name-only` output can be
+// piped in directly. Relative paths are resolved against the working
+// directory.
+func readFileList(arg string, stdin io.Reader) (map[string]bool, error) {
+	var r io.Reader
+	switch {
+	case arg == "-":
+		r = stdin
+	case strings.HasPrefix(arg, "@"):
+		f, err := os.Open(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	default:
+		return nil, fmt.Errorf("--files takes @list.txt or - for stdin, got %q", arg)
+	}
+
+	paths := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		abs, err := filepath.Abs(line)
+		if err != nil {
+			return nil, err
+		}
+		// Match the resolved paths the module is walked with
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		paths[abs] = true
+	}
+	return paths, sc.Err()
+}
+
+// inSelectedFiles reports whether the Go file filename is listed by --files
+// or lies under a listed directory. Everything matches when the flag is not
+// set.
+func inSelectedFiles(filename string) bool {
+	if selectedPaths == nil {
+		return true
+	}
+	for dir := filename; ; dir = filepath.Dir(dir) {
+		if selectedPaths[dir] {
+			return true
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"slices"
 	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // insertion represents a text insertion at a specific byte position
@@ -15,21 +18,210 @@ type insertion struct {
 	text string
 }
 
+// skipReason returns why fn must not be instrumented, or "" if it should be.
+func skipReason(fn *ast.FuncDecl, name, alias string) string {
+	switch {
+	case fn.Body == nil:
+		return "no body"
+	case len(fn.Body.List) == 0:
+		return "empty body"
+	case *pattern != "" && !strings.Contains(name, *pattern):
+		return fmt.Sprintf("does not match --pattern %q", *pattern)
+	case allowedFuncs != nil && !allowedFuncs[name]:
+		return "not selected by --from/--until/--trace-stdlib-boundary"
+	case targetFunction != "" && name != targetFunction:
+		return fmt.Sprintf("not the --function target %q", targetFunction)
+	case hasTraceDefer(fn.Body, alias):
+		return "already traced"
+	case *minComplexity > 0:
+		if c := cyclomaticComplexity(fn); c < *minComplexity {
+			return fmt.Sprintf("complexity %d below --min-complexity %d", c, *minComplexity)
+		}
+	}
+	return ""
+}
+
+// fileFilterReason is skipReason for the filters that depend on where fn is:
+// it returns why fn in filename isn't instrumented, or "" if it is. main
+// always passes so the summary has a root.
+func fileFilterReason(fset *token.FileSet, fn *ast.FuncDecl, filename, name string) string {
+	switch {
+	case name == "main":
+		return ""
+	case !inSelectedPkgs(filename):
+		return fmt.Sprintf("package not matched by --pkgs %s", *pkgs)
+	case !inSelectedFiles(filename):
+		return fmt.Sprintf("file not listed by --files %s", *fileList)
+	case !isChanged(filename, fset.Position(fn.Pos()).Line, fset.Position(fn.End()).Line):
+		return fmt.Sprintf("not changed since --changed %s", *changed)
+	}
+	return ""
+}
+
+// cyclomaticComplexity returns 1 plus the number of decision points in fn:
+// if, for, range, non-default case clauses, && and ||.
+func cyclomaticComplexity(fn *ast.FuncDecl) int {
+	complexity := 1
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			complexity++
+		case *ast.CaseClause:
+			if n.List != nil {
+				complexity++
+			}
+		case *ast.CommClause:
+			if n.Comm != nil {
+				complexity++
+			}
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				complexity++
+			}
+		}
+		return true
+	})
+	return complexity
+}
+
+// explainf prints an instrumentation decision for a function when --explain is set.
+func explainf(filename, name, format string, args ...any) {
+	if !*explain {
+		return
+	}
+	fmt.Printf("explain: %s: %s: %s\n", filename, name, fmt.Sprintf(format, args...))
+}
+
+// receiverName returns the name of fn's receiver, or "" for functions and
+// for unnamed or blank receivers, which can't be referenced. Pointer
+// receivers are passed as the pointer, which is printed as &{...} and is
+// safe when nil.
+func receiverName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 || len(fn.Recv.List[0].Names) == 0 {
+		return ""
+	}
+	if name := fn.Recv.List[0].Names[0].Name; name != "_" {
+		return name
+	}
+	return ""
+}
+
+// namedResults returns the names of fn's results, skipping blank ones, or
+// nil if its results are unnamed.
+func namedResults(fn *ast.FuncDecl) []string {
+	if fn.Type.Results == nil {
+		return nil
+	}
+	var names []string
+	for _, field := range fn.Type.Results.List {
+		for _, name := range field.Names {
+			if name.Name != "_" {
+				names = append(names, name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// goroutineInsertions returns the Goroutine defers for the function literals
+// fn starts with go statements, named "go <label>#N" in source order, so
+// each goroutine's lifetime is recorded.
+func goroutineInsertions(fset *token.FileSet, file *ast.File, fn *ast.FuncDecl, alias, label string) []insertion {
+	var insertions []insertion
+	n := 0
+	ast.Inspect(fn.Body, func(node ast.Node) bool {
+		stmt, ok := node.(*ast.GoStmt)
+		if !ok {
+			return true
+		}
+		lit, ok := stmt.Call.Fun.(*ast.FuncLit)
+		if !ok || len(lit.Body.List) == 0 {
+			return true
+		}
+		n++
+		name := fmt.Sprintf("go %s#%d", label, n)
+		pos, singleLine := bodyInsertPos(fset, file, lit.Body)
+		text := fmt.Sprintf("\n\tdefer %s.Goroutine(%q)()", alias, name)
+		if singleLine {
+			text = fmt.Sprintf(" defer %s.Goroutine(%q)();", alias, name)
+		}
+		insertions = append(insertions, insertion{pos: pos, text: text})
+		return true
+	})
+	return insertions
+}
+
+// isTestHarnessFunc reports whether fn is one the testing package calls
+// itself: TestMain, or a Test, Benchmark, Fuzz or Example function as go
+// test recognizes them. They stay untraced under --test so the harness
+// sees them as written.
+func isTestHarnessFunc(fn *ast.FuncDecl) bool {
+	if fn.Recv != nil {
+		return false
+	}
+	name := fn.Name.Name
+	if name == "TestMain" {
+		return true
+	}
+	for _, prefix := range []string{"Test", "Benchmark", "Fuzz", "Example"} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			r, _ := utf8.DecodeRuneInString(rest)
+			return rest == "" || !unicode.IsLower(r)
+		}
+	}
+	return false
+}
+
+// isProgramMain reports whether decl is the program entry point: func main()
+// in package main, not a method or a main func in another package.
+func isProgramMain(file *ast.File, decl ast.Decl) bool {
+	fn, ok := decl.(*ast.FuncDecl)
+	return ok && file.Name.Name == "main" && fn.Name.Name == "main" && fn.Recv == nil && fn.Body != nil
+}
+
+// bodyInsertPos returns the offset at which to insert the trace defer into
+// body and whether the body's first statement shares the line with its
+// opening brace, as in "func f() { return }". Such bodies get the defer
+// right after the brace, terminated with a semicolon. For the others the
+// offset is past any comments trailing the brace, so the defer gets its
+// own line without taking over a "{ // ..." comment.
+func bodyInsertPos(fset *token.FileSet, file *ast.File, body *ast.BlockStmt) (pos int, singleLine bool) {
+	pos = fset.Position(body.Lbrace).Offset + 1
+	line := fset.Position(body.Lbrace).Line
+	first := body.Rbrace
+	if len(body.List) > 0 {
+		first = body.List[0].Pos()
+	}
+	if fset.Position(first).Line == line {
+		return pos, true
+	}
+	for _, cg := range file.Comments {
+		for _, c := range cg.List {
+			if c.Pos() > body.Lbrace && c.Pos() < first && fset.Position(c.Pos()).Line == line {
+				pos = fset.Position(c.End()).Offset
+			}
+		}
+	}
+	return pos, false
+}
+
 // instrumentFileText instruments a Go file using source-level text injection.
 // This preserves all comments, directives (go:embed, go:generate, etc.), and formatting.
 func instrumentFileText(filename string, content []byte) ([]byte, error) {
 	fset := token.NewFileSet()
 	node, err := parser.ParseFile(fset, filename, content, parser.ParseComments)
 	if err != nil {
-		// Return original content - let go build report syntax errors
-		return content, nil
+		// Report syntax errors against the original path; go build would
+		// only point at the temp copy. The parser's positions already name
+		// the file, so callers don't add it again
+		return nil, fmt.Errorf("syntax error: %w", err)
 	}
 
-	// Check if already instrumented
-	for _, imp := range node.Imports {
-		if imp.Path.Value == fmt.Sprintf("%q", tracePkg) {
-			return content, nil
-		}
+	// Reuse an existing trace import (whatever its alias) instead of
+	// injecting a second one
+	alias, imported := traceImportName(node)
+	if !imported {
+		alias = tracePkgAlias
 	}
 
 	var insertions []insertion
@@ -38,30 +230,39 @@ func instrumentFileText(filename string, content []byte) ([]byte, error) {
 	// Collect function insertions
 	ast.Inspect(node, func(n ast.Node) bool {
 		fn, ok := n.(*ast.FuncDecl)
-		if !ok || fn.Body == nil || len(fn.Body.List) == 0 {
+		if !ok {
 			return true
 		}
 
 		name := funcName(fn)
 
 		// Apply filters
-		if *pattern != "" && !strings.Contains(name, *pattern) {
+		if strings.HasSuffix(filename, "_test.go") && isTestHarnessFunc(fn) {
+			explainf(filename, name, "skipped (run by the testing harness)")
 			return true
 		}
-		if allowedFuncs != nil && !allowedFuncs[name] {
+		if reason := skipReason(fn, name, alias); reason != "" {
+			explainf(filename, name, "skipped (%s)", reason)
 			return true
 		}
-		if targetFunction != "" && name != targetFunction {
+		// main stays traced so the summary has a root
+		if reason := fileFilterReason(fset, fn, filename, name); reason != "" {
+			explainf(filename, name, "skipped (%s)", reason)
 			return true
 		}
 
-		// Check if already has trace defer
-		if hasTraceDefer(fn.Body) {
-			return true
+		// Trace under the //gotrace:name label, if any
+		label := traceLabel(fn)
+		if label != name {
+			explainf(filename, name, "traced as %q (//gotrace:name)", label)
 		}
 
 		// Build parameter list (skip blank identifiers)
 		var params []string
+		recv := receiverName(fn)
+		if recv != "" && *withReceiver {
+			params = append(params, recv)
+		}
 		if fn.Type.Params != nil {
 			for _, field := range fn.Type.Params.List {
 				for _, paramName := range field.Names {
@@ -74,24 +275,30 @@ func instrumentFileText(filename string, content []byte) ([]byte, error) {
 
 		// Choose trace function based on filters
 		traceFuncName := "Trace"
-		if *filters == "panic" {
+		switch {
+		case *filters == "panic":
 			traceFuncName = "TraceOnPanic"
+		case recv != "" && *withReceiver:
+			// Method marks the first argument as the receiver
+			traceFuncName = "Method"
 		}
 
 		// Get position right after opening brace
-		lbracePos := fset.Position(fn.Body.Lbrace).Offset
-
-		// Check if this is a single-line function (content on same line as {)
-		// We need to detect if there's code after { on the same line
-		isSingleLine := false
-		if lbracePos+1 < len(content) {
-			// Look for non-whitespace before newline
-			for i := lbracePos + 1; i < len(content) && content[i] != '\n'; i++ {
-				if content[i] != ' ' && content[i] != '\t' {
-					isSingleLine = true
-					break
-				}
-			}
+		insertPos, isSingleLine := bodyInsertPos(fset, node, fn.Body)
+
+		if isSingleLine {
+			explainf(filename, name, "included (single-line body)")
+		} else {
+			explainf(filename, name, "included")
+		}
+		if verbose >= 3 {
+			fmt.Printf("    + %s\n", label)
+		}
+
+		// Named results are passed by pointer and read when the defer runs
+		var results string
+		if names := namedResults(fn); len(names) > 0 {
+			results = fmt.Sprintf("%s.Results(&%s)", alias, strings.Join(names, ", &"))
 		}
 
 		// Build defer statement
@@ -99,23 +306,26 @@ func instrumentFileText(filename string, content []byte) ([]byte, error) {
 		if len(params) > 0 {
 			if isSingleLine {
 				// For single-line functions, use semicolon to separate statements
-				deferText = fmt.Sprintf(" defer %s.%s(%q, %s)();",
-					tracePkgAlias, traceFuncName, name, strings.Join(params, ", "))
+				deferText = fmt.Sprintf(" defer %s.%s(%q, %s)(%s);",
+					alias, traceFuncName, label, strings.Join(params, ", "), results)
 			} else {
-				deferText = fmt.Sprintf("\n\tdefer %s.%s(%q, %s)()",
-					tracePkgAlias, traceFuncName, name, strings.Join(params, ", "))
+				deferText = fmt.Sprintf("\n\tdefer %s.%s(%q, %s)(%s)",
+					alias, traceFuncName, label, strings.Join(params, ", "), results)
 			}
 		} else {
 			if isSingleLine {
-				deferText = fmt.Sprintf(" defer %s.%s(%q)();",
-					tracePkgAlias, traceFuncName, name)
+				deferText = fmt.Sprintf(" defer %s.%s(%q)(%s);",
+					alias, traceFuncName, label, results)
 			} else {
-				deferText = fmt.Sprintf("\n\tdefer %s.%s(%q)()",
-					tracePkgAlias, traceFuncName, name)
+				deferText = fmt.Sprintf("\n\tdefer %s.%s(%q)(%s)",
+					alias, traceFuncName, label, results)
 			}
 		}
 
-		insertions = append(insertions, insertion{pos: lbracePos + 1, text: deferText})
+		insertions = append(insertions, insertion{pos: insertPos, text: deferText})
+		if *goroutines {
+			insertions = append(insertions, goroutineInsertions(fset, node, fn, alias, label)...)
+		}
 		hasInstrumentation = true
 
 		return true
@@ -132,31 +342,48 @@ func instrumentFileText(filename string, content []byte) ([]byte, error) {
 		pkgEndOffset++
 	}
 
-	importText := fmt.Sprintf("\nimport %s %q\n", tracePkgAlias, tracePkg)
-	insertions = append(insertions, insertion{pos: pkgEndOffset + 1, text: importText})
+	if !imported {
+		importText := fmt.Sprintf("\nimport %s %q\n", tracePkgAlias, tracePkg)
+		insertions = append(insertions, insertion{pos: pkgEndOffset + 1, text: importText})
+	}
 
 	// Add PrintSummary/PrintFunctionStats to main function
 	for _, decl := range node.Decls {
-		fn, ok := decl.(*ast.FuncDecl)
-		if !ok || fn.Name.Name != "main" || fn.Recv != nil || fn.Body == nil {
+		if !isProgramMain(node, decl) {
 			continue
 		}
+		fn := decl.(*ast.FuncDecl)
+		if slices.ContainsFunc(fn.Body.List, func(stmt ast.Stmt) bool { return isTraceSummary(stmt, alias) }) {
+			break
+		}
 
-		// Get position right before closing brace
-		rbracePos := fset.Position(fn.Body.Rbrace).Offset
-
-		var summaryText string
+		summaryCall := fmt.Sprintf("%s.PrintSummary()", alias)
 		if targetFunction != "" {
-			summaryText = fmt.Sprintf("\n\t%s.PrintFunctionStats(%q)", tracePkgAlias, targetFunction)
-		} else {
-			summaryText = fmt.Sprintf("\n\t%s.PrintSummary()", tracePkgAlias)
+			summaryCall = fmt.Sprintf("%s.PrintFunctionStats(%q)", alias, targetFunction)
+		}
+
+		if *summaryAtEnd {
+			// Plain statement right before the closing brace
+			rbracePos := fset.Position(fn.Body.Rbrace).Offset
+			insertions = append(insertions, insertion{pos: rbracePos, text: "\n\t" + summaryCall})
+			break
+		}
+
+		// Deferred at the top of main so it also runs on early returns. It is
+		// inserted at the same position as main's trace defer but applied
+		// after it, so it lands first and runs after main's exit line.
+		insertPos, isSingleLine := bodyInsertPos(fset, node, fn.Body)
+		summaryText := fmt.Sprintf("\n\tdefer %s", summaryCall)
+		if isSingleLine {
+			summaryText = fmt.Sprintf(" defer %s;", summaryCall)
 		}
-		insertions = append(insertions, insertion{pos: rbracePos, text: summaryText})
+		insertions = append(insertions, insertion{pos: insertPos, text: summaryText})
 		break
 	}
 
-	// Sort insertions by position descending (apply from end to start)
-	sort.Slice(insertions, func(i, j int) bool {
+	// Sort insertions by position descending (apply from end to start).
+	// Stable, so insertions at the same position apply in the order added.
+	sort.SliceStable(insertions, func(i, j int) bool {
 		return insertions[i].pos > insertions[j].pos
 	})
 
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"strings"
+)
+
+// selectedFunc is a function "gotrace list --json" reports as instrumented.
+type selectedFunc struct {
+	Name   string `json:"name"`            // Qualified name as matched by filters
+	Label  string `json:"label,omitempty"` // Trace label when set by //gotrace:name
+	File   string `json:"file"`            // Module-relative path
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// selectFuncs returns the functions in node, parsed from filename, that
+// would be instrumented, with rel as their file.
+func selectFuncs(fset *token.FileSet, node *ast.File, filename, rel string) []selectedFunc {
+	alias, imported := traceImportName(node)
+	if !imported {
+		alias = tracePkgAlias
+	}
+
+	var selected []selectedFunc
+	ast.Inspect(node, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncDecl)
+		if !ok {
+			return true
+		}
+		name := funcName(fn)
+		if strings.HasSuffix(rel, "_test.go") && isTestHarnessFunc(fn) {
+			return true
+		}
+		if skipReason(fn, name, alias) != "" || fileFilterReason(fset, fn, filename, name) != "" {
+			return true
+		}
+		f := selectedFunc{Name: name, File: rel, Line: fset.Position(fn.Pos()).Line, Reason: selectionReason(fn)}
+		if label := traceLabel(fn); label != name {
+			f.Label = label
+		}
+		selected = append(selected, f)
+		return true
+	})
+	return selected
+}
+
+// selectionReason describes why a function that passed skipReason is
+// instrumented: the filters it matched, or that none are set.
+func selectionReason(fn *ast.FuncDecl) string {
+	var reasons []string
+	if *pattern != "" {
+		reasons = append(reasons, fmt.Sprintf("matches --pattern %q", *pattern))
+	}
+	if targetFunction != "" {
+		reasons = append(reasons, "--function target")
+	}
+	if allowedFuncs != nil {
+		reasons = append(reasons, "selected by --from/--until/--trace-stdlib-boundary")
+	}
+	if *minComplexity > 0 {
+		reasons = append(reasons, fmt.Sprintf("complexity %d", cyclomaticComplexity(fn)))
+	}
+	if len(reasons) == 0 {
+		return "no filters"
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// writeSelectedJSON writes funcs to w as an indented JSON array.
+func writeSelectedJSON(w io.Writer, funcs []selectedFunc) error {
+	if funcs == nil {
+		funcs = []selectedFunc{} // "[]" rather than "null"
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(funcs)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
@@ -8,39 +9,149 @@ import (
 	"go/token"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 
 	"golang.org/x/mod/modfile"
 )
 
 const (
-	traceModule   = "github.com/napolitain/gotrace"
-	tracePkg      = traceModule + "/trace"
-	tracePkgAlias = "gotrace_trace" // Alias to avoid conflicts with runtime/trace or user packages
+	defaultTraceModule = "github.com/napolitain/gotrace"
+	tracePkgAlias      = "gotrace_trace" // Alias to avoid conflicts with runtime/trace or user packages
 )
 
+// Module and package path of the trace library injected into targets.
+// --trace-module overrides them for forks published under another path.
 var (
-	dryRun       = flag.Bool("dry-run", false, "show what would change without modifying")
-	verbose      = flag.Bool("verbose", false, "print detailed info")
-	pattern      = flag.String("pattern", "", "only instrument functions matching pattern")
-	filters      = flag.String("filters", "", "comma-separated filters (e.g. 'panic')")
-	until        = flag.String("until", "", "only instrument call path to this function")
-	from         = flag.String("from", "", "trace from this function (use with --until for segments)")
-	pmu          = flag.Bool("pmu", false, "collect hardware performance counters (Linux only)")
-	functionFlag = flag.String("function", "", "micro-benchmark a specific function only")
+	traceModule = defaultTraceModule
+	tracePkg    = traceModule + "/trace"
 )
 
+var (
+	dryRun        = flag.Bool("dry-run", false, "show what would change without modifying")
+	pattern       = flag.String("pattern", "", "only instrument functions matching pattern")
+	filters       = flag.String("filters", "", "comma-separated filters (e.g. 'panic')")
+	until         = flag.String("until", "", "only instrument call path to this function")
+	from          = flag.String("from", "", "trace from this function (use with --until for segments)")
+	pmu           = flag.Bool("pmu", false, "collect hardware performance counters (Linux only)")
+	functionFlag  = flag.String("function", "", "micro-benchmark a specific function only")
+	profileMem    = flag.Duration("profile-mem", 0, "sample heap usage at this interval during the run (e.g. 10ms)")
+	boundaryOnly  = flag.Bool("trace-stdlib-boundary", false, "only instrument functions called from a different package (uses the call graph)")
+	fanInTop      = flag.Int("fan-in", 0, "print the N functions with the most distinct callers and only instrument those (uses the call graph)")
+	leavesOnly    = flag.Bool("leaves-only", false, "only instrument functions that call no other function of the module (uses the call graph)")
+	minComplexity = flag.Int("min-complexity", 0, "only instrument functions with at least this cyclomatic complexity")
+	summaryPath   = flag.String("summary-file", "", "write the summary to this file instead of the terminal")
+	htmlOut       = flag.String("html", "", "also write the summary as a self-contained HTML report to this file")
+	topN          = flag.Int("top", 0, "print only the N slowest calls in the summary, without the other tables")
+	diffBase      = flag.String("diff-base", "", "compare average call times against traces saved in this file (saved there first if missing)")
+	diffThreshold = flag.Float64("diff-threshold", 0, "with --diff-base, fail if a function's average time regressed by more than this percentage")
+	failOnHot     = flag.Bool("fail-on-hot", false, "exit with status 4 after the summary if any call reached the hot threshold (for CI)")
+	summaryAtEnd  = flag.Bool("summary-at-end", false, "print the summary from the end of main instead of a defer at its top (skipped on early return)")
+	jsonOut       = flag.Bool("json", false, "with list or --dry-run, print the functions that would be instrumented as a JSON array")
+	withReceiver  = flag.Bool("capture-receiver", false, "pass method receivers to the trace as their first argument")
+	byReceiver    = flag.Bool("by-receiver", false, "count method calls per receiver in the summary (implies --capture-receiver)")
+	goroutines    = flag.Bool("goroutines", false, "also record the lifetime of goroutines started with go func() { ... }() in instrumented functions")
+	explain       = flag.Bool("explain", false, "print why each function was or wasn't instrumented")
+	collector     = flag.String("collector", "", "stream trace entries as NDJSON to a collector (host:port, tcp:addr or unix:path)")
+	flatOutput    = flag.Bool("flat", false, "print live lines left-aligned with a [depth] prefix instead of indenting")
+	colorMode     = flag.String("color", "auto", "color the traced program's output: auto, always (even when piped) or never; overrides NO_COLOR and FORCE_COLOR")
+	gomaxprocs    = flag.Int("gomaxprocs", 0, "set GOMAXPROCS for the traced program (0 leaves it unchanged)")
+	pkgs          = flag.String("pkgs", "", "only instrument packages matching these comma-separated patterns (./internal/..., internal/util or an import path)")
+	fileList      = flag.String("files", "", "only instrument the files and directories listed in @file or on stdin (-), one per line")
+	changed       = flag.String("changed", "", "only instrument functions changed since this git revision (e.g. main)")
+	traceModFlag  = flag.String("trace-module", defaultTraceModule, "module path of the gotrace fork providing the trace package")
+	pinVersion    = flag.String("trace-version", "", "require this gotrace version in the instrumented module instead of the local checkout or build info")
+	pinReplace    = flag.String("trace-replace", "", "replace the gotrace module with this directory or module@version in the instrumented module")
+	testMode      = flag.Bool("test", false, "trace the target's tests instead of the program: builds it with go test and traces helpers in _test.go files too")
+	keepGoing     = flag.Bool("keep-going", false, "copy files that fail to instrument as-is and carry on, reporting every failure at the end")
+	skipDirs      stringList
+	verbose       verbosity
+)
+
+func init() {
+	flag.Var(&skipDirs, "skip-dir", "glob of module-relative directories to leave uninstrumented (repeatable)")
+	flag.Var(&verbose, "verbose", "print progress: 1 packages, 2 files, 3 functions and go.mod changes (-v -v or --verbose=2 for more)")
+	flag.Var(&verbose, "v", "shorthand for --verbose")
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// verbosity is a counting flag: each bare -v or --verbose raises the level
+// by one, --verbose=N sets it.
+type verbosity int
+
+func (v *verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosity) Set(value string) error {
+	switch value {
+	case "true":
+		*v++
+		return nil
+	case "false":
+		*v = 0
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q, want a level from 0 to 3", value)
+	}
+	*v = verbosity(n)
+	return nil
+}
+
+func (v *verbosity) IsBoolFlag() bool {
+	return true
+}
+
+// isSkippedDir reports whether the module-relative directory rel, or any of
+// its parents, matches a --skip-dir pattern.
+func isSkippedDir(rel string) bool {
+	if len(skipDirs) == 0 {
+		return false
+	}
+	for dir := filepath.ToSlash(rel); dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		for _, pat := range skipDirs {
+			if ok, _ := path.Match(filepath.ToSlash(pat), dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `gotrace - Hot function tracing for Go
 
-Usage: gotrace [flags] <target> [args...]
+Usage: gotrace [run] [flags] <target> [args...]
+       gotrace list [flags] <target>
+       gotrace replay [--speed N] FILE
+       gotrace merge [-o FILE] FILE...
 
 Instruments your Go code in-memory, compiles, and runs it with tracing enabled.
 No files are modified on disk.
 
+Commands:
+  run       Instrument, build and run the target (the default)
+  list      Show what would be instrumented without running (same as --dry-run)
+  replay    Re-render a trace saved with trace.ExportJSON
+  merge     Combine traces saved by several runs into one summary
+
 Arguments:
   target    Package directory to run (e.g., ".", "./cmd/app")
   args      Arguments forwarded to the compiled program
@@ -53,16 +164,69 @@ Examples:
   gotrace .                       # Run current directory with tracing
   gotrace ./cmd/app               # Run specific package
   gotrace ./cmd/app --port 80     # Run with arguments forwarded
-  gotrace --dry-run ./cmd/app     # Preview instrumentation without running
+  gotrace list ./cmd/app          # Preview instrumentation without running
+  gotrace list --json .           # Selected functions as JSON for editors and scripts
   gotrace --filters panic .       # Only show traces when panic occurs
   gotrace --until "DB.Query" .    # Only trace call path to DB.Query
   gotrace --pmu .                 # Include hardware performance counters (Linux)
+  gotrace --gomaxprocs 1 --pmu .  # Pin to one P for steadier counters
+  gotrace --profile-mem 10ms .    # Sample heap growth during the run
+  gotrace --skip-dir "internal/gen*" .  # Leave matching directories uninstrumented
+  gotrace --collector unix:/tmp/gotrace.sock .  # Stream entries to a live viewer
+  gotrace --explain --pattern Handle .  # Show why each function is (not) traced
+  gotrace -v -v .                 # Print each instrumented file (-v=3 adds functions)
+  gotrace --keep-going .          # Run despite files that fail to instrument, then list them
+  gotrace --color always . | less -R  # Keep colors in a pager
+  gotrace --goroutines .          # Show how long each goroutine ran, and which still run
+  gotrace --min-complexity 5 .    # Only trace functions with 5+ branches
+  gotrace --trace-stdlib-boundary .  # Trace only cross-package calls
+  gotrace --fan-in 5 .            # Trace the 5 most widely called functions
+  gotrace --leaves-only .         # Time pure compute without nested trace overhead
+  gotrace --trace-module example.com/me/gotrace .  # Inject a forked trace package
+  gotrace --trace-version v0.4.0 .  # Pin the injected gotrace for reproducible CI builds
+  gotrace --test ./internal/parse -test.run TestParse  # Trace a package's tests
+  gotrace --changed main .        # Only trace functions changed on this branch
+  gotrace --pkgs ./internal/... . # Only trace packages under internal/
+  git diff --name-only main | gotrace --files - .  # Only trace files changed on this branch
+  gotrace --flat . > trace.log    # Left-aligned, greppable output
+  gotrace --summary-file summary.txt .  # Keep the summary apart from live output
+  gotrace --html report.html .    # Shareable report with sortable tables and a flame graph
+  gotrace --diff-base base.jsonl --diff-threshold 20 .  # Fail on slowdowns over 20%% vs a baseline
+  gotrace --top 5 .               # Summary with just the 5 slowest calls
+  gotrace --capture-receiver .    # Show which value each method ran on
+  gotrace --by-receiver .         # Per-instance call counts for methods
+  gotrace --fail-on-hot .         # Fail CI when a call reaches the hot threshold
+  gotrace replay run.jsonl        # Re-render a trace saved with trace.ExportJSON
+  gotrace merge shard*.jsonl      # One summary across sharded runs
 `)
 	}
 	flag.Parse()
 
+	cmd, rest := splitSubcommand(flag.Args())
+	switch cmd {
+	case "replay":
+		if err := runReplay(rest); err != nil {
+			fatal(err)
+		}
+		return
+	case "merge":
+		if err := runMerge(rest); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	// run and list take the same flags as the bare form, after the command
+	if err := flag.CommandLine.Parse(rest); err != nil {
+		fatal(err)
+	}
+	setTraceModule(*traceModFlag)
+	// Grouping by receiver needs the receiver passed to the trace
+	if *byReceiver {
+		*withReceiver = true
+	}
+
 	if flag.NArg() < 1 {
-		fatal(fmt.Errorf("usage: gotrace <target> [args...]\nRun 'gotrace --help' for more information"))
+		fatal(fmt.Errorf("usage: gotrace [run|list] <target> [args...]\nRun 'gotrace --help' for more information"))
 	}
 
 	target := flag.Arg(0)
@@ -76,7 +240,7 @@ Examples:
 		fatal(fmt.Errorf("target must be a directory containing a Go package"))
 	}
 
-	if *dryRun {
+	if *dryRun || cmd == "list" {
 		if err := previewInstrumentation(target); err != nil {
 			fatal(err)
 		}
@@ -84,12 +248,34 @@ Examples:
 	}
 
 	if err := RunHot(target, args); err != nil {
+		// The program's own failure was already shown; exit with its code,
+		// after any files --keep-going couldn't instrument
+		var exit *childExitError
+		if errors.As(err, &exit) {
+			if kept := keptError(); kept != nil {
+				fmt.Fprintf(os.Stderr, "gotrace: %v\n", kept)
+			}
+			os.Exit(exit.code)
+		}
 		fatal(err)
 	}
 }
 
+// splitSubcommand splits a leading subcommand off the non-flag arguments.
+// A bare target is an alias for "run", so "gotrace ." keeps working; a
+// target directory named like a command needs a path prefix ("./list").
+func splitSubcommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "run", "list", "replay", "merge":
+			return args[0], args[1:]
+		}
+	}
+	return "run", args
+}
+
 func previewInstrumentation(target string) error {
-	absTarget, err := filepath.Abs(target)
+	absTarget, err := resolveTarget(target)
 	if err != nil {
 		return err
 	}
@@ -101,11 +287,20 @@ func previewInstrumentation(target string) error {
 	if moduleRoot == "" {
 		return fmt.Errorf("no go.mod found for %s", absTarget)
 	}
+	if err := resolveSelection(moduleRoot); err != nil {
+		return err
+	}
 
-	fmt.Printf("Would instrument module at: %s\n", moduleRoot)
-	fmt.Printf("Target package: %s\n\n", absTarget)
+	// --json replaces the report with the selected functions
+	var selected []selectedFunc
+	if !*jsonOut {
+		fmt.Printf("Would instrument module at: %s\n", moduleRoot)
+		fmt.Printf("Target package: %s\n\n", absTarget)
+	}
 
-	return filepath.WalkDir(moduleRoot, func(path string, d fs.DirEntry, err error) error {
+	replacedDirs := localReplaceDirs(moduleRoot)
+	traceDirs := make(map[string]bool)
+	err = filepath.WalkDir(moduleRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -114,9 +309,25 @@ func previewInstrumentation(target string) error {
 			if base == "vendor" || base == "testdata" || (strings.HasPrefix(base, ".") && base != "." && base != "..") {
 				return filepath.SkipDir
 			}
+			if rel, err := filepath.Rel(moduleRoot, path); err == nil && isSkippedDir(rel) {
+				return filepath.SkipDir
+			}
+			if path != moduleRoot && !replacedDirs[path] {
+				if modPath, err := readModulePath(filepath.Join(path, "go.mod")); err == nil {
+					if !*jsonOut {
+						fmt.Printf("Would skip nested module %s (%s): not replaced by a local path in go.mod\n", path, modPath)
+					}
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		isTest := strings.HasSuffix(path, "_test.go")
+		if !strings.HasSuffix(path, ".go") || isTest && !*testMode {
 			return nil
 		}
-		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+		// Copies of the trace package are never instrumented
+		if isTracePackageDir(filepath.Dir(path), traceDirs) {
 			return nil
 		}
 
@@ -131,26 +342,46 @@ func previewInstrumentation(target string) error {
 			return nil // Skip unparseable files
 		}
 
-		// Check if instrumentation would modify
-		hasFunc := false
-		ast.Inspect(node, func(n ast.Node) bool {
-			if fn, ok := n.(*ast.FuncDecl); ok && fn.Body != nil && len(fn.Body.List) > 0 {
-				if *pattern == "" || strings.Contains(funcName(fn), *pattern) {
-					if !hasTraceDefer(fn.Body) {
-						hasFunc = true
-						return false
-					}
-				}
-			}
-			return true
-		})
-
-		if hasFunc {
-			rel, _ := filepath.Rel(moduleRoot, path)
+		// Select functions the way instrumentFileText does
+		rel, _ := filepath.Rel(moduleRoot, path)
+		funcs := selectFuncs(fset, node, path, filepath.ToSlash(rel))
+		if *jsonOut {
+			selected = append(selected, funcs...)
+		} else if len(funcs) > 0 {
 			fmt.Printf("  Would instrument: %s\n", rel)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if !*jsonOut {
+		previewGoMod(moduleRoot)
+		return nil
+	}
+	return writeSelectedJSON(os.Stdout, selected)
+}
+
+// previewGoMod prints the require and replace lines instrumentGoMod would
+// add to or drop from the module's go.mod. go mod tidy may add more.
+func previewGoMod(moduleRoot string) {
+	content, err := os.ReadFile(filepath.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		return
+	}
+	updated, err := instrumentGoMod(content, moduleRoot)
+	if err != nil {
+		fmt.Printf("\nWould fail to update go.mod: %v\n", err)
+		return
+	}
+	changes, err := goModChanges(content, updated)
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	fmt.Printf("\nWould update go.mod (before go mod tidy):\n")
+	for _, line := range changes {
+		fmt.Printf("  %s\n", line)
+	}
 }
 
 // allowedFuncs is set when --until is used to filter instrumentation to call path only.
@@ -163,6 +394,12 @@ var targetFunction string
 func instrumentAST(node *ast.File) bool {
 	modified := false
 
+	// Reuse the file's own trace import if it has one
+	alias, imported := traceImportName(node)
+	if !imported {
+		alias = tracePkgAlias
+	}
+
 	ast.Inspect(node, func(n ast.Node) bool {
 		fn, ok := n.(*ast.FuncDecl)
 		if !ok || fn.Body == nil || len(fn.Body.List) == 0 {
@@ -181,12 +418,16 @@ func instrumentAST(node *ast.File) bool {
 		if targetFunction != "" && name != targetFunction {
 			return true
 		}
-		if hasTraceDefer(fn.Body) {
+		if hasTraceDefer(fn.Body, alias) {
 			return true
 		}
 
 		// Build trace call with args
-		args := []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", name)}}
+		args := []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", traceLabel(fn))}}
+		recv := receiverName(fn)
+		if recv != "" && *withReceiver {
+			args = append(args, ast.NewIdent(recv))
+		}
 		if fn.Type.Params != nil {
 			for _, field := range fn.Type.Params.List {
 				for _, paramName := range field.Names {
@@ -201,19 +442,37 @@ func instrumentAST(node *ast.File) bool {
 
 		// Choose trace function based on filters
 		traceFuncName := "Trace"
-		if *filters == "panic" {
+		switch {
+		case *filters == "panic":
 			traceFuncName = "TraceOnPanic"
+		case recv != "" && *withReceiver:
+			// Method marks the first argument as the receiver
+			traceFuncName = "Method"
+		}
+
+		// Named results are passed by pointer and read when the defer runs
+		var results []ast.Expr
+		if names := namedResults(fn); len(names) > 0 {
+			var ptrs []ast.Expr
+			for _, name := range names {
+				ptrs = append(ptrs, &ast.UnaryExpr{Op: token.AND, X: ast.NewIdent(name)})
+			}
+			results = append(results, &ast.CallExpr{
+				Fun:  &ast.SelectorExpr{X: ast.NewIdent(alias), Sel: ast.NewIdent("Results")},
+				Args: ptrs,
+			})
 		}
 
 		deferStmt := &ast.DeferStmt{
 			Call: &ast.CallExpr{
 				Fun: &ast.CallExpr{
 					Fun: &ast.SelectorExpr{
-						X:   ast.NewIdent(tracePkgAlias),
+						X:   ast.NewIdent(alias),
 						Sel: ast.NewIdent(traceFuncName),
 					},
 					Args: args,
 				},
+				Args: results,
 			},
 		}
 
@@ -222,34 +481,44 @@ func instrumentAST(node *ast.File) bool {
 		return true
 	})
 
-	if modified {
+	if !modified {
+		return false
+	}
+	if !imported {
 		addImportWithAlias(node, tracePkg, tracePkgAlias)
 	}
 
 	// Add PrintSummary or PrintFunctionStats to main if present
 	ast.Inspect(node, func(n ast.Node) bool {
-		fn, ok := n.(*ast.FuncDecl)
-		if !ok || fn.Name.Name != "main" || fn.Recv != nil {
+		decl, ok := n.(ast.Decl)
+		if !ok || !isProgramMain(node, decl) {
 			return true
 		}
-		var summaryCall *ast.ExprStmt
+		fn := decl.(*ast.FuncDecl)
+		for _, stmt := range fn.Body.List {
+			if isTraceSummary(stmt, alias) {
+				return false
+			}
+		}
+		var summaryCall *ast.CallExpr
 		if targetFunction != "" {
 			// --function mode: use PrintFunctionStats
-			summaryCall = &ast.ExprStmt{
-				X: &ast.CallExpr{
-					Fun:  &ast.SelectorExpr{X: ast.NewIdent(tracePkgAlias), Sel: ast.NewIdent("PrintFunctionStats")},
-					Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", targetFunction)}},
-				},
+			summaryCall = &ast.CallExpr{
+				Fun:  &ast.SelectorExpr{X: ast.NewIdent(alias), Sel: ast.NewIdent("PrintFunctionStats")},
+				Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", targetFunction)}},
 			}
 		} else {
 			// Normal mode: use PrintSummary
-			summaryCall = &ast.ExprStmt{
-				X: &ast.CallExpr{
-					Fun: &ast.SelectorExpr{X: ast.NewIdent(tracePkgAlias), Sel: ast.NewIdent("PrintSummary")},
-				},
+			summaryCall = &ast.CallExpr{
+				Fun: &ast.SelectorExpr{X: ast.NewIdent(alias), Sel: ast.NewIdent("PrintSummary")},
 			}
 		}
-		fn.Body.List = append(fn.Body.List, summaryCall)
+		if *summaryAtEnd {
+			fn.Body.List = append(fn.Body.List, &ast.ExprStmt{X: summaryCall})
+		} else {
+			// Deferred first, so it runs last on every return path
+			fn.Body.List = append([]ast.Stmt{&ast.DeferStmt{Call: summaryCall}}, fn.Body.List...)
+		}
 		return false
 	})
 
@@ -275,16 +544,67 @@ func funcName(fn *ast.FuncDecl) string {
 	return fn.Name.Name
 }
 
-func hasTraceDefer(body *ast.BlockStmt) bool {
+// nameDirective overrides the traced name of the function it documents:
+//
+//	//gotrace:name "CustomLabel"
+const nameDirective = "//gotrace:name "
+
+// traceLabel returns the name fn is traced under: the //gotrace:name
+// directive's label if it has one, otherwise funcName. Filters such as
+// --pattern and --until still match funcName.
+func traceLabel(fn *ast.FuncDecl) string {
+	if fn.Doc != nil {
+		for _, c := range fn.Doc.List {
+			arg, ok := strings.CutPrefix(c.Text, nameDirective)
+			if !ok {
+				continue
+			}
+			arg = strings.TrimSpace(arg)
+			if label, err := strconv.Unquote(arg); err == nil {
+				arg = label
+			}
+			if arg != "" {
+				return arg
+			}
+		}
+	}
+	return funcName(fn)
+}
+
+// traceImportName returns the name under which node imports the trace
+// package, if it does. Blank and dot imports are ignored since they can't be
+// used to qualify the injected calls.
+func traceImportName(node *ast.File) (string, bool) {
+	for _, imp := range node.Imports {
+		if imp.Path.Value != fmt.Sprintf("%q", tracePkg) {
+			continue
+		}
+		if imp.Name == nil {
+			return "trace", true
+		}
+		if imp.Name.Name != "_" && imp.Name.Name != "." {
+			return imp.Name.Name, true
+		}
+	}
+	return "", false
+}
+
+// isTraceQualifier reports whether name refers to the trace package, either
+// through one of the well-known names or the file's own import alias.
+func isTraceQualifier(name, alias string) bool {
+	return name == "trace" || name == tracePkgAlias || (alias != "" && name == alias)
+}
+
+func hasTraceDefer(body *ast.BlockStmt, alias string) bool {
 	for _, stmt := range body.List {
-		if isTraceDefer(stmt) {
+		if isTraceDefer(stmt, alias) {
 			return true
 		}
 	}
 	return false
 }
 
-func isTraceDefer(stmt ast.Stmt) bool {
+func isTraceDefer(stmt ast.Stmt, alias string) bool {
 	def, ok := stmt.(*ast.DeferStmt)
 	if !ok {
 		return false
@@ -301,21 +621,24 @@ func isTraceDefer(stmt ast.Stmt) bool {
 	if !ok {
 		return false
 	}
-	// Match both old "trace" and new alias
-	if id.Name != "trace" && id.Name != tracePkgAlias {
+	if !isTraceQualifier(id.Name, alias) {
 		return false
 	}
-	// Match both Trace and TraceOnPanic
-	return sel.Sel.Name == "Trace" || sel.Sel.Name == "TraceOnPanic"
+	// Match Trace, Method and TraceOnPanic
+	return sel.Sel.Name == "Trace" || sel.Sel.Name == "Method" || sel.Sel.Name == "TraceOnPanic"
 }
 
-func isTraceSummary(stmt ast.Stmt) bool {
-	expr, ok := stmt.(*ast.ExprStmt)
-	if !ok {
-		return false
-	}
-	call, ok := expr.X.(*ast.CallExpr)
-	if !ok {
+// isTraceSummary reports whether stmt prints the trace summary, either
+// directly or deferred.
+func isTraceSummary(stmt ast.Stmt, alias string) bool {
+	var call *ast.CallExpr
+	switch s := stmt.(type) {
+	case *ast.ExprStmt:
+		call, _ = s.X.(*ast.CallExpr)
+	case *ast.DeferStmt:
+		call = s.Call
+	}
+	if call == nil {
 		return false
 	}
 	sel, ok := call.Fun.(*ast.SelectorExpr)
@@ -326,8 +649,7 @@ func isTraceSummary(stmt ast.Stmt) bool {
 	if !ok {
 		return false
 	}
-	// Match both old "trace" and new alias
-	return (id.Name == "trace" || id.Name == tracePkgAlias) && (sel.Sel.Name == "PrintSummary" || sel.Sel.Name == "PrintFunctionStats")
+	return isTraceQualifier(id.Name, alias) && (sel.Sel.Name == "PrintSummary" || sel.Sel.Name == "PrintFunctionStats")
 }
 
 func addImportWithAlias(node *ast.File, path, alias string) {
@@ -384,6 +706,16 @@ func fatal(err error) {
 	os.Exit(1)
 }
 
+// resolveTarget returns the absolute, symlink-free path of target so that
+// walking up to the enclosing go.mod follows the real directory layout.
+func resolveTarget(target string) (string, error) {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
 func findModuleRoot(dir string) (string, error) {
 	current := dir
 	for {
@@ -457,6 +789,12 @@ func hasReplace(mod *modfile.File, oldPath, newPath string) bool {
 	return false
 }
 
+// setTraceModule points instrumentation at the trace package of module path.
+func setTraceModule(path string) {
+	traceModule = path
+	tracePkg = path + "/trace"
+}
+
 func resolveTraceVersion() string {
 	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Path == traceModule {
 		if version := strings.TrimSpace(info.Main.Version); version != "" && version != "(devel)" {
@@ -2,13 +2,25 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"maps"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/napolitain/gotrace/trace"
 )
 
 func TestInstrumentAST_AddsDeferTrace(t *testing.T) {
@@ -35,7 +47,7 @@ func hello() {
 	ast.Inspect(node, func(n ast.Node) bool {
 		if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == "hello" {
 			if len(fn.Body.List) > 0 {
-				if isTraceDefer(fn.Body.List[0]) {
+				if isTraceDefer(fn.Body.List[0], tracePkgAlias) {
 					hasTraceDefer = true
 				}
 			}
@@ -132,7 +144,7 @@ func main() {
 	ast.Inspect(node, func(n ast.Node) bool {
 		if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == "main" {
 			for _, stmt := range fn.Body.List {
-				if isTraceSummary(stmt) {
+				if isTraceSummary(stmt, tracePkgAlias) {
 					hasPrintSummary = true
 				}
 			}
@@ -145,6 +157,243 @@ func main() {
 	}
 }
 
+func TestInstrumentFile_DefersSummaryAtTopOfMain(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *summaryAtEnd
+	defer func() { *summaryAtEnd = old }()
+
+	src := `package main
+
+import "os"
+
+func main() {
+	if len(os.Args) > 1 {
+		return
+	}
+	println("done")
+}
+`
+	*summaryAtEnd = false
+	result, err := instrumentFileText("main.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	node, err := parser.ParseFile(token.NewFileSet(), "main.go", result, 0)
+	if err != nil {
+		t.Fatalf("instrumented output does not parse: %v\n%s", err, result)
+	}
+	var body []ast.Stmt
+	for _, decl := range node.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "main" {
+			body = fn.Body.List
+		}
+	}
+	if len(body) < 2 {
+		t.Fatalf("expected summary and trace defers in main, got:\n%s", result)
+	}
+	if _, ok := body[0].(*ast.DeferStmt); !ok || !isTraceSummary(body[0], tracePkgAlias) {
+		t.Fatalf("expected first statement of main to defer the summary, got:\n%s", result)
+	}
+	if !isTraceDefer(body[1], tracePkgAlias) {
+		t.Fatalf("expected main's trace defer after the summary defer, got:\n%s", result)
+	}
+	if strings.Count(string(result), "PrintSummary") != 1 {
+		t.Fatalf("expected exactly one summary, got:\n%s", result)
+	}
+
+	// Single-line main stays valid
+	result, err = instrumentFileText("main.go", []byte("package main\n\nfunc main() { println(1) }\n"))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", result, 0); err != nil {
+		t.Fatalf("single-line main does not parse: %v\n%s", err, result)
+	}
+
+	*summaryAtEnd = true
+	result, err = instrumentFileText("main.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	if !strings.Contains(string(result), "\n\t"+tracePkgAlias+".PrintSummary()}") || strings.Contains(string(result), "defer "+tracePkgAlias+".PrintSummary") {
+		t.Fatalf("expected --summary-at-end to append a plain statement, got:\n%s", result)
+	}
+}
+
+func TestInstrumentFile_CapturesNamedResults(t *testing.T) {
+	t.Parallel()
+	src := `package calc
+
+func split(sum int) (x, _ int, err error) {
+	x = sum * 4 / 9
+	return
+}
+
+func double(n int) int {
+	return n * 2
+}
+`
+	result, err := instrumentFileText("calc.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	out := string(result)
+	if !strings.Contains(out, `Trace("split", sum)(`+tracePkgAlias+`.Results(&x, &err))`) {
+		t.Fatalf("expected named results to be captured by pointer, got:\n%s", out)
+	}
+	if !strings.Contains(out, `Trace("double", n)()`) {
+		t.Fatalf("expected unnamed results to be left alone, got:\n%s", out)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "calc.go", result, 0); err != nil {
+		t.Fatalf("instrumented output does not parse: %v\n%s", err, result)
+	}
+}
+
+func TestInstrumentFile_CaptureReceiver(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *withReceiver
+	defer func() { *withReceiver = old }()
+	*withReceiver = true
+
+	src := `package shop
+
+type Cart struct{ items []string }
+
+func (c *Cart) Add(item string) { c.items = append(c.items, item) }
+
+func (Cart) Kind() string { return "cart" }
+
+func (_ Cart) Empty() bool { return true }
+
+func Total(n int) int { return n }
+`
+	result, err := instrumentFileText("shop.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	out := string(result)
+	for _, want := range []string{`Method("Cart.Add", c, item)()`, `Trace("Cart.Kind")()`, `Trace("Cart.Empty")()`, `Trace("Total", n)()`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in output, got:\n%s", want, out)
+		}
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "shop.go", result, 0); err != nil {
+		t.Fatalf("instrumented output does not parse: %v\n%s", err, result)
+	}
+}
+
+func TestInstrumentFile_SingleLineEdgeCases(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		src  string
+		want string // Expected instrumented body; "" means unchanged
+	}{
+		{"empty body", "func f() {}\n", ""},
+		{"empty body with comment", "func f() { // nothing yet\n}\n", ""},
+		{"no trailing newline", "func f() { return }", `func f() { defer ` + tracePkgAlias + `.Trace("f")(); return }`},
+		{"go statement", "func f() { go g() }\n", `func f() { defer ` + tracePkgAlias + `.Trace("f")(); go g() }`},
+		{"block comment before statement", "func f() { /* why */ g() }\n", `func f() { defer ` + tracePkgAlias + `.Trace("f")(); /* why */ g() }`},
+		{"trailing comment after body", "func f() { g() } // done\n", `func f() { defer ` + tracePkgAlias + `.Trace("f")(); g() } // done`},
+		{"comment after brace", "func f() { // note\n\tg()\n}\n", "func f() { // note\n\tdefer " + tracePkgAlias + `.Trace("f")()` + "\n\tg()\n}"},
+		{"crlf line endings", "func f() {\r\n\tg()\r\n}\r\n", "func f() {\n\tdefer " + tracePkgAlias + `.Trace("f")()` + "\r\n\tg()"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "package p\n\nfunc g() {\n}\n\n" + tt.src
+			result, err := instrumentFileText("p.go", []byte(src))
+			if err != nil {
+				t.Fatalf("instrumentFileText: %v", err)
+			}
+			out := string(result)
+			want := tt.want
+			if want == "" {
+				want = tt.src
+			}
+			if !strings.Contains(out, want) {
+				t.Fatalf("expected %q in output, got:\n%s", want, out)
+			}
+			if _, err := parser.ParseFile(token.NewFileSet(), "p.go", result, 0); err != nil {
+				t.Fatalf("instrumented output does not parse: %v\n%s", err, result)
+			}
+		})
+	}
+}
+
+func TestInstrumentFile_NoSummaryInMethodNamedMain(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+type runner struct{}
+
+func (runner) main() {
+	println("method")
+}
+
+func helper() {
+	println("helper")
+}
+`
+	result, err := instrumentFileText("runner.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	out := string(result)
+	if !strings.Contains(out, `Trace("runner.main")`) {
+		t.Fatalf("expected the method to be traced as runner.main, got:\n%s", out)
+	}
+	if strings.Contains(out, "PrintSummary") {
+		t.Fatalf("expected no summary in a method named main, got:\n%s", out)
+	}
+
+	// func main() outside package main is not the program entry point either
+	lib := "package lib\n\nfunc main() {\n\tprintln(\"lib\")\n}\n"
+	result, err = instrumentFileText("lib.go", []byte(lib))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	if strings.Contains(string(result), "PrintSummary") {
+		t.Fatalf("expected no summary in a non-main package, got:\n%s", result)
+	}
+}
+
+func TestInstrumentFile_NameDirectiveOverridesLabel(t *testing.T) {
+	t.Parallel()
+	src := `package store
+
+type cache struct{}
+
+// Get looks up key.
+//
+//gotrace:name "cache.Get(hot)"
+func (c *cache) Get(key string) string {
+	return key
+}
+
+//gotrace:name setup
+func init() {
+	println("init")
+}
+
+func plain() {
+	println("plain")
+}
+`
+	result, err := instrumentFileText("store.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	out := string(result)
+	for _, want := range []string{`Trace("cache.Get(hot)", key)`, `Trace("setup")`, `Trace("plain")`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `Trace("cache.Get", key)`) {
+		t.Errorf("expected the directive to replace the default name, got:\n%s", out)
+	}
+}
+
 func TestInstrumentFile_ReturnsOriginalIfNoFunctions(t *testing.T) {
 	t.Parallel()
 	src := `package main
@@ -222,10 +471,10 @@ func TestCopyAndInstrumentModule_SkipsVendorAndTestdata(t *testing.T) {
 	// Create a minimal module structure
 	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
 	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
-	
+
 	os.MkdirAll(filepath.Join(tempSrc, "vendor"), 0755)
 	os.WriteFile(filepath.Join(tempSrc, "vendor", "vendor.go"), []byte("package vendor\n"), 0644)
-	
+
 	os.MkdirAll(filepath.Join(tempSrc, "testdata"), 0755)
 	os.WriteFile(filepath.Join(tempSrc, "testdata", "test.go"), []byte("package testdata\n"), 0644)
 
@@ -249,93 +498,1719 @@ func TestCopyAndInstrumentModule_SkipsVendorAndTestdata(t *testing.T) {
 	}
 }
 
-func TestPreviewInstrumentation_ListsFilesToInstrument(t *testing.T) {
-	// Create temp directory with a simple Go file
-	tempDir := t.TempDir()
-	os.WriteFile(filepath.Join(tempDir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
-	os.WriteFile(filepath.Join(tempDir, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+func TestCopyAndInstrumentModule_BuildTaggedDuplicates(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
 
-	// Capture output
-	old := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\trun()\n}\n"), 0644)
+	for _, goos := range []string{"linux", "windows"} {
+		src := fmt.Sprintf("//go:build %s\n\npackage main\n\nfunc run() {\n\tprintln(%q)\n}\n", goos, goos)
+		os.WriteFile(filepath.Join(tempSrc, "run_"+goos+".go"), []byte(src), 0644)
+	}
 
-	*dryRun = true
-	err := previewInstrumentation(tempDir)
-	*dryRun = false
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
 
-	w.Close()
-	os.Stdout = old
+	// Each implementation is instrumented and still selected by its own constraint only
+	for _, goos := range []string{"linux", "windows"} {
+		name := "run_" + goos + ".go"
+		content, _ := os.ReadFile(filepath.Join(tempDst, name))
+		if !strings.Contains(string(content), `Trace("run")()`) {
+			t.Errorf("expected %s to be instrumented, got:\n%s", name, content)
+		}
+		for _, ctxGOOS := range []string{"linux", "windows"} {
+			ctx := build.Default
+			ctx.GOOS = ctxGOOS
+			match, err := ctx.MatchFile(tempDst, name)
+			if err != nil {
+				t.Fatalf("MatchFile(%s): %v", name, err)
+			}
+			if match != (ctxGOOS == goos) {
+				t.Errorf("expected %s to build only for %s, matched GOOS=%s: %v", name, goos, ctxGOOS, match)
+			}
+		}
+	}
+}
+
+func TestCopyAndInstrumentModule_LeavesVendoredTracePackageAlone(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+
+	// The app replaces gotrace with a copy kept in its own tree
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n\nrequire "+traceModule+" v0.0.0\n\nreplace "+traceModule+" => ./third_party/gotrace\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+	vendored := filepath.Join(tempSrc, "third_party", "gotrace")
+	os.MkdirAll(filepath.Join(vendored, "trace"), 0755)
+	os.MkdirAll(filepath.Join(vendored, "cmd", "gotrace"), 0755)
+	os.WriteFile(filepath.Join(vendored, "go.mod"), []byte("module "+traceModule+"\n\ngo 1.21\n"), 0644)
+	traceSrc := "package trace\n\nconst gotraceRuntime = true\n\nfunc Trace(name string, args ...any) func(...any) {\n\treturn func(...any) {}\n}\n"
+	os.WriteFile(filepath.Join(vendored, "trace", "trace.go"), []byte(traceSrc), 0644)
+	os.WriteFile(filepath.Join(vendored, "cmd", "gotrace", "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"tool\")\n}\n"), 0644)
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(tempDst, "third_party", "gotrace", "trace", "trace.go")); string(content) != traceSrc {
+		t.Fatalf("expected the vendored trace package to be copied as-is, got:\n%s", content)
+	}
+	if _, err := os.Stat(filepath.Join(tempDst, "third_party", "gotrace", "cmd", "gotrace")); !os.IsNotExist(err) {
+		t.Error("expected the vendored gotrace command to be skipped")
+	}
+	if content, _ := os.ReadFile(filepath.Join(tempDst, "main.go")); !strings.Contains(string(content), "Trace(\"main\")") {
+		t.Errorf("expected main.go to be instrumented, got:\n%s", content)
+	}
+}
+
+func TestCopyAndInstrumentModule_InstrumentsRestOfManuallyTracedFile(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
 
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	src := "package main\n\nimport \"" + tracePkg + "\"\n\nfunc manual() {\n\tdefer trace.Trace(\"manual\")()\n}\n\nfunc untraced() {\n\tprintln(\"hi\")\n}\n\nfunc main() {\n\tmanual()\n\tuntraced()\n}\n"
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte(src), 0644)
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tempDst, "main.go"))
 	if err != nil {
-		t.Fatalf("previewInstrumentation: %v", err)
+		t.Fatal(err)
+	}
+	out := string(content)
+	if !strings.Contains(out, "defer trace.Trace(\"untraced\")()") || !strings.Contains(out, "defer trace.Trace(\"main\")()") {
+		t.Errorf("expected the untraced functions to be instrumented with the existing import, got:\n%s", out)
+	}
+	if n := strings.Count(out, "Trace(\"manual\")"); n != 1 {
+		t.Errorf("expected the manual trace to be left alone, found %d, got:\n%s", n, out)
+	}
+	if strings.Contains(out, tracePkgAlias) {
+		t.Errorf("expected no second trace import, got:\n%s", out)
 	}
+}
 
-	var buf bytes.Buffer
-	buf.ReadFrom(r)
-	output := buf.String()
+func TestCopyAndInstrumentModule_KeepGoingCollectsErrors(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldKeep := *keepGoing
+	defer func() { *keepGoing = oldKeep; keptErrs = nil }()
 
-	if !strings.Contains(output, "main.go") {
-		t.Errorf("expected output to mention main.go, got:\n%s", output)
+	tempSrc := t.TempDir()
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	broken := "package bad\n\nfunc Broken( {\n"
+	for _, pkg := range []string{"a", "b", "bad", "c"} {
+		os.MkdirAll(filepath.Join(tempSrc, pkg), 0755)
+		src := "package " + pkg + "\n\nfunc Work() int {\n\treturn 1\n}\n"
+		if pkg == "bad" {
+			src = broken
+		}
+		os.WriteFile(filepath.Join(tempSrc, pkg, pkg+".go"), []byte(src), 0644)
+	}
+
+	*keepGoing = false
+	if err := copyAndInstrumentModule(tempSrc, t.TempDir()); err == nil {
+		t.Fatal("expected the broken package to abort the copy without --keep-going")
+	}
+
+	*keepGoing = true
+	tempDst := t.TempDir()
+	captureStdout(t, func() {
+		if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+			t.Fatalf("copyAndInstrumentModule: %v", err)
+		}
+	})
+	for _, pkg := range []string{"a", "b", "c"} {
+		content, err := os.ReadFile(filepath.Join(tempDst, pkg, pkg+".go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), `Trace("Work")`) {
+			t.Errorf("expected package %s to be instrumented past the broken one, got:\n%s", pkg, content)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(tempDst, "bad", "bad.go")); string(content) != broken {
+		t.Errorf("expected the broken file to be copied as-is, got:\n%s", content)
+	}
+	err := keptError()
+	if err == nil || !strings.Contains(err.Error(), "1 file(s) could not be instrumented") || strings.Count(err.Error(), filepath.Join("bad", "bad.go")) != 1 {
+		t.Errorf("expected the broken file in the final error, got %v", err)
 	}
 }
 
-func TestInstrumentAST_WithAllowedFuncs(t *testing.T) {
-	// NOTE: Not parallel because it modifies global allowedFuncs
-	src := `package main
+func TestCopyAndInstrumentModule_TestModeTracesTestHelpers(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldTest := *testMode
+	defer func() { *testMode = oldTest }()
+	*testMode = true
 
-func main() {
-	helper()
-	other()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "parse.go"), []byte("package parse\n\nfunc Parse(s string) int {\n\treturn len(s)\n}\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "parse_test.go"), []byte(`package parse
+
+import "testing"
+
+func parseAll(t *testing.T, inputs ...string) int {
+	n := 0
+	for _, in := range inputs {
+		n += Parse(in)
+	}
+	return n
 }
 
-func helper() {
-	println("helper")
+func TestParse(t *testing.T) {
+	if parseAll(t, "a", "bc") != 3 {
+		t.Fatal("bad length")
+	}
 }
 
-func other() {
-	println("other")
+func BenchmarkParse(b *testing.B) {
+	for range b.N {
+		Parse("abc")
+	}
 }
-`
-	// Save and restore global state
-	oldAllowed := allowedFuncs
-	defer func() { allowedFuncs = oldAllowed }()
 
-	// Only allow "main" and "helper" to be instrumented
-	allowedFuncs = map[string]bool{
-		"main":   true,
-		"helper": true,
+func Testify() {
+	println("not a test")
+}
+`), 0644)
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(tempDst, "parse_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(content)
+	for _, want := range []string{`Trace("parseAll", t, inputs)`, `Trace("Testify")`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in the test file, got:\n%s", want, out)
+		}
+	}
+	for _, harness := range []string{`Trace("TestParse"`, `Trace("BenchmarkParse"`} {
+		if strings.Contains(out, harness) {
+			t.Errorf("expected %s to stay untraced, got:\n%s", harness, out)
+		}
 	}
 
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, "test.go", src, parser.ParseComments)
+	if err := addTestSummary(tempDst); err != nil {
+		t.Fatalf("addTestSummary: %v", err)
+	}
+	main, err := os.ReadFile(filepath.Join(tempDst, testMainFile))
 	if err != nil {
-		t.Fatalf("parse: %v", err)
+		t.Fatalf("expected a TestMain to be added: %v", err)
 	}
+	if !strings.HasPrefix(string(main), "package parse\n") || !strings.Contains(string(main), "code := m.Run()\n\t"+tracePkgAlias+".PrintSummary()") {
+		t.Errorf("unexpected TestMain:\n%s", main)
+	}
+}
 
-	modified := instrumentAST(node)
-	if !modified {
-		t.Fatal("expected AST to be modified")
+func TestRunGoModTidy_RetriesTransientFailures(t *testing.T) {
+	// NOTE: Not parallel because it modifies PATH and tidyBackoff
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go command is a shell script")
 	}
+	oldBackoff := tidyBackoff
+	defer func() { tidyBackoff = oldBackoff }()
+	tidyBackoff = time.Millisecond
 
-	// Check which functions were instrumented
-	instrumented := make(map[string]bool)
-	ast.Inspect(node, func(n ast.Node) bool {
-		if fn, ok := n.(*ast.FuncDecl); ok && fn.Body != nil {
-			if len(fn.Body.List) > 0 && isTraceDefer(fn.Body.List[0]) {
-				instrumented[fn.Name.Name] = true
-			}
+	// A fake go that fails until it has been run failures times
+	fakeGo := func(t *testing.T, failures int) string {
+		bin := t.TempDir()
+		count := filepath.Join(bin, "count")
+		script := fmt.Sprintf("#!/bin/sh\necho x >> %q\n[ $(wc -l < %q) -gt %d ]\n", count, count, failures)
+		if err := os.WriteFile(filepath.Join(bin, "go"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		return count
+	}
+	runs := func(count string) int {
+		data, _ := os.ReadFile(count)
+		return strings.Count(string(data), "\n")
+	}
+
+	t.Run("fails then succeeds", func(t *testing.T) {
+		count := fakeGo(t, 1)
+		if err := runGoModTidy(t.TempDir()); err != nil {
+			t.Fatalf("expected the retry to succeed, got %v", err)
+		}
+		if got := runs(count); got != 2 {
+			t.Fatalf("expected 2 runs, got %d", got)
+		}
+	})
+	t.Run("gives up", func(t *testing.T) {
+		count := fakeGo(t, 10)
+		err := runGoModTidy(t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("failed after %d attempts", tidyAttempts)) {
+			t.Fatalf("expected a final error naming the attempts, got %v", err)
+		}
+		if got := runs(count); got != tidyAttempts {
+			t.Fatalf("expected %d runs, got %d", tidyAttempts, got)
 		}
-		return true
 	})
+}
 
-	if !instrumented["main"] {
-		t.Error("expected main to be instrumented")
+func TestRunBinary_ReturnsChildExitCode(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake program is a shell script")
 	}
-	if !instrumented["helper"] {
-		t.Error("expected helper to be instrumented")
+	bin := filepath.Join(t.TempDir(), "prog")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
 	}
-	if instrumented["other"] {
-		t.Error("expected other to NOT be instrumented (not in allowedFuncs)")
+
+	// Returned rather than exiting, so RunHot still cleans up and reports
+	err := runBinary(bin, nil)
+	var exit *childExitError
+	if !errors.As(err, &exit) || exit.code != 3 {
+		t.Fatalf("expected the child's exit code 3, got %v", err)
+	}
+}
+
+func TestCopyAndInstrumentModule_LeavesTracePackageCopyUnderOtherPathAlone(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+
+	// A copy of the trace package moved into the app's own module, so its
+	// import path says nothing about what it is
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+	os.MkdirAll(filepath.Join(tempSrc, "internal", "tracecopy"), 0755)
+	os.MkdirAll(filepath.Join(tempSrc, "internal", "trace"), 0755)
+	copySrc := "package trace\n\nconst (\n\tgotraceRuntime = true\n\tother          = 1\n)\n\nfunc Trace(name string, args ...any) func(...any) {\n\treturn func(...any) {}\n}\n"
+	os.WriteFile(filepath.Join(tempSrc, "internal", "tracecopy", "trace.go"), []byte(copySrc), 0644)
+	// A package merely named trace is the app's own code
+	ownSrc := "package trace\n\n// gotraceRuntime is only mentioned here\nfunc Span() {\n\tprintln(\"span\")\n}\n"
+	os.WriteFile(filepath.Join(tempSrc, "internal", "trace", "span.go"), []byte(ownSrc), 0644)
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(tempDst, "internal", "tracecopy", "trace.go")); string(content) != copySrc {
+		t.Fatalf("expected the trace package copy to be copied as-is, got:\n%s", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(tempDst, "internal", "trace", "span.go")); !strings.Contains(string(content), "Trace(\"Span\")") {
+		t.Errorf("expected the app's own trace package to be instrumented, got:\n%s", content)
+	}
+}
+
+func TestPreviewInstrumentation_JSONListsSelectedFuncs(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	src := "package main\n\nfunc main() {\n\thandleRequest()\n}\n\n//gotrace:name \"handle\"\nfunc handleRequest() {\n\tprintln(\"hi\")\n}\n\nfunc empty() {}\n"
+	os.WriteFile(filepath.Join(tempDir, "main.go"), []byte(src), 0644)
+
+	*jsonOut = true
+	defer func() { *jsonOut = false }()
+	var err error
+	output := captureStdout(t, func() {
+		err = previewInstrumentation(tempDir)
+	})
+	if err != nil {
+		t.Fatalf("previewInstrumentation: %v", err)
+	}
+
+	var funcs []selectedFunc
+	if err := json.Unmarshal([]byte(output), &funcs); err != nil {
+		t.Fatalf("expected a JSON array, got %v:\n%s", err, output)
+	}
+	want := []selectedFunc{
+		{Name: "main", File: "main.go", Line: 3, Reason: "no filters"},
+		{Name: "handleRequest", Label: "handle", File: "main.go", Line: 8, Reason: "no filters"},
+	}
+	if !slices.Equal(funcs, want) {
+		t.Fatalf("expected %+v, got %+v", want, funcs)
+	}
+}
+
+func TestPreviewInstrumentation_JSONSkipsTestHarnessFuncs(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "m.go"), []byte("package m\n\nfunc Add(a, b int) int {\n\treturn a + b\n}\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "m_test.go"), []byte(`package m
+
+import "testing"
+
+func TestMain(m *testing.M) {
+	m.Run()
+}
+
+func TestAdd(t *testing.T) {
+	check(t, Add(1, 2))
+}
+
+func BenchmarkAdd(b *testing.B) {
+	Add(1, 2)
+}
+
+func ExampleAdd() {
+	println(Add(1, 2))
+}
+
+func check(t *testing.T, n int) {
+	println(n)
+}
+`), 0644)
+
+	oldTest := *testMode
+	defer func() { *testMode = oldTest }()
+	*testMode = true
+	if names, want := previewNames(t, tempDir), []string{"Add", "check"}; !slices.Equal(names, want) {
+		t.Fatalf("expected %v selected, without the testing harness funcs, got %v", want, names)
+	}
+}
+
+// previewNames runs the list --json preview of dir and returns the names of
+// the selected functions.
+func previewNames(t *testing.T, dir string) []string {
+	t.Helper()
+	old := *jsonOut
+	defer func() { *jsonOut = old }()
+	*jsonOut = true
+	var err error
+	output := captureStdout(t, func() {
+		err = previewInstrumentation(dir)
+	})
+	if err != nil {
+		t.Fatalf("previewInstrumentation: %v", err)
+	}
+	var funcs []selectedFunc
+	if err := json.Unmarshal([]byte(output), &funcs); err != nil {
+		t.Fatalf("expected a JSON array, got %v:\n%s", err, output)
+	}
+	var names []string
+	for _, f := range funcs {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestPreviewInstrumentation_AppliesChanged(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldChanged := *changed
+	defer func() { *changed = oldChanged; changedLines = nil }()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	src := "package main\n\nfunc main() {\n\tedited()\n\tuntouched()\n}\n\nfunc edited() {\n\tprintln(1)\n}\n\nfunc untouched() {\n\tprintln(2)\n}\n"
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644)
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte(strings.Replace(src, "println(1)", "println(10)", 1)), 0644)
+
+	*changed = "HEAD"
+	if names, want := previewNames(t, dir), []string{"main", "edited"}; !slices.Equal(names, want) {
+		t.Fatalf("expected list to select %v like the run, got %v", want, names)
+	}
+}
+
+func TestPreviewInstrumentation_AppliesPkgs(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldPkgs := *pkgs
+	defer func() { *pkgs = oldPkgs; pkgPatterns = nil }()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\tsetup()\n}\n\nfunc setup() {\n\tprintln(1)\n}\n"), 0644)
+	for _, pkg := range []string{"store", "web"} {
+		os.MkdirAll(filepath.Join(dir, "internal", pkg), 0755)
+		os.WriteFile(filepath.Join(dir, "internal", pkg, pkg+".go"), []byte("package "+pkg+"\n\nfunc Open"+pkg+"() {\n\tprintln(1)\n}\n"), 0644)
+	}
+
+	*pkgs = "./internal/store"
+	if names, want := previewNames(t, dir), []string{"Openstore", "main"}; !slices.Equal(names, want) {
+		t.Fatalf("expected list to select %v like the run, got %v", want, names)
+	}
+}
+
+func TestPreviewInstrumentation_AppliesFiles(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldFiles := *fileList
+	defer func() { *fileList = oldFiles; selectedPaths = nil }()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\tlisted()\n\tother()\n}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "listed.go"), []byte("package main\n\nfunc listed() {\n\tprintln(1)\n}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "other.go"), []byte("package main\n\nfunc other() {\n\tprintln(2)\n}\n"), 0644)
+	list := filepath.Join(t.TempDir(), "list.txt")
+	os.WriteFile(list, []byte(filepath.Join(dir, "listed.go")+"\n"), 0644)
+
+	*fileList = "@" + list
+	if names, want := previewNames(t, dir), []string{"listed", "main"}; !slices.Equal(names, want) {
+		t.Fatalf("expected list to select %v like the run, got %v", want, names)
+	}
+}
+
+func TestPreviewInstrumentation_ListsFilesToInstrument(t *testing.T) {
+	// Create temp directory with a simple Go file
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+
+	// Capture output
+	old := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	*dryRun = true
+	err := previewInstrumentation(tempDir)
+	*dryRun = false
+
+	w.Close()
+	os.Stdout = old
+
+	if err != nil {
+		t.Fatalf("previewInstrumentation: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	output := buf.String()
+
+	if !strings.Contains(output, "main.go") {
+		t.Errorf("expected output to mention main.go, got:\n%s", output)
+	}
+}
+
+func TestInstrumentAST_WithAllowedFuncs(t *testing.T) {
+	// NOTE: Not parallel because it modifies global allowedFuncs
+	src := `package main
+
+func main() {
+	helper()
+	other()
+}
+
+func helper() {
+	println("helper")
+}
+
+func other() {
+	println("other")
+}
+`
+	// Save and restore global state
+	oldAllowed := allowedFuncs
+	defer func() { allowedFuncs = oldAllowed }()
+
+	// Only allow "main" and "helper" to be instrumented
+	allowedFuncs = map[string]bool{
+		"main":   true,
+		"helper": true,
+	}
+
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "test.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	modified := instrumentAST(node)
+	if !modified {
+		t.Fatal("expected AST to be modified")
+	}
+
+	// Check which functions were instrumented
+	instrumented := make(map[string]bool)
+	ast.Inspect(node, func(n ast.Node) bool {
+		if fn, ok := n.(*ast.FuncDecl); ok && fn.Body != nil {
+			if hasTraceDefer(fn.Body, tracePkgAlias) {
+				instrumented[fn.Name.Name] = true
+			}
+		}
+		return true
+	})
+
+	if !instrumented["main"] {
+		t.Error("expected main to be instrumented")
+	}
+	if !instrumented["helper"] {
+		t.Error("expected helper to be instrumented")
+	}
+	if instrumented["other"] {
+		t.Error("expected other to NOT be instrumented (not in allowedFuncs)")
+	}
+}
+
+func TestInstrumentFile_ReusesAliasedTraceImport(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+import tr "github.com/napolitain/gotrace/trace"
+
+func traced() {
+	defer tr.Trace("traced")()
+	println("traced")
+}
+
+func untraced() {
+	println("untraced")
+}
+`
+	result, err := instrumentFileText("test.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+
+	out := string(result)
+	if !strings.Contains(out, `defer tr.Trace("untraced")()`) {
+		t.Fatalf("expected injected call to reuse the tr alias, got:\n%s", out)
+	}
+	if strings.Contains(out, tracePkgAlias) {
+		t.Fatalf("expected no duplicate import with %s alias, got:\n%s", tracePkgAlias, out)
+	}
+	if strings.Count(out, `Trace("traced")`) != 1 {
+		t.Fatalf("expected manually traced function to be left alone, got:\n%s", out)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "test.go", result, 0); err != nil {
+		t.Fatalf("instrumented output does not parse: %v", err)
+	}
+}
+
+func TestChildEnv_ForwardsProfileMem(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *profileMem
+	defer func() { *profileMem = old }()
+
+	*profileMem = 0
+	if slices.ContainsFunc(childEnv(), func(kv string) bool { return strings.HasPrefix(kv, envProfileMem+"=") }) {
+		t.Fatalf("expected %s to be unset when --profile-mem is not given", envProfileMem)
+	}
+
+	*profileMem = 5 * time.Millisecond
+	if !slices.Contains(childEnv(), envProfileMem+"=5ms") {
+		t.Fatalf("expected %s=5ms in child environment", envProfileMem)
+	}
+}
+
+func TestCopyAndInstrumentModule_HonorsSkipDir(t *testing.T) {
+	// NOTE: Not parallel because it modifies global skipDirs
+	oldSkip := skipDirs
+	defer func() { skipDirs = oldSkip }()
+	skipDirs = stringList{"internal/gen*"}
+
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+
+	genSrc := "package generated\n\nfunc Gen() {\n\tprintln(\"gen\")\n}\n"
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+	os.MkdirAll(filepath.Join(tempSrc, "internal", "generated", "deep"), 0755)
+	os.WriteFile(filepath.Join(tempSrc, "internal", "generated", "gen.go"), []byte(genSrc), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "internal", "generated", "deep", "deep.go"), []byte(genSrc), 0644)
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+
+	for _, rel := range []string{"internal/generated/gen.go", "internal/generated/deep/deep.go"} {
+		content, err := os.ReadFile(filepath.Join(tempDst, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatalf("expected %s to be copied: %v", rel, err)
+		}
+		if string(content) != genSrc {
+			t.Errorf("expected %s to be copied uninstrumented, got:\n%s", rel, content)
+		}
+	}
+	content, _ := os.ReadFile(filepath.Join(tempDst, "main.go"))
+	if !strings.Contains(string(content), "trace.Trace") {
+		t.Error("main.go should still be instrumented")
+	}
+
+	output := captureStdout(t, func() {
+		if err := previewInstrumentation(tempSrc); err != nil {
+			t.Fatalf("previewInstrumentation: %v", err)
+		}
+	})
+	if strings.Contains(output, "gen.go") {
+		t.Errorf("expected dry-run to skip excluded directory, got:\n%s", output)
+	}
+}
+
+func TestCopyAndInstrumentModule_NestedModules(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+
+	libSrc := "package lib\n\nfunc Do() {\n\tprintln(\"lib\")\n}\n"
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module test\n\ngo 1.21\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ./lib\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+	for _, dir := range []string{"lib", "tools"} {
+		os.MkdirAll(filepath.Join(tempSrc, dir), 0755)
+		os.WriteFile(filepath.Join(tempSrc, dir, "go.mod"), []byte("module example.com/"+dir+"\n\ngo 1.21\n"), 0644)
+		os.WriteFile(filepath.Join(tempSrc, dir, dir+".go"), []byte(libSrc), 0644)
+	}
+
+	if err := copyAndInstrumentModule(tempSrc, tempDst); err != nil {
+		t.Fatalf("copyAndInstrumentModule: %v", err)
+	}
+
+	// The replaced nested module is part of the build and gets instrumented
+	content, err := os.ReadFile(filepath.Join(tempDst, "lib", "lib.go"))
+	if err != nil {
+		t.Fatalf("expected replaced nested module to be copied: %v", err)
+	}
+	if !strings.Contains(string(content), "Trace(\"Do\")") {
+		t.Errorf("expected replaced nested module to be instrumented, got:\n%s", content)
+	}
+
+	// An unreferenced nested module is left out entirely
+	if _, err := os.Stat(filepath.Join(tempDst, "tools")); !os.IsNotExist(err) {
+		t.Errorf("expected unreferenced nested module to be skipped, stat err = %v", err)
+	}
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	old := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	fn()
+
+	w.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	r.Close()
+	return buf.String()
+}
+
+func TestResolveTarget_FollowsSymlinkToModule(t *testing.T) {
+	t.Parallel()
+	realRoot := t.TempDir()
+	os.WriteFile(filepath.Join(realRoot, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	appDir := filepath.Join(realRoot, "cmd", "app")
+	os.MkdirAll(appDir, 0755)
+	os.WriteFile(filepath.Join(appDir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+
+	link := filepath.Join(t.TempDir(), "app")
+	if err := os.Symlink(appDir, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	resolved, err := resolveTarget(link)
+	if err != nil {
+		t.Fatalf("resolveTarget: %v", err)
+	}
+	root, err := findModuleRoot(resolved)
+	if err != nil {
+		t.Fatalf("findModuleRoot: %v", err)
+	}
+
+	wantRoot, _ := filepath.EvalSymlinks(realRoot)
+	if root != wantRoot {
+		t.Fatalf("findModuleRoot() = %q, want %q", root, wantRoot)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel != filepath.Join("cmd", "app") {
+		t.Fatalf("expected target relative to module root to be cmd/app, got %q (%v)", rel, err)
+	}
+}
+
+func TestChildEnv_ForwardsCollector(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *collector
+	defer func() { *collector = old }()
+
+	*collector = "unix:/tmp/gotrace.sock"
+	if !slices.Contains(childEnv(), envCollector+"=unix:/tmp/gotrace.sock") {
+		t.Fatalf("expected %s to be forwarded to the child", envCollector)
+	}
+}
+
+func TestChildEnv_ForwardsAbsoluteSummaryFile(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *summaryPath
+	defer func() { *summaryPath = old }()
+
+	*summaryPath = "summary.txt"
+	want, _ := filepath.Abs("summary.txt")
+	if !slices.Contains(childEnv(), envSummary+"="+want) {
+		t.Fatalf("expected %s=%s in child environment", envSummary, want)
+	}
+}
+
+func TestChildEnv_ForwardsAbsoluteHTMLFile(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *htmlOut
+	defer func() { *htmlOut = old }()
+
+	*htmlOut = "report.html"
+	want, _ := filepath.Abs("report.html")
+	if !slices.Contains(childEnv(), envHTML+"="+want) {
+		t.Fatalf("expected %s=%s in child environment", envHTML, want)
+	}
+}
+
+func TestCompareWithBase_ReportsRegression(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldBase, oldThreshold := *diffBase, *diffThreshold
+	defer func() { *diffBase, *diffThreshold = oldBase, oldThreshold }()
+
+	dir := t.TempDir()
+	writeRun := func(name string, durations map[string]int64) string {
+		path := filepath.Join(dir, name)
+		lines := []string{`{"format":"gotrace.entries","version":1}`}
+		for fn, d := range durations {
+			lines = append(lines, fmt.Sprintf(`{"name":%q,"depth":0,"start_ns":0,"end_ns":%d,"duration_ns":%d,"gid":1}`, fn, d, d))
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := writeRun("base.jsonl", map[string]int64{"parse": 1_000_000, "render": 2_000_000})
+	cur := writeRun("cur.jsonl", map[string]int64{"parse": 1_500_000, "render": 2_000_000, "fresh": 10})
+
+	*diffBase, *diffThreshold = base, 20
+	var err error
+	out := captureStdout(t, func() { err = compareWithBase(cur) })
+	if err == nil || !strings.Contains(err.Error(), "1 function(s) regressed by more than 20.0%") {
+		t.Fatalf("expected the parse regression to fail the run, got %v", err)
+	}
+	if !strings.Contains(out, "1 of 2 common functions slower") || !regexp.MustCompile(`parse\s+1ms → 1.5ms\s+\+50.0%`).MatchString(out) {
+		t.Fatalf("expected parse reported as 50%% slower, got:\n%s", out)
+	}
+
+	// Below the threshold the regression is reported without failing
+	*diffThreshold = 60
+	captureStdout(t, func() { err = compareWithBase(cur) })
+	if err != nil {
+		t.Fatalf("expected no failure under the threshold, got %v", err)
+	}
+
+	// A missing baseline is created from the run
+	*diffBase = filepath.Join(dir, "new.jsonl")
+	captureStdout(t, func() { err = compareWithBase(cur) })
+	if err != nil {
+		t.Fatalf("compareWithBase without baseline: %v", err)
+	}
+	if _, err := os.Stat(*diffBase); err != nil {
+		t.Fatalf("expected baseline to be saved: %v", err)
+	}
+}
+
+func TestChildEnv_ForwardsFailOnHot(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *failOnHot
+	defer func() { *failOnHot = old }()
+
+	*failOnHot = false
+	if slices.Contains(childEnv(), envFailOnHot+"=1") {
+		t.Fatalf("expected %s to be unset without --fail-on-hot", envFailOnHot)
+	}
+	*failOnHot = true
+	if !slices.Contains(childEnv(), envFailOnHot+"=1") {
+		t.Fatalf("expected %s=1 in child environment", envFailOnHot)
+	}
+}
+
+func TestReadFileList_SelectsListedFiles(t *testing.T) {
+	// NOTE: Not parallel because it modifies global selectedPaths
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(root, "list.txt")
+	os.WriteFile(list, []byte("# from git diff --name-only\n"+filepath.Join(root, "api.go")+"\n\n"+filepath.Join(root, "internal")+"\n"), 0644)
+	paths, err := readFileList("@"+list, nil)
+	if err != nil {
+		t.Fatalf("readFileList: %v", err)
+	}
+	stdinPaths, err := readFileList("-", strings.NewReader(filepath.Join(root, "api.go")+"\n"+filepath.Join(root, "internal")+"\n"))
+	if err != nil {
+		t.Fatalf("readFileList(-): %v", err)
+	}
+	if !maps.Equal(paths, stdinPaths) {
+		t.Errorf("expected the same paths from a file and stdin, got %v and %v", paths, stdinPaths)
+	}
+	if _, err := readFileList("list.txt", nil); err == nil {
+		t.Error("expected an error for a list without @ or -")
+	}
+
+	old := selectedPaths
+	defer func() { selectedPaths = old }()
+	selectedPaths = paths
+	tests := map[string]bool{
+		"api.go":                  true,
+		"other.go":                false,
+		"internal/store/store.go": true,
+		"internalx/x.go":          false,
+	}
+	for rel, want := range tests {
+		if got := inSelectedFiles(filepath.Join(root, filepath.FromSlash(rel))); got != want {
+			t.Errorf("inSelectedFiles(%s) = %v, want %v", rel, got, want)
+		}
+	}
+
+	src := "package main\n\nfunc main() {\n\thelper()\n}\n\nfunc helper() {\n\tprintln(1)\n}\n"
+	result, err := instrumentFileText(filepath.Join(root, "other.go"), []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	if out := string(result); !strings.Contains(out, `Trace("main")`) || strings.Contains(out, `Trace("helper")`) {
+		t.Errorf("expected only main traced in an unlisted file, got:\n%s", out)
+	}
+}
+
+func TestParsePkgPatterns_SelectsSubset(t *testing.T) {
+	// NOTE: Not parallel because it modifies global pkgPatterns
+	root := t.TempDir()
+	patterns, err := parsePkgPatterns("./internal/..., example.com/app/cmd/tool", root, "example.com/app")
+	if err != nil {
+		t.Fatalf("parsePkgPatterns: %v", err)
+	}
+	old := pkgPatterns
+	defer func() { pkgPatterns = old }()
+	pkgPatterns = patterns
+
+	tests := map[string]bool{
+		"internal/store/store.go": true,
+		"internal/api.go":         true,
+		"internalx/x.go":          false,
+		"cmd/tool/main.go":        true,
+		"cmd/tool/sub/sub.go":     false,
+		"main.go":                 false,
+	}
+	for rel, want := range tests {
+		if got := inSelectedPkgs(filepath.Join(root, filepath.FromSlash(rel))); got != want {
+			t.Errorf("inSelectedPkgs(%s) = %v, want %v", rel, got, want)
+		}
+	}
+
+	// Unselected packages are left alone except for main
+	src := "package main\n\nfunc main() {\n\thelper()\n}\n\nfunc helper() {\n\tprintln(1)\n}\n"
+	result, err := instrumentFileText(filepath.Join(root, "main.go"), []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	if out := string(result); !strings.Contains(out, `Trace("main")`) || strings.Contains(out, `Trace("helper")`) {
+		t.Fatalf("expected only main traced outside --pkgs, got:\n%s", out)
+	}
+
+	if _, err := parsePkgPatterns("../other/...", root, "example.com/app"); err == nil {
+		t.Fatal("expected a pattern outside the module to be rejected")
+	}
+}
+
+func TestPrintPMUSummary_ReportsOnCPUShare(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	if runtime.GOOS != "linux" {
+		t.Skip("PMU counters are Linux-only")
+	}
+	old := *pmu
+	defer func() { *pmu = old }()
+	*pmu = true
+
+	output := captureStdout(t, func() {
+		PrintPMUSummary(PMUCounters{CPUCycles: 1000, TaskClockNs: 25_000_000, WallNs: 100_000_000})
+	})
+	if !strings.Contains(output, "On-CPU Time:") || !strings.Contains(output, "25% of 100ms wall") {
+		t.Fatalf("expected on-CPU share of wall time, got:\n%s", output)
+	}
+}
+
+func TestChildEnv_ForwardsFlat(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *flatOutput
+	defer func() { *flatOutput = old }()
+
+	*flatOutput = true
+	if !slices.Contains(childEnv(), envFlat+"=1") {
+		t.Fatalf("expected %s=1 in child environment", envFlat)
+	}
+}
+
+func TestChildEnv_ForwardsColor(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *colorMode
+	defer func() { *colorMode = old }()
+
+	*colorMode = "auto"
+	if slices.ContainsFunc(childEnv(), func(kv string) bool { return strings.HasPrefix(kv, envColor+"=") }) {
+		t.Fatalf("expected no %s for --color auto", envColor)
+	}
+	*colorMode = "always"
+	if !slices.Contains(childEnv(), envColor+"=always") {
+		t.Fatalf("expected %s=always in child environment", envColor)
+	}
+}
+
+func TestChildEnv_ForwardsByReceiver(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *byReceiver
+	defer func() { *byReceiver = old }()
+
+	*byReceiver = true
+	if !slices.Contains(childEnv(), envByReceiver+"=1") {
+		t.Fatalf("expected %s=1 in child environment", envByReceiver)
+	}
+}
+
+func TestCopyAndInstrumentModule_ReportsSyntaxErrorAtOriginalPath(t *testing.T) {
+	t.Parallel()
+	tempSrc := t.TempDir()
+	tempDst := t.TempDir()
+
+	broken := filepath.Join(tempSrc, "pkg", "broken.go")
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module test\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+	os.MkdirAll(filepath.Dir(broken), 0755)
+	os.WriteFile(broken, []byte("package pkg\n\nfunc Broken( {\n}\n"), 0644)
+
+	err := copyAndInstrumentModule(tempSrc, tempDst)
+	if err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	if !strings.Contains(err.Error(), broken+":3:") || strings.Contains(err.Error(), tempDst) || strings.Count(err.Error(), "broken.go") != 1 {
+		t.Fatalf("expected error at %s:3 naming the file once, not the temp copy, got: %v", broken, err)
+	}
+}
+
+func TestChildEnv_SetsGOMAXPROCS(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *gomaxprocs
+	defer func() { *gomaxprocs = old }()
+
+	*gomaxprocs = 0
+	t.Setenv("GOMAXPROCS", "")
+	if slices.Contains(childEnv(), "GOMAXPROCS=1") {
+		t.Fatal("expected GOMAXPROCS to be left alone when --gomaxprocs is not given")
+	}
+
+	*gomaxprocs = 1
+	env := childEnv()
+	if env[len(env)-1] != "GOMAXPROCS=1" {
+		t.Fatalf("expected GOMAXPROCS=1 last so it overrides the inherited value, got %q", env[len(env)-1])
+	}
+}
+
+func TestInstrumentFile_ExplainReportsDecisions(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldExplain, oldPattern := *explain, *pattern
+	defer func() { *explain, *pattern = oldExplain, oldPattern }()
+	*explain = true
+	*pattern = "Handle"
+
+	src := `package main
+
+func HandleRequest() {
+	println("handled")
+}
+
+func helper() {
+	println("helper")
+}
+
+func noop() {}
+`
+	output := captureStdout(t, func() {
+		if _, err := instrumentFileText("test.go", []byte(src)); err != nil {
+			t.Fatalf("instrumentFileText: %v", err)
+		}
+	})
+
+	for _, want := range []string{
+		"explain: test.go: HandleRequest: included",
+		`explain: test.go: helper: skipped (does not match --pattern "Handle")`,
+		"explain: test.go: noop: skipped (empty body)",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in explanation, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestInstrumentFile_MinComplexitySkipsSimpleFunctions(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *minComplexity
+	defer func() { *minComplexity = old }()
+	*minComplexity = 4
+
+	src := `package main
+
+func simple(a, b int) int {
+	return a + b
+}
+
+func branchy(xs []int) int {
+	n := 0
+	for _, x := range xs {
+		if x > 0 && x%2 == 0 {
+			n++
+		}
+	}
+	return n
+}
+`
+	result, err := instrumentFileText("test.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+
+	out := string(result)
+	if strings.Contains(out, `Trace("simple"`) {
+		t.Errorf("expected simple function to be skipped, got:\n%s", out)
+	}
+	if !strings.Contains(out, `Trace("branchy"`) {
+		t.Errorf("expected branchy function to be instrumented, got:\n%s", out)
+	}
+}
+
+func TestFindFunctionNodes_MatchesFullImportPath(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	for _, dir := range []string{"a/util", "b/util"} {
+		os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755)
+		os.WriteFile(filepath.Join(root, filepath.FromSlash(dir), "util.go"),
+			[]byte("package util\n\ntype T struct{}\n\nfunc (T) Run() {}\n\nfunc Helper() int {\n\treturn 1\n}\n"), 0644)
+	}
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+import (
+	autil "example.com/app/a/util"
+	butil "example.com/app/b/util"
+)
+
+func main() {
+	println(autil.Helper() + butil.Helper())
+	autil.T{}.Run()
+	butil.T{}.Run()
+}
+`), 0644)
+
+	graph, prog, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+
+	if got := len(findFunctionNodes(graph, prog, "util.Helper")); got != 2 {
+		t.Fatalf("expected short package name to be ambiguous (2 matches), got %d", got)
+	}
+	for _, target := range []string{"example.com/app/a/util.Helper", "example.com/app/b/util.T.Run"} {
+		nodes := findFunctionNodes(graph, prog, target)
+		if len(nodes) != 1 {
+			t.Fatalf("expected exactly 1 match for %q, got %d", target, len(nodes))
+		}
+		if got, want := nodes[0].Func.Pkg.Pkg.Path(), target[:strings.LastIndex(target, "/util.")+len("/util")]; got != want {
+			t.Fatalf("%q matched package %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestFindBoundaryFuncs_SelectsCrossPackageCalls(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.MkdirAll(filepath.Join(root, "store"), 0755)
+	os.WriteFile(filepath.Join(root, "store", "store.go"), []byte(`package store
+
+func Get(key string) string {
+	return normalize(key)
+}
+
+func normalize(key string) string {
+	return key + "!"
+}
+`), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+import "example.com/app/store"
+
+func main() {
+	println(lookup("k"))
+}
+
+func lookup(key string) string {
+	return store.Get(key)
+}
+`), 0644)
+
+	graph, _, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+	funcs := findBoundaryFuncs(graph, "example.com/app")
+
+	for _, want := range []string{"main", "Get"} {
+		if !funcs[want] {
+			t.Errorf("expected %s to be a boundary function, got %v", want, funcs)
+		}
+	}
+	for _, unwanted := range []string{"lookup", "normalize", "Println"} {
+		if funcs[unwanted] {
+			t.Errorf("expected %s not to be a boundary function, got %v", unwanted, funcs)
+		}
+	}
+}
+
+func TestInstrumentGoMod_RenamedTraceModule(t *testing.T) {
+	// NOTE: Not parallel because it modifies the trace module and working directory
+	defer setTraceModule(traceModule)
+	setTraceModule("example.com/fork/gotrace")
+
+	forkRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(forkRoot, "go.mod"), []byte("module example.com/fork/gotrace\n\ngo 1.21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(forkRoot)
+
+	// The fork's own go.mod is left alone
+	self := []byte("module example.com/fork/gotrace\n\ngo 1.21\n")
+	if out, err := instrumentGoMod(self, forkRoot); err != nil || string(out) != string(self) {
+		t.Fatalf("expected fork go.mod unchanged, got %q (%v)", out, err)
+	}
+
+	// A module whose path merely starts with the fork's path is a normal target
+	out, err := instrumentGoMod([]byte("module example.com/fork/gotrace-extras\n\ngo 1.21\n"), t.TempDir())
+	if err != nil {
+		t.Fatalf("instrumentGoMod: %v", err)
+	}
+	if !strings.Contains(string(out), "require example.com/fork/gotrace ") {
+		t.Fatalf("expected require on the fork, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "example.com/fork/gotrace => ") {
+		t.Fatalf("expected replace pointing at the local fork, got:\n%s", out)
+	}
+	if strings.Contains(string(out), defaultTraceModule+" ") {
+		t.Fatalf("expected no require on %s, got:\n%s", defaultTraceModule, out)
+	}
+}
+
+func TestInstrumentGoMod_PinnedTraceVersion(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldVersion, oldReplace := *pinVersion, *pinReplace
+	defer func() { *pinVersion, *pinReplace = oldVersion, oldReplace }()
+
+	app := []byte("module example.com/app\n\ngo 1.21\n\nrequire " + traceModule + " v0.1.0\n")
+
+	// A pinned version replaces the existing require and skips the local checkout
+	*pinVersion, *pinReplace = "v1.2.3", ""
+	out, err := instrumentGoMod(app, t.TempDir())
+	if err != nil {
+		t.Fatalf("instrumentGoMod: %v", err)
+	}
+	if !strings.Contains(string(out), "require "+traceModule+" v1.2.3") || strings.Contains(string(out), "v0.1.0") {
+		t.Fatalf("expected the pinned version in go.mod, got:\n%s", out)
+	}
+	if strings.Contains(string(out), "replace") {
+		t.Fatalf("expected no replace with only --trace-version, got:\n%s", out)
+	}
+
+	// A pinned replacement module is used as given
+	*pinReplace = "example.com/mirror/gotrace@v1.2.4"
+	if out, err = instrumentGoMod(app, t.TempDir()); err != nil {
+		t.Fatalf("instrumentGoMod: %v", err)
+	}
+	if !strings.Contains(string(out), "replace "+traceModule+" => example.com/mirror/gotrace v1.2.4") {
+		t.Fatalf("expected the pinned replace in go.mod, got:\n%s", out)
+	}
+
+	// A local directory is made absolute for the temp module
+	*pinReplace = "./vendor/gotrace"
+	if out, err = instrumentGoMod(app, t.TempDir()); err != nil {
+		t.Fatalf("instrumentGoMod: %v", err)
+	}
+	want, _ := filepath.Abs("vendor/gotrace")
+	if !strings.Contains(string(out), "=> "+want) {
+		t.Fatalf("expected replace with %s, got:\n%s", want, out)
+	}
+}
+
+func TestCopyAndInstrumentModule_VerbosityLevels(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldVerbose, oldVersion := verbose, *pinVersion
+	defer func() { verbose, *pinVersion = oldVerbose, oldVersion }()
+	*pinVersion = "v1.2.3"
+
+	tempSrc := t.TempDir()
+	os.WriteFile(filepath.Join(tempSrc, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(tempSrc, "main.go"), []byte("package main\n\nfunc helper() {\n\tprintln(\"hi\")\n}\n\nfunc main() {\n\thelper()\n}\n"), 0644)
+
+	run := func(level string) string {
+		if err := verbose.Set(level); err != nil {
+			t.Fatal(err)
+		}
+		return captureStdout(t, func() {
+			if err := copyAndInstrumentModule(tempSrc, t.TempDir()); err != nil {
+				t.Fatalf("copyAndInstrumentModule: %v", err)
+			}
+		})
+	}
+
+	if out := run("1"); !strings.Contains(out, "Instrumenting package example.com/app") || strings.Contains(out, "main.go") {
+		t.Errorf("expected only package progress at level 1, got:\n%s", out)
+	}
+	if out := run("2"); !strings.Contains(out, "  main.go") || strings.Contains(out, "+ helper") {
+		t.Errorf("expected file progress but no functions at level 2, got:\n%s", out)
+	}
+	out := run("3")
+	for _, want := range []string{"    + helper", "    + main", "go.mod: require " + traceModule + " v1.2.3"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q at level 3, got:\n%s", want, out)
+		}
+	}
+
+	// A bare -v counts up
+	verbose = 0
+	verbose.Set("true")
+	verbose.Set("true")
+	if verbose != 2 {
+		t.Errorf("expected two bare -v flags to give level 2, got %d", verbose)
+	}
+}
+
+func TestPreviewInstrumentation_ShowsGoModChanges(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldVersion, oldReplace := *pinVersion, *pinReplace
+	defer func() { *pinVersion, *pinReplace = oldVersion, oldReplace }()
+	*pinVersion, *pinReplace = "v1.2.3", "example.com/mirror/gotrace@v1.2.4"
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n\nrequire "+traceModule+" v0.1.0\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0644)
+
+	out := captureStdout(t, func() {
+		if err := previewInstrumentation(root); err != nil {
+			t.Fatalf("previewInstrumentation: %v", err)
+		}
+	})
+
+	want := "Would update go.mod (before go mod tidy):\n" +
+		"  - require " + traceModule + " v0.1.0\n" +
+		"  + replace " + traceModule + " => example.com/mirror/gotrace v1.2.4\n" +
+		"  + require " + traceModule + " v1.2.3\n"
+	if !strings.Contains(out, want) {
+		t.Fatalf("expected the go.mod preview\n%s\ngot:\n%s", want, out)
+	}
+}
+
+func TestInstrumentFile_GoroutinesRecordsGoStatementLifetimes(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *goroutines
+	defer func() { *goroutines = old }()
+	*goroutines = true
+
+	src := `package main
+
+func serve(jobs []int) {
+	for _, j := range jobs {
+		go func(j int) {
+			work(j)
+		}(j)
+	}
+	go func() { work(0) }()
+	go work(1)
+}
+`
+	out, err := instrumentFileText("serve.go", []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	for _, want := range []string{
+		"go func(j int) {\n\tdefer " + tracePkgAlias + `.Goroutine("go serve#1")()`,
+		"go func() { defer " + tracePkgAlias + `.Goroutine("go serve#2")(); work(0) }()`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "serve#3") {
+		t.Errorf("expected go statements without a function literal to be left alone, got:\n%s", out)
+	}
+}
+
+func TestInstrumentFile_ChangedOnlyTracesTouchedFunctions(t *testing.T) {
+	// NOTE: Not parallel because it modifies global changedLines
+	defer func() { changedLines = nil }()
+
+	root := t.TempDir()
+	diff := `diff --git a/svc/svc.go b/svc/svc.go
+--- a/svc/svc.go
++++ b/svc/svc.go
+@@ -4,0 +5,2 @@ func untouched() {
+@@ -12 +14 @@ func edited() {
+@@ -20,2 +21,0 @@ func trimmed() {
+diff --git a/old.go b/old.go
+--- a/old.go
++++ /dev/null
+@@ -1,3 +0,0 @@
+`
+	lines, err := parseDiffRanges(diff, root)
+	if err != nil {
+		t.Fatalf("parseDiffRanges: %v", err)
+	}
+	file := filepath.Join(root, "svc", "svc.go")
+	want := []lineRange{{5, 6}, {14, 14}, {21, 21}}
+	if !slices.Equal(lines[file], want) {
+		t.Fatalf("expected ranges %v, got %v", want, lines[file])
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected only svc.go in ranges, got %v", lines)
+	}
+
+	changedLines = lines
+	src := `package svc
+
+func added() {
+	println("new")
+}
+
+func untouched() {
+	println("same")
+}
+
+func edited() {
+	println("x")
+	println("y")
+	println("changed")
+}
+
+func trimmed() {
+	println("a")
+	println("b")
+	println("c")
+}
+`
+	result, err := instrumentFileText(file, []byte(src))
+	if err != nil {
+		t.Fatalf("instrumentFileText: %v", err)
+	}
+	out := string(result)
+	for _, fn := range []string{"added", "edited", "trimmed"} {
+		if !strings.Contains(out, `Trace("`+fn+`")`) {
+			t.Errorf("expected %s to be traced, got:\n%s", fn, out)
+		}
+	}
+	if strings.Contains(out, `Trace("untouched")`) {
+		t.Errorf("expected untouched to be skipped, got:\n%s", out)
+	}
+}
+
+func TestFindCallersTo_InterfaceMethodIncludesImplementations(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+type Store interface {
+	Get(key string) string
+}
+
+type memStore struct{}
+
+func (*memStore) Get(key string) string { return "mem:" + key }
+
+type diskStore struct{}
+
+func (diskStore) Get(key string) string { return "disk:" + key }
+
+func lookup(s Store) string {
+	return s.Get("k")
+}
+
+func unrelated() {}
+
+func main() {
+	unrelated()
+	println(lookup(&memStore{}), lookup(diskStore{}))
+}
+`), 0644)
+
+	graph, prog, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+
+	for _, target := range []string{"Store.Get", "main.Store.Get", "example.com/app.Store.Get"} {
+		callers, err := findCallersTo(graph, prog, target)
+		if err != nil {
+			t.Fatalf("findCallersTo(%q): %v", target, err)
+		}
+		for _, want := range []string{"memStore.Get", "diskStore.Get", "lookup", "main"} {
+			if !callers[want] {
+				t.Errorf("%q: expected %s on the call path, got %v", target, want, callers)
+			}
+		}
+		if callers["unrelated"] {
+			t.Errorf("%q: expected unrelated to be excluded, got %v", target, callers)
+		}
+	}
+}
+
+func TestFindCallersTo_ResolvesMethodValues(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+type Server struct{ name string }
+
+func (s *Server) Handle(req string) string { return s.name + req }
+
+func serve(handler func(string) string) string {
+	return handler("/")
+}
+
+func direct(s *Server) string {
+	f := s.Handle
+	return f("/direct")
+}
+
+func expr() string {
+	return (*Server).Handle(&Server{}, "/expr")
+}
+
+func unrelated() {}
+
+func main() {
+	srv := &Server{name: "api"}
+	unrelated()
+	println(serve(srv.Handle), direct(srv), expr())
+}
+`), 0644)
+
+	graph, prog, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+	callers, err := findCallersTo(graph, prog, "Server.Handle")
+	if err != nil {
+		t.Fatalf("findCallersTo: %v", err)
+	}
+	for _, want := range []string{"Server.Handle", "serve", "direct", "expr", "main"} {
+		if !callers[want] {
+			t.Errorf("expected %s on the call path, got %v", want, callers)
+		}
+	}
+	for name := range callers {
+		if strings.Contains(name, "$") {
+			t.Errorf("expected no synthetic wrapper %s in the selection", name)
+		}
+	}
+	if callers["unrelated"] {
+		t.Errorf("expected unrelated to be excluded, got %v", callers)
+	}
+	if leaves := findLeafFuncs(graph, "example.com/app"); leaves["direct"] || !leaves["Server.Handle"] {
+		t.Errorf("expected a call through a method value to count for --leaves-only, got %v", leaves)
+	}
+}
+
+func TestFindLeafFuncs_SelectsFunctionsWithoutModuleCallees(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+import "strings"
+
+func main() {
+	println(render(parse("a,b")), fib(10), each([]int{1, 2}))
+}
+
+func parse(s string) []string { return strings.Split(s, ",") }
+
+func render(parts []string) string { return strings.Join(upper(parts), "|") }
+
+func upper(parts []string) []string {
+	for i, p := range parts {
+		parts[i] = strings.ToUpper(p)
+	}
+	return parts
+}
+
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+func double(n int) int { return 2 * n }
+
+func each(xs []int) int {
+	sum := 0
+	apply := func(x int) { sum += double(x) }
+	for _, x := range xs {
+		apply(x)
+	}
+	return sum
+}
+`), 0644)
+
+	graph, _, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+	funcs := findLeafFuncs(graph, "example.com/app")
+
+	// parse and upper only call the standard library
+	for _, want := range []string{"main", "parse", "upper", "double"} {
+		if !funcs[want] {
+			t.Errorf("expected %s to be a leaf, got %v", want, funcs)
+		}
+	}
+	// fib calls itself and each calls double through a closure
+	for _, unwanted := range []string{"render", "fib", "each", "Split"} {
+		if funcs[unwanted] {
+			t.Errorf("expected %s not to be a leaf, got %v", unwanted, funcs)
+		}
+	}
+}
+
+func TestRankByFanIn_WidelyCalledHelperFirst(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+func helper() int { return 1 }
+
+func a() int { return helper() + helper() }
+func b() int { return helper() + c() }
+func c() int { return helper() }
+
+func main() {
+	println(a() + b() + c())
+}
+`), 0644)
+
+	graph, _, err := buildCallGraph(root)
+	if err != nil {
+		t.Fatalf("buildCallGraph: %v", err)
+	}
+	ranked := rankByFanIn(graph, "example.com/app", nil)
+	if len(ranked) < 2 {
+		t.Fatalf("expected ranked functions, got %v", ranked)
+	}
+	// helper is called by a, b and c; repeated calls from a count once
+	if ranked[0] != (fanIn{name: "helper", callers: 3}) {
+		t.Fatalf("expected helper with 3 callers first, got %v", ranked)
+	}
+	if ranked[1] != (fanIn{name: "c", callers: 2}) {
+		t.Fatalf("expected c with 2 callers second, got %v", ranked)
+	}
+
+	funcs := intersectFuncs(map[string]bool{"helper": true, "a": true}, map[string]bool{"helper": true, "c": true})
+	if len(funcs) != 1 || !funcs["helper"] {
+		t.Fatalf("expected intersection to keep only helper, got %v", funcs)
+	}
+}
+
+func TestPreviewInstrumentation_FanInRanksWithinUntil(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	oldTop, oldUntil := *fanInTop, *until
+	defer func() { *fanInTop, *until = oldTop, oldUntil; allowedFuncs = nil }()
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/app\n\ngo 1.21\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte(`package main
+
+func helper() int { return 1 }
+
+func a() int { return helper() + helper() }
+func b() int { return helper() + c() }
+func c() int { return helper() }
+
+func main() {
+	println(a() + b() + c())
+}
+`), 0644)
+
+	// helper has the most callers overall but isn't on the path to c
+	*fanInTop, *until = 1, "c"
+	if names, want := previewNames(t, root), []string{"c", "main"}; !slices.Equal(names, want) {
+		t.Fatalf("expected list to select %v like the run, got %v", want, names)
+	}
+}
+
+func TestSplitSubcommand(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		args     []string
+		wantCmd  string
+		wantRest []string
+	}{
+		{[]string{".", "--port", "80"}, "run", []string{".", "--port", "80"}},
+		{[]string{"run", "--pmu", "."}, "run", []string{"--pmu", "."}},
+		{[]string{"list", "./cmd/app"}, "list", []string{"./cmd/app"}},
+		{[]string{"replay", "run.jsonl"}, "replay", []string{"run.jsonl"}},
+		{[]string{"merge", "a.jsonl", "b.jsonl"}, "merge", []string{"a.jsonl", "b.jsonl"}},
+		{[]string{"./list"}, "run", []string{"./list"}},
+		{nil, "run", nil},
+	}
+	for _, tt := range tests {
+		cmd, rest := splitSubcommand(tt.args)
+		if cmd != tt.wantCmd || !slices.Equal(rest, tt.wantRest) {
+			t.Errorf("splitSubcommand(%q) = %q, %q; want %q, %q", tt.args, cmd, rest, tt.wantCmd, tt.wantRest)
+		}
+	}
+}
+
+func TestRunReplay_RendersSavedTrace(t *testing.T) {
+	// NOTE: Not parallel because it records into the global trace set
+	trace.Reset()
+	defer trace.Reset()
+
+	saved := filepath.Join(t.TempDir(), "run.jsonl")
+	os.WriteFile(saved, []byte(`{"format":"gotrace.entries","version":1}
+{"name":"inner","args":["7"],"depth":2,"start_ns":1500,"end_ns":2500,"duration_ns":1000,"gid":1,"file":"app.go","line":12}
+{"name":"outer","depth":1,"start_ns":1000,"end_ns":4000,"duration_ns":3000,"gid":1,"file":"app.go","line":5}
+`), 0644)
+
+	output := captureStdout(t, func() {
+		if err := runReplay([]string{saved}); err != nil {
+			t.Fatalf("runReplay: %v", err)
+		}
+	})
+
+	outerEnter := strings.Index(output, "outer")
+	innerEnter := strings.Index(output, "inner")
+	innerExit := strings.Index(output[innerEnter+1:], "inner") + innerEnter + 1
+	if outerEnter < 0 || innerEnter < outerEnter || innerExit <= innerEnter {
+		t.Fatalf("expected outer to enter before inner, got:\n%s", output)
+	}
+	if !strings.Contains(output, "app.go:12") || !strings.Contains(output, "GoTrace Summary") {
+		t.Fatalf("expected replayed locations and a summary, got:\n%s", output)
+	}
+	if got := len(trace.GetTraces()); got != 2 {
+		t.Fatalf("expected 2 replayed entries, got %d", got)
+	}
+
+	if err := runReplay(nil); err == nil {
+		t.Fatal("expected an error without a trace file")
 	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/napolitain/gotrace/trace"
+)
+
+// runMerge implements "gotrace merge [flags] FILE...": it combines traces
+// saved with trace.ExportJSON by several runs, e.g. the shards of a load
+// test, and prints one summary across all of them.
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	out := fs.String("o", "", "also write the merged entries to this file with trace.ExportJSON")
+	keepGIDs := fs.Bool("keep-gids", false, "keep the recorded goroutine IDs instead of offsetting each run's")
+	function := fs.String("function", "", "print percentile stats for this function instead of the summary")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gotrace merge [-o FILE] [--keep-gids] [--function NAME] FILE...\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return fmt.Errorf("merge needs at least two trace files")
+	}
+
+	var readers []io.Reader
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	var entries []trace.Entry
+	if *keepGIDs {
+		for i, r := range readers {
+			run, err := trace.ImportJSON(r)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", fs.Arg(i), err)
+			}
+			entries = append(entries, run...)
+		}
+	} else {
+		var err error
+		if entries, err = trace.MergeRuns(readers...); err != nil {
+			return err
+		}
+	}
+	trace.AddEntries(entries)
+
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		if err := trace.ExportJSON(f); err != nil {
+			f.Close()
+			return fmt.Errorf("write %s: %w", *out, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if *function != "" {
+		trace.PrintFunctionStats(*function)
+		return nil
+	}
+	trace.PrintSummary()
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pkgPattern is a --pkgs pattern resolved to a package directory.
+type pkgPattern struct {
+	dir       string // Absolute package directory
+	recursive bool   // Pattern ended in "/...", so subdirectories match too
+}
+
+// pkgPatterns is set when --pkgs is used; only functions in matching
+// package directories are instrumented.
+var pkgPatterns []pkgPattern
+
+// parsePkgPatterns resolves a comma-separated --pkgs list against the module
+// at moduleRoot. Patterns are relative directories ("./internal/..."),
+// module-relative paths ("internal/util") or import paths within the module
+// ("example.com/app/internal/..."); a trailing "/..." also matches
+// subpackages.
+func parsePkgPatterns(list, moduleRoot, modulePath string) ([]pkgPattern, error) {
+	var patterns []pkgPattern
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		rel := p
+		if rel == modulePath || strings.HasPrefix(rel, modulePath+"/") {
+			rel = "." + strings.TrimPrefix(rel, modulePath)
+		}
+		var pat pkgPattern
+		if rel == "..." || strings.HasSuffix(rel, "/...") {
+			pat.recursive = true
+			rel = strings.TrimSuffix(strings.TrimSuffix(rel, "..."), "/")
+		}
+		rel = path.Clean("./" + filepath.ToSlash(rel))
+		if rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(filepath.ToSlash(p)) {
+			return nil, fmt.Errorf("--pkgs pattern %q is outside the module", p)
+		}
+		pat.dir = filepath.Join(moduleRoot, filepath.FromSlash(rel))
+		patterns = append(patterns, pat)
+	}
+	return patterns, nil
+}
+
+// inSelectedPkgs reports whether the package of the Go file filename matches
+// --pkgs. Everything matches when the flag is not set.
+func inSelectedPkgs(filename string) bool {
+	if pkgPatterns == nil {
+		return true
+	}
+	dir := filepath.Dir(filename)
+	for _, p := range pkgPatterns {
+		if dir == p.dir || (p.recursive && strings.HasPrefix(dir, p.dir+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,10 +3,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -17,6 +19,11 @@ type PMUCounters struct {
 	CacheReferences uint64
 	CacheMisses     uint64
 	BranchMisses    uint64
+	TaskClockNs     uint64 // On-CPU time of all threads, in nanoseconds
+	WallNs          uint64 // Wall-clock run time, set by the runner
+	UserNs          uint64 // User CPU time, only in the rusage fallback
+	SystemNs        uint64 // System CPU time, only in the rusage fallback
+	Fallback        bool   // perf events were unavailable; only CPU times are set
 }
 
 // PMUGroup manages a group of perf event file descriptors
@@ -51,6 +58,7 @@ type perfEventAttr struct {
 // Constants for perf_event_open
 const (
 	PERF_TYPE_HARDWARE = 0
+	PERF_TYPE_SOFTWARE = 1
 
 	PERF_COUNT_HW_CPU_CYCLES       = 0
 	PERF_COUNT_HW_INSTRUCTIONS     = 1
@@ -58,6 +66,8 @@ const (
 	PERF_COUNT_HW_CACHE_MISSES     = 3
 	PERF_COUNT_HW_BRANCH_MISSES    = 5
 
+	PERF_COUNT_SW_TASK_CLOCK = 1
+
 	PERF_FLAG_FD_CLOEXEC = 1 << 3
 )
 
@@ -71,14 +81,16 @@ const (
 )
 
 var pmuCounterConfigs = []struct {
-	name   string
-	config uint64
+	name      string
+	eventType uint32
+	config    uint64
 }{
-	{"cpu_cycles", PERF_COUNT_HW_CPU_CYCLES},
-	{"instructions", PERF_COUNT_HW_INSTRUCTIONS},
-	{"cache_references", PERF_COUNT_HW_CACHE_REFERENCES},
-	{"cache_misses", PERF_COUNT_HW_CACHE_MISSES},
-	{"branch_misses", PERF_COUNT_HW_BRANCH_MISSES},
+	{"cpu_cycles", PERF_TYPE_HARDWARE, PERF_COUNT_HW_CPU_CYCLES},
+	{"instructions", PERF_TYPE_HARDWARE, PERF_COUNT_HW_INSTRUCTIONS},
+	{"cache_references", PERF_TYPE_HARDWARE, PERF_COUNT_HW_CACHE_REFERENCES},
+	{"cache_misses", PERF_TYPE_HARDWARE, PERF_COUNT_HW_CACHE_MISSES},
+	{"branch_misses", PERF_TYPE_HARDWARE, PERF_COUNT_HW_BRANCH_MISSES},
+	{"task_clock", PERF_TYPE_SOFTWARE, PERF_COUNT_SW_TASK_CLOCK},
 }
 
 // perfEventOpen wraps the perf_event_open syscall
@@ -112,7 +124,7 @@ func SetupPMU(pid int) (*PMUGroup, error) {
 
 	for i, cfg := range pmuCounterConfigs {
 		attr := perfEventAttr{
-			Type:   PERF_TYPE_HARDWARE,
+			Type:   cfg.eventType,
 			Size:   uint32(unsafe.Sizeof(perfEventAttr{})),
 			Config: cfg.config,
 			Flags:  attrFlagDisabled | attrFlagExcludeKern | attrFlagExcludeHV | attrFlagInherit | attrFlagEnableOnExec,
@@ -126,7 +138,7 @@ func SetupPMU(pid int) (*PMUGroup, error) {
 		fd, err := perfEventOpen(&attr, pid, -1, groupFD, PERF_FLAG_FD_CLOEXEC)
 		if err != nil {
 			group.Close()
-			return nil, fmt.Errorf("perf_event_open for %s: %w (try: sudo sysctl kernel.perf_event_paranoid=-1)", cfg.name, err)
+			return nil, fmt.Errorf("perf_event_open for %s: %w (%s)", cfg.name, err, pmuHint(err))
 		}
 
 		if i == 0 {
@@ -138,6 +150,21 @@ func SetupPMU(pid int) (*PMUGroup, error) {
 	return group, nil
 }
 
+// pmuHint suggests what to do about a perf_event_open error.
+func pmuHint(err error) string {
+	switch {
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return "not permitted: try sudo sysctl kernel.perf_event_paranoid=-1, or grant CAP_PERFMON"
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.EOPNOTSUPP):
+		return "event not supported by this CPU; virtual machines often expose no hardware counters"
+	case errors.Is(err, syscall.ENOSYS):
+		return "perf events unavailable: the kernel lacks them or a container seccomp profile blocks perf_event_open"
+	case errors.Is(err, syscall.EMFILE):
+		return "too many open files: raise the limit with ulimit -n"
+	}
+	return "try: sudo sysctl kernel.perf_event_paranoid=-1"
+}
+
 // Read reads current counter values from all PMU counters
 func (g *PMUGroup) Read() (PMUCounters, error) {
 	if g == nil {
@@ -169,6 +196,8 @@ func (g *PMUGroup) Read() (PMUCounters, error) {
 			counters.CacheMisses = value
 		case 4:
 			counters.BranchMisses = value
+		case 5:
+			counters.TaskClockNs = value
 		}
 	}
 
@@ -198,6 +227,10 @@ func PrintPMUSummary(counters PMUCounters) {
 	if !*pmu {
 		return
 	}
+	if counters.Fallback {
+		printCPUTimeSummary(counters)
+		return
+	}
 
 	fmt.Println()
 	fmt.Println("🔧 Hardware Counters (process total)")
@@ -220,6 +253,31 @@ func PrintPMUSummary(counters PMUCounters) {
 	fmt.Printf("  Cache Misses:      %15s    (%.2f%% miss rate)\n", formatCount(counters.CacheMisses), cacheMissRate)
 	
 	fmt.Printf("  Branch Misses:     %15s\n", formatCount(counters.BranchMisses))
+
+	// Traced durations are wall-clock and include time blocked on channels,
+	// locks and syscalls; the task clock shows how much of the run was on-CPU
+	if counters.WallNs > 0 {
+		fmt.Printf("  On-CPU Time:       %15s    (%.0f%% of %s wall, all threads)\n",
+			time.Duration(counters.TaskClockNs).Round(time.Microsecond),
+			float64(counters.TaskClockNs)/float64(counters.WallNs)*100,
+			time.Duration(counters.WallNs).Round(time.Microsecond))
+	}
+}
+
+// printCPUTimeSummary prints the CPU times gathered when perf events are
+// unavailable.
+func printCPUTimeSummary(counters PMUCounters) {
+	fmt.Println()
+	fmt.Println("🔧 CPU Time (perf events unavailable, from rusage)")
+	fmt.Println("  " + strings.Repeat("─", 60))
+	fmt.Printf("  User:              %15s\n", time.Duration(counters.UserNs).Round(time.Microsecond))
+	fmt.Printf("  System:            %15s\n", time.Duration(counters.SystemNs).Round(time.Microsecond))
+	if counters.WallNs > 0 {
+		fmt.Printf("  On-CPU Time:       %15s    (%.0f%% of %s wall, all threads)\n",
+			time.Duration(counters.TaskClockNs).Round(time.Microsecond),
+			float64(counters.TaskClockNs)/float64(counters.WallNs)*100,
+			time.Duration(counters.WallNs).Round(time.Microsecond))
+	}
 }
 
 // formatCount formats a number with thousands separators
@@ -244,6 +302,10 @@ func formatCount(n uint64) string {
 // Global PMU group for the traced process
 var globalPMU *PMUGroup
 
+// pmuFallback is set when perf events could not be opened; the child's CPU
+// times from its rusage are reported instead.
+var pmuFallback bool
+
 // InitPMUForChild sets up PMU to be inherited by child process
 func InitPMUForChild() error {
 	if !*pmu {
@@ -253,15 +315,26 @@ func InitPMUForChild() error {
 	var err error
 	globalPMU, err = SetupPMU(0) // 0 = current process, will be inherited
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "Warning: hardware counters unavailable, reporting CPU time only: %v\n", err)
+		pmuFallback = true
 	}
 	return nil
 }
 
-// ReadAndClosePMU reads final PMU values and closes
-func ReadAndClosePMU() PMUCounters {
+// ReadAndClosePMU reads final PMU values and closes. Without perf events it
+// returns the CPU times of the exited child described by state, if any.
+func ReadAndClosePMU(state *os.ProcessState) PMUCounters {
 	if globalPMU == nil {
-		return PMUCounters{}
+		if !pmuFallback || state == nil {
+			return PMUCounters{}
+		}
+		user, sys := state.UserTime(), state.SystemTime()
+		return PMUCounters{
+			UserNs:      uint64(user),
+			SystemNs:    uint64(sys),
+			TaskClockNs: uint64(user + sys),
+			Fallback:    true,
+		}
 	}
 	
 	counters, err := globalPMU.Read()
@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPMUHint_ClassifiesErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{syscall.EACCES, "perf_event_paranoid"},
+		{syscall.EPERM, "CAP_PERFMON"},
+		{syscall.ENOENT, "not supported"},
+		{syscall.EOPNOTSUPP, "not supported"},
+		{syscall.ENOSYS, "seccomp"},
+		{fmt.Errorf("wrapped: %w", syscall.EACCES), "perf_event_paranoid"},
+		{syscall.EINVAL, "perf_event_paranoid"},
+	}
+	for _, tt := range tests {
+		if got := pmuHint(tt.err); !strings.Contains(got, tt.want) {
+			t.Errorf("pmuHint(%v) = %q, want it to mention %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPrintPMUSummary_RusageFallback(t *testing.T) {
+	// NOTE: Not parallel because it modifies global flags
+	old := *pmu
+	defer func() { *pmu = old }()
+	*pmu = true
+
+	out := captureStdout(t, func() {
+		PrintPMUSummary(PMUCounters{UserNs: 30_000_000, SystemNs: 10_000_000, TaskClockNs: 40_000_000, WallNs: 80_000_000, Fallback: true})
+	})
+	if strings.Contains(out, "CPU Cycles") {
+		t.Fatalf("expected no hardware counters in the fallback, got:\n%s", out)
+	}
+	for _, want := range []string{"from rusage", "User:", "30ms", "On-CPU Time:", "50% of 80ms wall"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in fallback summary, got:\n%s", want, out)
+		}
+	}
+}
@@ -2,7 +2,10 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 // PMUCounters holds hardware performance counter values (stub for non-Linux)
 type PMUCounters struct {
@@ -11,6 +14,11 @@ type PMUCounters struct {
 	CacheReferences uint64
 	CacheMisses     uint64
 	BranchMisses    uint64
+	TaskClockNs     uint64
+	WallNs          uint64
+	UserNs          uint64
+	SystemNs        uint64
+	Fallback        bool
 }
 
 // PMUGroup is a stub for non-Linux systems
@@ -49,6 +57,6 @@ func InitPMUForChild() error {
 }
 
 // ReadAndClosePMU returns zero counters on non-Linux systems
-func ReadAndClosePMU() PMUCounters {
+func ReadAndClosePMU(state *os.ProcessState) PMUCounters {
 	return PMUCounters{}
 }
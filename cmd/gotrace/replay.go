@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/napolitain/gotrace/trace"
+)
+
+// runReplay implements "gotrace replay [--speed N] FILE": it loads entries
+// saved with trace.ExportJSON and renders them like a live run, followed by
+// the summary.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 0, "replay at this multiple of the recorded timing (0 prints without delays)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gotrace replay [--speed N] FILE\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("replay needs exactly one trace file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := trace.ImportJSON(f)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", fs.Arg(0), err)
+	}
+	trace.Replay(entries, *speed)
+	trace.PrintSummary()
+	return nil
+}
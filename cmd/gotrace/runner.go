@@ -2,23 +2,48 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/fs"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/mod/modfile"
 )
 
+// Environment variables read by the trace package in the instrumented binary
+const (
+	envProfileMem = "GOTRACE_PROFILE_MEM"
+	envCollector  = "GOTRACE_COLLECTOR"
+	envFlat       = "GOTRACE_FLAT"
+	envColor      = "GOTRACE_COLOR"
+	envSummary    = "GOTRACE_SUMMARY_FILE"
+	envSummaryTop = "GOTRACE_SUMMARY_TOP"
+	envHTML       = "GOTRACE_HTML_FILE"
+	envJSON       = "GOTRACE_JSON_FILE"
+	envFailOnHot  = "GOTRACE_FAIL_ON_HOT"
+	envByReceiver = "GOTRACE_GROUP_RECEIVER"
+)
+
+// keptErrs holds the instrumentation failures copyAndInstrumentModule went
+// past under --keep-going.
+var keptErrs []error
+
 // RunHot instruments the target in-memory, compiles, and executes it
-func RunHot(target string, args []string) error {
-	// Resolve target to absolute path
-	absTarget, err := filepath.Abs(target)
+func RunHot(target string, args []string) (err error) {
+	// Resolve target to an absolute path with symlinks evaluated
+	absTarget, err := resolveTarget(target)
 	if err != nil {
 		return fmt.Errorf("resolve target: %w", err)
 	}
@@ -32,8 +57,10 @@ func RunHot(target string, args []string) error {
 	}
 
 	// Validate flag combinations
-	if *functionFlag != "" && (*from != "" || *until != "") {
-		return fmt.Errorf("--function cannot be used with --from or --until")
+	switch *colorMode {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("--color must be auto, always or never, got %q", *colorMode)
 	}
 
 	// Find module root
@@ -45,15 +72,100 @@ func RunHot(target string, args []string) error {
 		return fmt.Errorf("no go.mod found for %s", absTarget)
 	}
 
-	// Handle call graph filtering based on --from and --until flags
-	if *from != "" || *until != "" {
-		if *verbose {
+	// Work out which functions to instrument
+	if err := resolveSelection(moduleRoot); err != nil {
+		return err
+	}
+
+	// Create temp directory for instrumented code
+	tempDir, err := os.MkdirTemp("", "gotrace-*")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	if verbose == 0 {
+		defer os.RemoveAll(tempDir)
+	} else {
+		fmt.Printf("Temp directory (not cleaned up in verbose mode): %s\n", tempDir)
+	}
+
+	// Copy and instrument the entire module
+	if err := copyAndInstrumentModule(moduleRoot, tempDir); err != nil {
+		return fmt.Errorf("instrument module: %w", err)
+	}
+	// With --keep-going, whatever the run does, fail with the files that
+	// couldn't be instrumented
+	defer func() {
+		if kept := keptError(); kept != nil {
+			err = errors.Join(err, kept)
+		}
+	}()
+
+	// Determine the relative path from module root to target
+	relTarget, err := filepath.Rel(moduleRoot, absTarget)
+	if err != nil {
+		return fmt.Errorf("relative path: %w", err)
+	}
+
+	// Run go mod tidy to sync dependencies after adding gotrace import
+	if err := runGoModTidy(tempDir); err != nil {
+		return fmt.Errorf("go mod tidy: %w", err)
+	}
+
+	// Build the instrumented code
+	buildTarget := filepath.Join(tempDir, relTarget)
+	if *testMode {
+		if err := addTestSummary(buildTarget); err != nil {
+			return fmt.Errorf("add test summary: %w", err)
+		}
+		// Tests expect to run in their package directory, and testdata
+		// isn't copied
+		runDir = absTarget
+	}
+	binaryName := "gotrace-binary"
+	if runtime.GOOS == "windows" {
+		binaryName += ".exe"
+	}
+	binaryPath := filepath.Join(tempDir, binaryName)
+	if err := buildInstrumented(buildTarget, binaryPath); err != nil {
+		return fmt.Errorf("build: %w", err)
+	}
+
+	// Run the binary, saving its traces for --diff-base
+	if *diffBase != "" {
+		diffRunPath = filepath.Join(tempDir, "gotrace-run.jsonl")
+	}
+	if err := runBinary(binaryPath, args); err != nil {
+		return err
+	}
+	if *diffBase != "" {
+		return compareWithBase(diffRunPath)
+	}
+	return nil
+}
+
+// resolveSelection sets up the filters that need the module at moduleRoot
+// to decide which functions are instrumented. RunHot and the --dry-run and
+// list previews share it, so they select the same functions.
+func resolveSelection(moduleRoot string) error {
+	if *functionFlag != "" && (*from != "" || *until != "") {
+		return fmt.Errorf("--function cannot be used with --from or --until")
+	}
+
+	// Handle call graph filtering based on --from, --until, --trace-stdlib-boundary, --fan-in and --leaves-only flags
+	if *from != "" || *until != "" || *boundaryOnly || *fanInTop > 0 || *leavesOnly {
+		if verbose >= 1 {
 			if *from != "" && *until != "" {
 				fmt.Printf("Building call graph to find path from %q to %q...\n", *from, *until)
 			} else if *from != "" {
 				fmt.Printf("Building call graph to find callees from %q...\n", *from)
-			} else {
+			} else if *until != "" {
 				fmt.Printf("Building call graph to find path to %q...\n", *until)
+			} else if *boundaryOnly {
+				fmt.Printf("Building call graph to find package boundary crossings...\n")
+			} else if *leavesOnly {
+				fmt.Printf("Building call graph to find leaf functions...\n")
+			} else {
+				fmt.Printf("Building call graph to rank functions by fan-in...\n")
 			}
 		}
 
@@ -70,7 +182,7 @@ func RunHot(target string, args []string) error {
 			if err != nil {
 				return fmt.Errorf("find path segment: %w", err)
 			}
-			if *verbose {
+			if verbose >= 1 {
 				fmt.Printf("Will instrument %d functions in path from %q to %q\n", len(funcs), *from, *until)
 			}
 		case *from != "":
@@ -79,79 +191,117 @@ func RunHot(target string, args []string) error {
 			if err != nil {
 				return fmt.Errorf("find callees: %w", err)
 			}
-			if *verbose {
+			if verbose >= 1 {
 				fmt.Printf("Will instrument %d functions called from %q\n", len(funcs), *from)
 			}
-		default:
+		case *until != "":
 			// Backward: all callers to target (existing behavior)
 			funcs, err = findCallersTo(graph, prog, *until)
 			if err != nil {
 				return fmt.Errorf("find callers: %w", err)
 			}
-			if *verbose {
+			if verbose >= 1 {
 				fmt.Printf("Will instrument functions in call path to %q\n", *until)
 			}
 		}
-		allowedFuncs = funcs
-	}
 
-	// If --function is specified, only instrument that function
-	if *functionFlag != "" {
-		if *verbose {
-			fmt.Printf("Micro-benchmark mode: only tracing %q\n", *functionFlag)
+		// --trace-stdlib-boundary, --fan-in and --leaves-only narrow any --from/--until selection
+		var modulePath string
+		if *boundaryOnly || *fanInTop > 0 || *leavesOnly {
+			if modulePath, err = readModulePath(filepath.Join(moduleRoot, "go.mod")); err != nil {
+				return fmt.Errorf("read module path: %w", err)
+			}
 		}
-		targetFunction = *functionFlag
-	}
-
-	// Create temp directory for instrumented code
-	tempDir, err := os.MkdirTemp("", "gotrace-*")
-	if err != nil {
-		return fmt.Errorf("create temp dir: %w", err)
-	}
-	if !*verbose {
-		defer os.RemoveAll(tempDir)
-	} else {
-		fmt.Printf("Temp directory (not cleaned up in verbose mode): %s\n", tempDir)
+		if *boundaryOnly {
+			funcs = intersectFuncs(funcs, findBoundaryFuncs(graph, modulePath))
+			if verbose >= 1 {
+				fmt.Printf("Will instrument %d functions entered across package boundaries\n", len(funcs))
+			}
+		}
+		if *leavesOnly {
+			funcs = intersectFuncs(funcs, findLeafFuncs(graph, modulePath))
+			if verbose >= 1 {
+				fmt.Printf("Will instrument %d leaf functions\n", len(funcs))
+			}
+		}
+		// Rank last, among the functions the other flags left, so there are N
+		if *fanInTop > 0 {
+			ranked := rankByFanIn(graph, modulePath, funcs)
+			top := ranked[:min(*fanInTop, len(ranked))]
+			if !*jsonOut {
+				fmt.Printf("Top %d functions by fan-in:\n", len(top))
+			}
+			choke := map[string]bool{"main": true}
+			for _, f := range top {
+				if !*jsonOut {
+					fmt.Printf("  %4d callers  %s\n", f.callers, f.name)
+				}
+				choke[f.name] = true
+			}
+			funcs = intersectFuncs(funcs, choke)
+		}
+		allowedFuncs = funcs
 	}
 
-	// Copy and instrument the entire module
-	if err := copyAndInstrumentModule(moduleRoot, tempDir); err != nil {
-		return fmt.Errorf("instrument module: %w", err)
+	// If --pkgs is specified, only instrument the matching packages
+	if *pkgs != "" {
+		modulePath, err := readModulePath(filepath.Join(moduleRoot, "go.mod"))
+		if err != nil {
+			return fmt.Errorf("read module path: %w", err)
+		}
+		if pkgPatterns, err = parsePkgPatterns(*pkgs, moduleRoot, modulePath); err != nil {
+			return err
+		}
 	}
 
-	// Determine the relative path from module root to target
-	relTarget, err := filepath.Rel(moduleRoot, absTarget)
-	if err != nil {
-		return fmt.Errorf("relative path: %w", err)
+	// If --files is specified, only instrument the listed files and directories
+	if *fileList != "" {
+		paths, err := readFileList(*fileList, os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read --files list: %w", err)
+		}
+		if verbose >= 1 {
+			fmt.Printf("Will instrument functions in %d listed files and directories\n", len(paths))
+		}
+		selectedPaths = paths
 	}
 
-	// Run go mod tidy to sync dependencies after adding gotrace import
-	if err := runGoModTidy(tempDir); err != nil {
-		return fmt.Errorf("go mod tidy: %w", err)
+	// If --changed is specified, only instrument functions touched since that revision
+	if *changed != "" {
+		lines, err := gitChangedLines(moduleRoot, *changed)
+		if err != nil {
+			return fmt.Errorf("find changed lines: %w", err)
+		}
+		if verbose >= 1 {
+			fmt.Printf("Will instrument functions in %d files changed since %s\n", len(lines), *changed)
+		}
+		changedLines = lines
 	}
 
-	// Build the instrumented code
-	buildTarget := filepath.Join(tempDir, relTarget)
-	binaryName := "gotrace-binary"
-	if runtime.GOOS == "windows" {
-		binaryName += ".exe"
-	}
-	binaryPath := filepath.Join(tempDir, binaryName)
-	if err := buildInstrumented(buildTarget, binaryPath); err != nil {
-		return fmt.Errorf("build: %w", err)
+	// If --function is specified, only instrument that function
+	if *functionFlag != "" {
+		if verbose >= 1 {
+			fmt.Printf("Micro-benchmark mode: only tracing %q\n", *functionFlag)
+		}
+		targetFunction = *functionFlag
 	}
-
-	// Run the binary
-	return runBinary(binaryPath, args)
+	return nil
 }
 
 // copyAndInstrumentModule copies and instruments the entire module
 func copyAndInstrumentModule(moduleRoot, tempDir string) error {
-	// Check if this is the gotrace module itself
-	isGotraceModule := false
+	// Module path of the root and of each nested module, to tell the import
+	// path of every directory and skip the cmd/gotrace dir of any gotrace copy
+	modules := make(map[string]string)
 	if modPath, err := readModulePath(filepath.Join(moduleRoot, "go.mod")); err == nil {
-		isGotraceModule = (modPath == traceModule)
+		modules[moduleRoot] = modPath
 	}
+	replacedDirs := localReplaceDirs(moduleRoot)
+	seenPkgs := make(map[string]bool) // For --verbose progress
+	// Directories holding a copy of the trace package: this module itself, a
+	// fork or a vendored copy, under whatever import path
+	traceDirs := make(map[string]bool)
+	keptErrs = nil
 
 	// Walk the module and process files
 	return filepath.WalkDir(moduleRoot, func(path string, d fs.DirEntry, err error) error {
@@ -178,12 +328,24 @@ func copyAndInstrumentModule(moduleRoot, tempDir string) error {
 			if rel == filepath.Join("test", "projects") {
 				return filepath.SkipDir
 			}
-			// Skip cmd/gotrace dir when instrumenting gotrace itself (avoid instrumenting the tool)
-			if isGotraceModule {
-				if rel == filepath.Join("cmd", "gotrace") {
-					return filepath.SkipDir
+			// Nested modules only take part in the build when go.mod replaces
+			// them with their local directory; leave the others out
+			if path != moduleRoot {
+				if modPath, err := readModulePath(filepath.Join(path, "go.mod")); err == nil {
+					if !replacedDirs[path] {
+						fmt.Fprintf(os.Stderr, "Note: skipping nested module %s (%s): not replaced by a local path in go.mod\n", rel, modPath)
+						return filepath.SkipDir
+					}
+					if verbose >= 1 {
+						fmt.Printf("Instrumenting nested module %s (%s)\n", rel, modPath)
+					}
+					modules[path] = modPath
 				}
 			}
+			// Skip the cmd/gotrace dir of any copy of gotrace (avoid instrumenting the tool)
+			if importPathOf(path, modules) == traceModule+"/cmd/gotrace" {
+				return filepath.SkipDir
+			}
 			return os.MkdirAll(destPath, 0755)
 		}
 
@@ -212,8 +374,8 @@ func copyAndInstrumentModule(moduleRoot, tempDir string) error {
 			return os.WriteFile(destPath, content, 0644)
 		}
 
-		// Skip test files
-		if strings.HasSuffix(path, "_test.go") {
+		// Skip test files, unless tracing tests
+		if strings.HasSuffix(path, "_test.go") && !*testMode {
 			return os.WriteFile(destPath, content, 0644)
 		}
 
@@ -222,26 +384,182 @@ func copyAndInstrumentModule(moduleRoot, tempDir string) error {
 			return os.WriteFile(destPath, content, 0644)
 		}
 
-		// Skip files that already import the trace package (already instrumented)
-		if bytes.Contains(content, []byte(tracePkg)) {
+		// Copy files under --skip-dir directories as-is so they still build
+		if isSkippedDir(filepath.Dir(rel)) {
 			return os.WriteFile(destPath, content, 0644)
 		}
 
-		// Skip files in trace/ directory when instrumenting gotrace itself
-		if isGotraceModule && strings.HasPrefix(rel, "trace"+string(filepath.Separator)) {
+		// Skip any copy of the trace package; tracing it would recurse
+		if isTracePackageDir(filepath.Dir(path), traceDirs) {
 			return os.WriteFile(destPath, content, 0644)
 		}
 
+		if dir := filepath.Dir(rel); verbose >= 1 && !seenPkgs[dir] {
+			seenPkgs[dir] = true
+			fmt.Printf("Instrumenting package %s\n", importPathOf(filepath.Dir(path), modules))
+		}
+		if verbose >= 2 {
+			fmt.Printf("  %s\n", rel)
+		}
+
 		// Instrument the Go file using source-level injection (preserves all comments/directives)
 		instrumented, err := instrumentFileText(path, content)
 		if err != nil {
-			return fmt.Errorf("instrument %s: %w", path, err)
+			// The error names the file at its parser position
+			if !*keepGoing {
+				return err
+			}
+			// Leave the file as it is; the build only breaks if the target needs its package
+			fmt.Fprintf(os.Stderr, "Warning: %v; copying the file uninstrumented\n", err)
+			keptErrs = append(keptErrs, err)
+			return os.WriteFile(destPath, content, 0644)
 		}
 
 		return os.WriteFile(destPath, instrumented, 0644)
 	})
 }
 
+// keptError reports the files --keep-going copied uninstrumented, or nil.
+func keptError() error {
+	if len(keptErrs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d file(s) could not be instrumented:\n%w", len(keptErrs), errors.Join(keptErrs...))
+}
+
+// testMainFile is the file addTestSummary adds to a test package.
+const testMainFile = "gotrace_main_test.go"
+
+// addTestSummary makes the tests in dir print the trace summary when they
+// finish, by adding a TestMain that prints it after m.Run. A package that
+// has its own TestMain is left alone, with a note on how to add it.
+func addTestSummary(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	pkgName := ""
+	for _, file := range files {
+		node, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return err
+		}
+		if pkgName == "" {
+			pkgName = node.Name.Name
+		}
+		for _, decl := range node.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "TestMain" {
+				fmt.Fprintf(os.Stderr, "Note: %s has its own TestMain; call %s.PrintSummary() after m.Run() in it to get a summary\n",
+					filepath.Base(file), filepath.Base(tracePkg))
+				return nil
+			}
+		}
+	}
+	src := fmt.Sprintf(`package %s
+
+import (
+	"os"
+	"testing"
+
+	%s %q
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	%s.PrintSummary()
+	os.Exit(code)
+}
+`, pkgName, tracePkgAlias, tracePkg, tracePkgAlias)
+	return os.WriteFile(filepath.Join(dir, testMainFile), []byte(src), 0644)
+}
+
+// importPathOf returns the import path of directory dir, given the module
+// paths of the module roots seen so far, or "" outside of them.
+func importPathOf(dir string, modules map[string]string) string {
+	for current := dir; ; {
+		if modPath, ok := modules[current]; ok {
+			rel, err := filepath.Rel(current, dir)
+			if err != nil {
+				return ""
+			}
+			if rel == "." {
+				return modPath
+			}
+			return modPath + "/" + filepath.ToSlash(rel)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return ""
+		}
+		current = parent
+	}
+}
+
+// traceMarker is the constant the trace package declares (gotraceRuntime in
+// trace/trace.go) so copies of it are recognized by content, not path.
+const traceMarker = "gotraceRuntime"
+
+// isTracePackageDir reports whether the package in dir is a copy of the
+// trace package, i.e. one of its files declares traceMarker. Results are
+// cached in seen by directory.
+func isTracePackageDir(dir string, seen map[string]bool) bool {
+	if found, ok := seen[dir]; ok {
+		return found
+	}
+	seen[dir] = false
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, path := range matches {
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.Contains(content, []byte(traceMarker)) {
+			continue
+		}
+		node, err := parser.ParseFile(token.NewFileSet(), path, content, parser.SkipObjectResolution)
+		if err != nil || node.Name.Name != "trace" {
+			continue
+		}
+		for _, decl := range node.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					if name.Name == traceMarker {
+						seen[dir] = true
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// localReplaceDirs returns the absolute directories that moduleRoot's go.mod
+// replaces modules with, i.e. the local modules the build actually uses.
+func localReplaceDirs(moduleRoot string) map[string]bool {
+	dirs := make(map[string]bool)
+	content, err := os.ReadFile(filepath.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		return dirs
+	}
+	mod, err := modfile.Parse("go.mod", content, nil)
+	if err != nil {
+		return dirs
+	}
+	for _, rep := range mod.Replace {
+		if rep.New.Version != "" || !modfile.IsDirectoryPath(rep.New.Path) {
+			continue
+		}
+		dir := rep.New.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(moduleRoot, dir)
+		}
+		dirs[filepath.Clean(dir)] = true
+	}
+	return dirs
+}
+
 // instrumentGoMod adds the gotrace dependency to go.mod
 func instrumentGoMod(content []byte, moduleRoot string) ([]byte, error) {
 	mod, err := modfile.Parse("go.mod", content, nil)
@@ -254,66 +572,168 @@ func instrumentGoMod(content []byte, moduleRoot string) ([]byte, error) {
 		return content, nil
 	}
 
-	// Find local gotrace root for replace directive
+	// Find local gotrace root for replace directive, unless pinned
 	localRoot := findLocalGotraceRoot()
 	traceVersion := resolveTraceVersion()
+	if *pinVersion != "" {
+		localRoot, traceVersion = "", *pinVersion
+	}
+	replacePath, replaceVersion := localRoot, ""
+	if *pinReplace != "" {
+		replacePath, replaceVersion = parseTraceReplace(*pinReplace)
+	}
 
-	if localRoot == "" && traceVersion == "v0.0.0" {
-		return nil, fmt.Errorf("unable to locate gotrace module; run from gotrace repo or ensure it's installed")
+	if replacePath == "" && traceVersion == "v0.0.0" {
+		return nil, fmt.Errorf("unable to locate gotrace module; run from gotrace repo, ensure it's installed, or pin it with --trace-version or --trace-replace")
 	}
 
-	// Add require
-	if !hasRequire(mod, traceModule) {
+	// Add require, updating an existing one to a pinned version
+	if !hasRequire(mod, traceModule) || *pinVersion != "" {
 		if err := mod.AddRequire(traceModule, traceVersion); err != nil {
 			return nil, err
 		}
+		if verbose >= 3 {
+			fmt.Printf("go.mod: require %s %s\n", traceModule, traceVersion)
+		}
 	}
 
-	// Add replace if local
-	if localRoot != "" {
-		replacePath := localRoot
-		// Use absolute path for temp dir builds
-		if !hasReplace(mod, traceModule, replacePath) {
-			if err := mod.AddReplace(traceModule, "", replacePath, ""); err != nil {
-				return nil, err
-			}
+	// Add replace if local or pinned
+	if replacePath != "" && !hasReplace(mod, traceModule, replacePath) {
+		if err := mod.AddReplace(traceModule, "", replacePath, replaceVersion); err != nil {
+			return nil, err
+		}
+		if verbose >= 3 {
+			fmt.Printf("go.mod: replace %s => %s\n", traceModule, strings.TrimSpace(replacePath+" "+replaceVersion))
 		}
 	}
 
 	return mod.Format()
 }
 
-// runGoModTidy runs go mod tidy in the given directory
-func runGoModTidy(dir string) error {
-	cmd := exec.Command("go", "mod", "tidy")
-	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// goModChanges lists the require and replace lines that differ between two
+// versions of a go.mod, as "+ require path version" or "- replace old => new"
+// lines, removals first.
+func goModChanges(before, after []byte) ([]string, error) {
+	lines := func(content []byte) (map[string]bool, error) {
+		mod, err := modfile.Parse("go.mod", content, nil)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool)
+		for _, r := range mod.Require {
+			set["require "+r.Mod.Path+" "+r.Mod.Version] = true
+		}
+		for _, r := range mod.Replace {
+			set["replace "+strings.TrimSpace(r.Old.Path+" "+r.Old.Version)+" => "+strings.TrimSpace(r.New.Path+" "+r.New.Version)] = true
+		}
+		return set, nil
+	}
+	old, err := lines(before)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := lines(after)
+	if err != nil {
+		return nil, err
+	}
+	var added, dropped []string
+	for line := range cur {
+		if !old[line] {
+			added = append(added, "+ "+line)
+		}
+	}
+	for line := range old {
+		if !cur[line] {
+			dropped = append(dropped, "- "+line)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(dropped)
+	return append(dropped, added...), nil
+}
+
+// parseTraceReplace splits a --trace-replace value into the replacement
+// for the gotrace module: "path@version" for another module, or a local
+// directory, made absolute since the temp module lives elsewhere.
+func parseTraceReplace(value string) (path, version string) {
+	if p, v, ok := strings.Cut(value, "@"); ok && !modfile.IsDirectoryPath(p) {
+		return p, v
+	}
+	if abs, err := filepath.Abs(value); err == nil {
+		return abs, ""
+	}
+	return value, ""
+}
 
-	if *verbose {
+// tidyAttempts bounds how often go mod tidy is tried, waiting tidyBackoff
+// before the first retry and twice as long before each further one, so a
+// network hiccup while fetching modules doesn't abort the run.
+const tidyAttempts = 3
+
+var tidyBackoff = time.Second // Shortened in tests
+
+// runGoModTidy runs go mod tidy in the given directory, retrying failures
+func runGoModTidy(dir string) error {
+	if verbose >= 1 {
 		fmt.Printf("Running go mod tidy in %s...\n", dir)
 	}
 
-	return cmd.Run()
+	backoff := tidyBackoff
+	for attempt := 1; ; attempt++ {
+		cmd := exec.Command("go", "mod", "tidy")
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		if attempt == tidyAttempts {
+			return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+		fmt.Fprintf(os.Stderr, "gotrace: go mod tidy failed (attempt %d/%d), retrying in %s: %v\n", attempt, tidyAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
-// buildInstrumented compiles the instrumented code
+// buildInstrumented compiles the instrumented code, or its test binary
+// with --test
 func buildInstrumented(targetDir, outputPath string) error {
 	cmd := exec.Command("go", "build", "-o", outputPath, ".")
+	if *testMode {
+		cmd = exec.Command("go", "test", "-c", "-o", outputPath, ".")
+	}
 	cmd.Dir = targetDir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if *verbose {
+	if verbose >= 1 {
 		fmt.Printf("Building %s...\n", targetDir)
 	}
 
 	return cmd.Run()
 }
 
+// runDir, when set, is the working directory of the traced program.
+var runDir string
+
+// childExitError reports that the traced program exited with a non-zero
+// code. RunHot returns it after its cleanup and --keep-going report, and
+// gotrace then exits with the same code.
+type childExitError struct {
+	code int
+}
+
+func (e *childExitError) Error() string {
+	return fmt.Sprintf("traced program exited with code %d", e.code)
+}
+
 // runBinary executes the compiled binary with argument forwarding
 func runBinary(binaryPath string, args []string) error {
 	cmd := exec.Command(binaryPath, args...)
+	cmd.Dir = runDir
+	cmd.Env = childEnv()
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -327,9 +747,10 @@ func runBinary(binaryPath string, args []string) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
 		signal.Stop(sigCh)
-		ReadAndClosePMU() // cleanup PMU on error
+		ReadAndClosePMU(nil) // cleanup PMU on error
 		return fmt.Errorf("start: %w", err)
 	}
 
@@ -356,13 +777,14 @@ func runBinary(binaryPath string, args []string) error {
 	close(done)
 
 	// Read PMU counters after child exits
-	pmuCounters := ReadAndClosePMU()
+	pmuCounters := ReadAndClosePMU(cmd.ProcessState)
+	pmuCounters.WallNs = uint64(time.Since(start))
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			// Print PMU summary even on non-zero exit
 			PrintPMUSummary(pmuCounters)
-			os.Exit(exitErr.ExitCode())
+			return &childExitError{code: exitErr.ExitCode()}
 		}
 		return err
 	}
@@ -372,3 +794,52 @@ func runBinary(binaryPath string, args []string) error {
 
 	return nil
 }
+
+// childEnv returns the environment for the instrumented binary, forwarding
+// runner flags that the trace package reads at startup
+func childEnv() []string {
+	env := os.Environ()
+	if *profileMem > 0 {
+		env = append(env, envProfileMem+"="+profileMem.String())
+	}
+	if *collector != "" {
+		env = append(env, envCollector+"="+*collector)
+	}
+	if *summaryPath != "" {
+		// Absolute, so it doesn't depend on the program's working directory
+		path, err := filepath.Abs(*summaryPath)
+		if err != nil {
+			path = *summaryPath
+		}
+		env = append(env, envSummary+"="+path)
+	}
+	if *htmlOut != "" {
+		path, err := filepath.Abs(*htmlOut)
+		if err != nil {
+			path = *htmlOut
+		}
+		env = append(env, envHTML+"="+path)
+	}
+	if diffRunPath != "" {
+		env = append(env, envJSON+"="+diffRunPath)
+	}
+	if *topN > 0 {
+		env = append(env, envSummaryTop+"="+strconv.Itoa(*topN))
+	}
+	if *flatOutput {
+		env = append(env, envFlat+"=1")
+	}
+	if *colorMode != "auto" {
+		env = append(env, envColor+"="+*colorMode)
+	}
+	if *failOnHot {
+		env = append(env, envFailOnHot+"=1")
+	}
+	if *byReceiver {
+		env = append(env, envByReceiver+"=1")
+	}
+	if *gomaxprocs > 0 {
+		env = append(env, "GOMAXPROCS="+strconv.Itoa(*gomaxprocs))
+	}
+	return env
+}
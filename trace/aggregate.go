@@ -0,0 +1,174 @@
+package trace
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync/atomic"
+)
+
+// aggregateOnly replaces per-call recording with per-function aggregates.
+var aggregateOnly atomic.Bool
+
+// keepSlowestOnly keeps only each function's slowest call plus its count
+// and total (SetKeepSlowestOnly).
+var keepSlowestOnly atomic.Bool
+
+// aggregates holds running per-function statistics in aggregate-only and
+// keep-slowest-only mode. Guarded by mu.
+var aggregates = make(map[string]*aggregate)
+
+// SetAggregateOnly switches recording to per-function running aggregates
+// (count, total, min/max, and a quantile sketch) instead of storing every
+// Entry, keeping memory O(1) per function for long runs. PrintSummary and
+// PrintFunctionStats keep working with approximate percentiles; GetTraces
+// and GetHotPaths return nothing for calls recorded in this mode.
+func SetAggregateOnly(enabled bool) {
+	aggregateOnly.Store(enabled)
+}
+
+// SetKeepSlowestOnly records, per function, only the slowest call and a
+// running count, total and min/max, for a compact worst-case report that
+// uses little memory. PrintSummary keeps its tables; GetTraces and
+// GetHotPaths return the slowest call of each function, and
+// PrintFunctionStats has no percentiles. SetAggregateOnly takes precedence.
+func SetKeepSlowestOnly(enabled bool) {
+	keepSlowestOnly.Store(enabled)
+}
+
+// aggregating reports whether calls are recorded into aggregates rather
+// than stored one by one.
+func aggregating() bool {
+	return aggregateOnly.Load() || keepSlowestOnly.Load()
+}
+
+// aggregate is the running summary of all calls to one function.
+type aggregate struct {
+	slowestOnly bool // Recorded by SetKeepSlowestOnly: no sketch, slowest is exported
+	count       int
+	total       int64
+	min         int64
+	max         int64
+	zeros       int     // Calls that measured 0ns
+	mean        float64 // Welford running mean and sum of squared deviations
+	m2          float64
+	slowest     Entry // Slowest call seen, kept for the summary's top calls
+	sketch      sketch
+}
+
+func (a *aggregate) add(e Entry) {
+	d := e.Duration
+	if a.count == 0 || d < a.min {
+		a.min = d
+	}
+	if a.count == 0 || d > a.max {
+		a.max = d
+		a.slowest = e
+	}
+	if d == 0 {
+		a.zeros++
+	}
+	a.count++
+	a.total += d
+	delta := float64(d) - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (float64(d) - a.mean)
+	if !a.slowestOnly {
+		a.sketch.add(d)
+	}
+}
+
+// distribution returns the approximate timing distribution of the calls.
+func (a *aggregate) distribution() distribution {
+	return distribution{
+		count:  a.count,
+		total:  a.total,
+		min:    a.min,
+		max:    a.max,
+		zeros:  a.zeros,
+		mean:   a.total / int64(a.count),
+		median: a.sketch.quantile(0.5),
+		p95:    a.sketch.quantile(0.95),
+		p99:    a.sketch.quantile(0.99),
+		stdDev: int64(math.Sqrt(a.m2 / float64(a.count))),
+	}
+}
+
+// recordAggregate folds e into its function's aggregate. Callers must hold mu.
+func recordAggregate(e Entry) {
+	a, ok := aggregates[e.Name]
+	if !ok {
+		a = &aggregate{slowestOnly: !aggregateOnly.Load()}
+		aggregates[e.Name] = a
+	}
+	a.add(e)
+}
+
+// slowestEntries returns the slowest call of each function recorded in
+// keep-slowest-only mode. Callers must hold mu.
+func slowestEntries() []Entry {
+	var entries []Entry
+	for _, a := range aggregates {
+		if a.slowestOnly {
+			entries = append(entries, a.slowest)
+		}
+	}
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(a.StartNs, b.StartNs)
+	})
+	return entries
+}
+
+// Relative accuracy of sketch quantiles.
+const sketchAlpha = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAlpha) / (1 - sketchAlpha)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// sketch is a DDSketch-style log-bucketed histogram. Quantiles are within
+// sketchAlpha relative error, and memory grows only with the logarithm of
+// the value range (about 1400 buckets for 1ns to 1000s).
+type sketch struct {
+	buckets map[int]uint64
+	zeros   uint64
+	count   uint64
+}
+
+func (s *sketch) add(v int64) {
+	s.count++
+	if v <= 0 {
+		s.zeros++
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[int]uint64)
+	}
+	s.buckets[int(math.Ceil(math.Log(float64(v))/sketchLogGamma))]++
+}
+
+// quantile returns the approximate value at quantile q in [0, 1], using the
+// same rank convention as the exact percentiles in PrintFunctionStats.
+func (s *sketch) quantile(q float64) int64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(float64(s.count-1) * q)
+	if rank < s.zeros {
+		return 0
+	}
+	keys := make([]int, 0, len(s.buckets))
+	for k := range s.buckets {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	cum := s.zeros
+	for _, k := range keys {
+		cum += s.buckets[k]
+		if cum > rank {
+			return int64(2 * math.Pow(sketchGamma, float64(k)) / (sketchGamma + 1))
+		}
+	}
+	return int64(2 * math.Pow(sketchGamma, float64(keys[len(keys)-1])) / (sketchGamma + 1))
+}
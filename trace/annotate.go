@@ -0,0 +1,50 @@
+package trace
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Annotation is a marker placed on the timeline with Annotate.
+type Annotation struct {
+	Message string // Marker text
+	TimeNs  int64  // Time in nanoseconds (same clock as Entry.StartNs)
+	Depth   int32  // Call stack depth at the time of the marker
+	GID     uint64 // Goroutine ID
+}
+
+var (
+	annotationsMu sync.Mutex
+	annotations   []Annotation
+)
+
+// Annotate prints a marker line in the live output and records it so
+// exporters can place it on the timeline:
+//
+//	trace.Annotate("request 42 start")
+func Annotate(msg string) {
+	a := Annotation{Message: msg, TimeNs: clock(), Depth: atomic.LoadInt32(&depth), GID: getGID()}
+
+	annotationsMu.Lock()
+	annotations = append(annotations, a)
+	annotationsMu.Unlock()
+
+	if collecting.Load() {
+		return
+	}
+	flushFold()
+	indent := indentFor(a.Depth + 1)
+	if colorize.Load() {
+		printLine("%s%s", indent, headerStyle.Render("--- "+msg+" ---"))
+	} else {
+		printLine("%s--- %s ---", indent, msg)
+	}
+}
+
+// GetAnnotations returns a copy of all recorded annotations.
+func GetAnnotations() []Annotation {
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	return slices.Clone(annotations)
+}
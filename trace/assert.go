@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"strings"
+	"time"
+)
+
+// TestingT is the part of testing.TB the assertion helpers use. Taking an
+// interface keeps the testing package out of traced binaries.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertCalled fails t unless name was recorded exactly n times:
+//
+//	trace.Reset()
+//	cache.Get("k")
+//	trace.AssertCalled(t, "store.Load", 1)
+func AssertCalled(t TestingT, name string, n int) {
+	t.Helper()
+	calls := tracesNamed(name)
+	if len(calls) == n {
+		return
+	}
+	t.Errorf("trace: expected %s to be called %d times, got %d%s", name, n, len(calls), recordedNames(name))
+}
+
+// AssertMaxDuration fails t if any recorded call of name took longer than
+// limit, reporting the slowest one, or if name was never called.
+func AssertMaxDuration(t TestingT, name string, limit time.Duration) {
+	t.Helper()
+	calls := tracesNamed(name)
+	if len(calls) == 0 {
+		t.Errorf("trace: expected %s to finish within %s, but it was never called%s", name, limit, recordedNames(name))
+		return
+	}
+	slowest, over := calls[0], 0
+	for _, e := range calls {
+		if e.Duration > slowest.Duration {
+			slowest = e
+		}
+		if time.Duration(e.Duration) > limit {
+			over++
+		}
+	}
+	if over > 0 {
+		t.Errorf("trace: %d of %d calls to %s took longer than %s; slowest took %s at %s",
+			over, len(calls), name, limit, time.Duration(slowest.Duration), entryLocation(slowest))
+	}
+}
+
+// tracesNamed returns the recorded calls of name.
+func tracesNamed(name string) []Entry {
+	var calls []Entry
+	for _, e := range GetTraces() {
+		if e.Name == name {
+			calls = append(calls, e)
+		}
+	}
+	return calls
+}
+
+// recordedNames lists the distinct traced names, to help spot a misspelled
+// name in an assertion. It is empty when name itself was recorded.
+func recordedNames(name string) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range GetTraces() {
+		if e.Name == name {
+			return ""
+		}
+		if !seen[e.Name] {
+			seen[e.Name] = true
+			names = append(names, e.Name)
+		}
+	}
+	if len(names) == 0 {
+		return " (no calls recorded)"
+	}
+	return " (recorded: " + strings.Join(names, ", ") + ")"
+}
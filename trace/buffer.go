@@ -0,0 +1,96 @@
+package trace
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// flushSize batches recorded entries per goroutine before they are
+// appended to the shared traces slice (SetBufferFlushSize). Values below
+// 2 record every entry directly.
+var flushSize atomic.Int32
+
+// buffers holds the pending entries of each goroutine, keyed by GID. A
+// buffer is removed once it is flushed, so goroutines that have exited
+// leave nothing behind.
+var buffers sync.Map // uint64 -> *entryBuffer
+
+// entryBuffer collects one goroutine's finished entries. Only its goroutine
+// appends to it; the mutex is contended only by Flush.
+type entryBuffer struct {
+	mu      sync.Mutex
+	entries []Entry
+	flushed bool // Removed from buffers; the goroutine must start a new one
+}
+
+// flushLocked appends buf's entries to the shared trace set, taking mu with
+// lock, and removes buf from buffers. Callers must hold buf.mu.
+func (buf *entryBuffer) flushLocked(gid uint64, lock func()) {
+	if len(buf.entries) > 0 {
+		lock()
+		traces = append(traces, buf.entries...)
+		mu.Unlock()
+	}
+	buf.entries = nil
+	buf.flushed = true
+	buffers.CompareAndDelete(gid, buf)
+}
+
+// SetBufferFlushSize makes each goroutine collect up to n finished entries
+// locally and append them to the shared trace set in one batch, taking the
+// global lock once per batch instead of once per call. GetTraces, the
+// summaries and exports flush pending entries first; call Flush to drain
+// them explicitly. Entries from different goroutines are then no longer
+// interleaved in completion order. Zero or one (the default) disables
+// batching.
+func SetBufferFlushSize(n int) {
+	flushSize.Store(int32(n))
+	if n < 2 {
+		Flush()
+	}
+}
+
+// Flush appends all entries still pending in per-goroutine buffers to the
+// shared trace set.
+func Flush() {
+	buffers.Range(func(key, value any) bool {
+		buf := value.(*entryBuffer)
+		buf.mu.Lock()
+		buf.flushLocked(key.(uint64), mu.Lock)
+		buf.mu.Unlock()
+		return true
+	})
+}
+
+// bufferEntry adds e to its goroutine's buffer, flushing the buffer once it
+// holds size entries. It reports false when batching is disabled.
+func bufferEntry(e Entry) bool {
+	size := int(flushSize.Load())
+	if size < 2 {
+		return false
+	}
+	for {
+		v, ok := buffers.Load(e.GID)
+		if !ok {
+			v, _ = buffers.LoadOrStore(e.GID, &entryBuffer{})
+		}
+		buf := v.(*entryBuffer)
+		buf.mu.Lock()
+		if buf.flushed {
+			// Flush removed it after we loaded it
+			buf.mu.Unlock()
+			continue
+		}
+		buf.entries = append(buf.entries, e)
+		if len(buf.entries) >= size {
+			buf.flushLocked(e.GID, lockTraces)
+		}
+		buf.mu.Unlock()
+		return true
+	}
+}
+
+// resetBuffers drops all pending entries.
+func resetBuffers() {
+	buffers.Clear()
+}
@@ -0,0 +1,131 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+)
+
+// processName names this process in Chrome trace exports (SetProcessName).
+var processName atomic.Pointer[string]
+
+// SetProcessName sets the process name shown by trace viewers for
+// ExportChromeTrace output. It defaults to the executable's base name.
+// Exports are keyed by the real process ID, so traces of several
+// cooperating processes can be loaded together and told apart.
+func SetProcessName(name string) {
+	processName.Store(&name)
+}
+
+// chromeEvent is one event of the Chrome trace event format, as loaded by
+// chrome://tracing and Perfetto. Timestamps are in microseconds.
+type chromeEvent struct {
+	Name  string         `json:"name"`
+	Phase string         `json:"ph"`
+	TS    float64        `json:"ts"`
+	Dur   *float64       `json:"dur,omitempty"` // Complete events only, so a zero length is still written
+	PID   int            `json:"pid"`
+	TID   uint64         `json:"tid"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// ExportChromeTrace writes the collected traces to w in the Chrome trace
+// event format, for chrome://tracing or ui.perfetto.dev: one complete event
+// per call on a track per goroutine, annotations as instant events, and
+// metadata events naming the process and goroutines.
+func ExportChromeTrace(w io.Writer) error {
+	return writeTraceEvents(w, false)
+}
+
+// ExportPerfetto writes the collected traces to the file at path in the
+// JSON trace format ui.perfetto.dev opens. It is ExportChromeTrace with the
+// timeline taken from each call's StartNs and EndNs, which nest the slices
+// on every goroutine's track, and an instant event where each panic was
+// raised.
+func ExportPerfetto(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeTraceEvents(f, true)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeTraceEvents writes the event file of ExportChromeTrace, or with
+// perfetto that of ExportPerfetto.
+func writeTraceEvents(w io.Writer, perfetto bool) error {
+	pid := os.Getpid()
+	name := filepath.Base(os.Args[0])
+	if p := processName.Load(); p != nil && *p != "" {
+		name = *p
+	}
+	events := []chromeEvent{{
+		Name: "process_name", Phase: "M", PID: pid,
+		Args: map[string]any{"name": name},
+	}}
+
+	threads := make(map[uint64]string)
+	for _, e := range GetTraces() {
+		je := toJSONEntry(e)
+		args := map[string]any{}
+		if len(je.Args) > 0 {
+			args["args"] = je.Args
+		}
+		if len(je.Returns) > 0 {
+			args["returns"] = je.Returns
+		}
+		if je.File != "" {
+			args["location"] = fmt.Sprintf("%s:%d", je.File, je.Line)
+		}
+		if je.Panicked {
+			args["panic"] = je.PanicVal
+		}
+		dur := e.Duration
+		if perfetto && e.EndNs >= e.StartNs {
+			dur = e.EndNs - e.StartNs
+		}
+		durUs := float64(dur) / 1e3
+		events = append(events, chromeEvent{
+			Name: e.Name, Phase: "X", PID: pid, TID: e.GID,
+			TS: float64(e.StartNs) / 1e3, Dur: &durUs,
+			Args: args,
+		})
+		if perfetto && e.Panicked {
+			events = append(events, chromeEvent{
+				Name: "panic: " + e.Name, Phase: "i", Scope: "t", PID: pid, TID: e.GID,
+				TS: float64(e.StartNs+dur) / 1e3, Args: map[string]any{"panic": je.PanicVal},
+			})
+		}
+		threads[e.GID] = e.GoroutineLabel
+	}
+	for _, a := range GetAnnotations() {
+		events = append(events, chromeEvent{
+			Name: a.Message, Phase: "i", Scope: "t", PID: pid, TID: a.GID,
+			TS: float64(a.TimeNs) / 1e3,
+		})
+	}
+	for _, gid := range slices.Sorted(maps.Keys(threads)) {
+		label := threads[gid]
+		if label == "" {
+			label = fmt.Sprintf("g%d", gid)
+		}
+		events = append(events, chromeEvent{
+			Name: "thread_name", Phase: "M", PID: pid, TID: gid,
+			Args: map[string]any{"name": label},
+		})
+	}
+
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []chromeEvent `json:"traceEvents"`
+		DisplayTimeUnit string        `json:"displayTimeUnit"`
+	}{events, "ns"})
+}
@@ -0,0 +1,8 @@
+//go:build !portable
+
+package trace
+
+import _ "unsafe" // For go:linkname
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
@@ -0,0 +1,14 @@
+//go:build portable
+
+package trace
+
+import "time"
+
+// clockBase anchors nanotime so it reads the monotonic clock without linkname.
+var clockBase = time.Now()
+
+// nanotime returns monotonic nanoseconds since package initialization.
+// This is the portable fallback for toolchains that forbid linkname.
+func nanotime() int64 {
+	return int64(time.Since(clockBase))
+}
@@ -0,0 +1,94 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	collectorMu   sync.Mutex
+	collectorConn net.Conn
+	collectorEnc  *json.Encoder
+	collecting    atomic.Bool
+)
+
+func init() {
+	if addr := os.Getenv("GOTRACE_COLLECTOR"); addr != "" {
+		network, address := parseCollectorAddr(addr)
+		if err := DialCollector(network, address); err != nil {
+			fmt.Fprintf(os.Stderr, "gotrace: collector unavailable, printing locally: %v\n", err)
+		}
+	}
+}
+
+// parseCollectorAddr splits "unix:/path" or "tcp:host:port" into network and
+// address. A bare "host:port" is treated as TCP.
+func parseCollectorAddr(addr string) (network, address string) {
+	for _, network := range []string{"unix", "tcp", "tcp4", "tcp6"} {
+		if rest, ok := strings.CutPrefix(addr, network+":"); ok {
+			return network, rest
+		}
+	}
+	return "tcp", addr
+}
+
+// DialCollector streams finished entries as NDJSON to a collector listening
+// on network/addr instead of printing them locally. If the connection drops,
+// tracing falls back to local printing.
+func DialCollector(network, addr string) error {
+	conn, err := net.DialTimeout(network, addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+
+	collectorMu.Lock()
+	if collectorConn != nil {
+		collectorConn.Close()
+	}
+	collectorConn = conn
+	collectorEnc = json.NewEncoder(conn)
+	collectorMu.Unlock()
+	collecting.Store(true)
+	return nil
+}
+
+// CloseCollector closes the collector connection, if any, and resumes local printing.
+func CloseCollector() {
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	closeCollectorLocked()
+}
+
+func closeCollectorLocked() {
+	collecting.Store(false)
+	if collectorConn != nil {
+		collectorConn.Close()
+		collectorConn = nil
+		collectorEnc = nil
+	}
+}
+
+// sendToCollector streams e to the collector. It returns false when no
+// collector is connected, in which case the caller should print locally.
+func sendToCollector(e Entry) bool {
+	if !collecting.Load() {
+		return false
+	}
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	if collectorEnc == nil {
+		return false
+	}
+	if err := collectorEnc.Encode(toJSONEntry(e)); err != nil {
+		fmt.Fprintf(os.Stderr, "gotrace: collector connection lost, printing locally: %v\n", err)
+		closeCollectorLocked()
+		return false
+	}
+	return true
+}
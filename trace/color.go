@@ -0,0 +1,34 @@
+package trace
+
+import (
+	"os"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// applyColorEnv sets up colored output from the environment. GOTRACE_COLOR
+// (set by gotrace --color) takes precedence: "always" forces color codes
+// even when output is piped, for a pager that renders them, and "never"
+// turns them off. Otherwise NO_COLOR turns color off, FORCE_COLOR forces
+// it on, and lipgloss keeps it for terminals only.
+func applyColorEnv() {
+	switch mode := os.Getenv("GOTRACE_COLOR"); {
+	case mode == "never":
+		colorize.Store(false)
+	case mode == "always":
+		forceColor()
+	case os.Getenv("NO_COLOR") != "":
+		colorize.Store(false)
+	case os.Getenv("FORCE_COLOR") != "" && os.Getenv("FORCE_COLOR") != "0":
+		forceColor()
+	default:
+		colorize.Store(true)
+	}
+}
+
+// forceColor enables color codes whether or not stdout is a terminal.
+func forceColor() {
+	colorize.Store(true)
+	lipgloss.SetColorProfile(termenv.TrueColor)
+}
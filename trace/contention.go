@@ -0,0 +1,64 @@
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// contentionSampleEvery is how many trace lock acquisitions share one
+	// timed sample when SetMonitorContention is on.
+	contentionSampleEvery = 16
+	// contentionWarnFraction is the share of total traced time spent waiting
+	// on the trace lock above which the summary warns.
+	contentionWarnFraction = 0.05
+)
+
+var (
+	monitorContention atomic.Bool
+	contentionLocks   atomic.Uint64
+	contentionWaitNs  atomic.Int64 // Sampled wait, scaled to all acquisitions
+)
+
+// SetMonitorContention makes the tracer time how long recording waits on its
+// own global lock, sampling one acquisition in 16, and PrintSummary warn
+// when the estimated wait exceeds 5% of the total traced time. Heavily
+// concurrent tracing then distorts the durations it measures; aggregate-only
+// mode (SetAggregateOnly) or batching (SetBufferFlushSize) take the lock
+// less often.
+func SetMonitorContention(enabled bool) {
+	monitorContention.Store(enabled)
+}
+
+// lockTraces acquires mu for recording. When monitoring, a sampled
+// acquisition first tries TryLock and, if the lock is held, times the wait.
+func lockTraces() {
+	if monitorContention.Load() && (contentionLocks.Add(1)-1)%contentionSampleEvery == 0 {
+		if mu.TryLock() {
+			return
+		}
+		start := clock()
+		mu.Lock()
+		contentionWaitNs.Add((clock() - start) * contentionSampleEvery)
+		return
+	}
+	mu.Lock()
+}
+
+// writeContentionWarning appends a warning to sb when the estimated wait on
+// the trace lock is a significant share of totalNs.
+func writeContentionWarning(sb *strings.Builder, totalNs int64) {
+	wait := contentionWaitNs.Load()
+	if wait == 0 || float64(wait) < contentionWarnFraction*float64(totalNs) {
+		return
+	}
+	sb.WriteString(warmStyle.Render(fmt.Sprintf("  ⚠️  ~%s waiting on the trace lock (%.0f%% of total time): tracing is distorting results, try SetAggregateOnly or SetBufferFlushSize",
+		formatDuration(wait), 100*float64(wait)/float64(max(totalNs, 1)))) + "\n")
+}
+
+// resetContention drops the measured wait.
+func resetContention() {
+	contentionLocks.Store(0)
+	contentionWaitNs.Store(0)
+}
@@ -0,0 +1,76 @@
+package trace
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	dumpOnExit atomic.Bool // Set once DumpOnExit has been called
+	exitDumped atomic.Bool // Set once the exit summary has been printed
+	inExit     atomic.Bool // Set while the OnExit funcs run, so one calling PrintSummary doesn't rerun them
+
+	exitMu    sync.Mutex
+	exitHooks []func()
+)
+
+// DumpOnExit arranges for the summary to be printed when the program exits
+// through main returning or through Exit. Defer the returned function at the
+// top of main so early returns and panics unwinding main still report:
+//
+//	defer trace.DumpOnExit()()
+//
+// Go has no exit hooks, so a bare os.Exit still skips the summary; call
+// trace.Exit instead. The summary is printed at most once.
+func DumpOnExit() func() {
+	dumpOnExit.Store(true)
+	return runExitDump
+}
+
+// Exit prints the summary, if DumpOnExit was registered, then exits with code.
+// Use it in place of os.Exit in traced programs.
+func Exit(code int) {
+	if dumpOnExit.Load() {
+		runExitDump()
+	}
+	exitFunc(code)
+}
+
+func runExitDump() {
+	if exitDumped.CompareAndSwap(false, true) {
+		PrintSummary()
+	}
+}
+
+// OnExit registers fn to run when the summary is printed: after PrintSummary
+// or PrintFunctionStats, in the order registered. Instrumented programs
+// print the summary once at the end of main, so this is where to hook extra
+// exporters:
+//
+//	trace.OnExit(func() { trace.ExportJSON(f) })
+func OnExit(fn func()) {
+	exitMu.Lock()
+	exitHooks = append(exitHooks, fn)
+	exitMu.Unlock()
+}
+
+// runExitHooks calls the OnExit funcs.
+func runExitHooks() {
+	if !inExit.CompareAndSwap(false, true) {
+		return
+	}
+	defer inExit.Store(false)
+	exitMu.Lock()
+	hooks := slices.Clone(exitHooks)
+	exitMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+func resetExitHooks() {
+	exitMu.Lock()
+	exitHooks = nil
+	exitMu.Unlock()
+}
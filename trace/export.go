@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportFormat selects the encoding of ExportHotPaths.
+type ExportFormat string
+
+const (
+	FormatJSON ExportFormat = "json" // JSON Lines, as written by ExportJSON
+	FormatCSV  ExportFormat = "csv"  // One header row, then one row per entry
+)
+
+// csvHeader names the columns written for FormatCSV, the fields of the JSON
+// format under the same names.
+var csvHeader = []string{"name", "args", "returns", "depth", "start_ns", "end_ns", "duration_ns",
+	"gid", "label", "package", "file", "line", "panicked", "panic", "wait", "goroutine", "receiver"}
+
+// ExportHotPaths writes only the entries GetHotPaths returns, those at or
+// above the hot threshold, to w in format, so CI can keep just the calls
+// worth looking at.
+func ExportHotPaths(w io.Writer, format ExportFormat) error {
+	switch format {
+	case FormatJSON:
+		return writeJSONEntries(w, GetHotPaths())
+	case FormatCSV:
+		return writeCSVEntries(w, GetHotPaths())
+	default:
+		return fmt.Errorf("unknown export format %q, want %q or %q", format, FormatJSON, FormatCSV)
+	}
+}
+
+// writeCSVEntries writes entries as CSV with the csvHeader columns,
+// formatting values as ExportJSON does and joining args and returns with
+// ", ".
+func writeCSVEntries(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		je := toJSONEntry(e)
+		row := []string{je.Name, strings.Join(je.Args, ", "), strings.Join(je.Returns, ", "),
+			strconv.Itoa(int(je.Depth)), strconv.FormatInt(je.StartNs, 10), strconv.FormatInt(je.EndNs, 10),
+			strconv.FormatInt(je.Duration, 10), strconv.FormatUint(je.GID, 10), je.Label, je.Package, je.File,
+			strconv.Itoa(je.Line), strconv.FormatBool(je.Panicked), je.PanicVal, je.Wait,
+			strconv.FormatBool(je.Lifetime), strconv.FormatBool(je.Receiver)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,32 @@
+package trace
+
+import "sync/atomic"
+
+// entryFilter, when set, decides per call whether it is traced
+// (SetEntryFilter).
+var entryFilter atomic.Pointer[func(name string, args []any) bool]
+
+// SetEntryFilter makes Trace, TraceOnPanic and Region consult keep before
+// every call: when it returns false the call is neither printed nor
+// recorded, e.g. to trace only requests for one user ID. The calls it makes
+// inside are not nested under the skipped call. Traced functions called
+// from keep itself are not traced. Nil (the default) traces every call.
+func SetEntryFilter(keep func(name string, args []any) bool) {
+	if keep == nil {
+		entryFilter.Store(nil)
+		return
+	}
+	entryFilter.Store(&keep)
+}
+
+// filteredOut reports whether the entry filter skips this call of name on
+// goroutine gid.
+func filteredOut(gid uint64, name string, args []any) bool {
+	keep := entryFilter.Load()
+	if keep == nil {
+		return false
+	}
+	beginPrinting(gid)
+	defer endPrinting(gid)
+	return !(*keep)(name, args)
+}
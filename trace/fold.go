@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Folding state for SetFoldRepeats. Like depth, it is process-wide.
+var (
+	foldRepeats   atomic.Bool
+	foldMu        sync.Mutex
+	foldLastName  string // Last exited function at foldLastDepth
+	foldLastDepth int32
+	foldCount     int   // Repeats of the last call hidden so far
+	foldInside    int32 // Depth of the repeat currently being hidden, 0 if none
+)
+
+// SetFoldRepeats folds consecutive calls of the same function at the same
+// depth into a single "name ×N" line in live output. Every call is still
+// recorded for the summary.
+func SetFoldRepeats(enabled bool) {
+	foldMu.Lock()
+	defer foldMu.Unlock()
+	if !enabled {
+		flushFoldLocked()
+	}
+	foldRepeats.Store(enabled)
+}
+
+// foldEnter reports whether the entry line for name at depth d should be hidden.
+func foldEnter(name string, d int32) bool {
+	if !foldRepeats.Load() {
+		return false
+	}
+	foldMu.Lock()
+	defer foldMu.Unlock()
+	if foldInside > 0 && d > foldInside {
+		return true // Callee of a hidden repeat
+	}
+	if foldLastName == name && foldLastDepth == d {
+		foldInside = d
+		foldCount++
+		return true
+	}
+	flushFoldLocked()
+	return false
+}
+
+// foldExit reports whether the exit line for name at depth d should be hidden.
+func foldExit(name string, d int32) bool {
+	if !foldRepeats.Load() {
+		return false
+	}
+	foldMu.Lock()
+	defer foldMu.Unlock()
+	if foldInside > 0 && d > foldInside {
+		return true
+	}
+	if foldInside == d {
+		foldInside = 0
+		return true
+	}
+	if foldLastName != name || foldLastDepth != d {
+		flushFoldLocked()
+	}
+	foldLastName, foldLastDepth = name, d
+	return false
+}
+
+// flushFold prints any pending folded repeats.
+func flushFold() {
+	foldMu.Lock()
+	defer foldMu.Unlock()
+	flushFoldLocked()
+}
+
+func flushFoldLocked() {
+	if foldCount > 0 {
+		indent := indentFor(foldLastDepth)
+		count := fmt.Sprintf("×%d", foldCount+1)
+		if colorize.Load() {
+			printLine("%s%s %s %s", indent, exitStyle.Render("↻"), funcStyle.Render(foldLastName), argsStyle.Render(count))
+		} else {
+			printLine("%s↻ %s %s", indent, foldLastName, count)
+		}
+	}
+	foldLastName, foldLastDepth, foldCount, foldInside = "", 0, 0, 0
+}
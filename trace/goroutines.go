@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// goroutineSampleInterval is how often SetTrackGoroutineCount samples.
+const goroutineSampleInterval = 10 * time.Millisecond
+
+var (
+	goroutineMu   sync.Mutex
+	goroutineStop chan struct{} // Non-nil while the sampler runs
+	goroutineMin  int
+	goroutineMax  int
+	goroutineSum  int64
+	goroutineN    int64
+)
+
+// SetTrackGoroutineCount starts or stops sampling runtime.NumGoroutine in
+// the background. While samples exist, PrintSummary reports the maximum,
+// minimum and average goroutine count, which shows leaks or excessive
+// spawning during the traced run. The sampler's own goroutine is not
+// counted.
+func SetTrackGoroutineCount(enabled bool) {
+	goroutineMu.Lock()
+	defer goroutineMu.Unlock()
+	if enabled == (goroutineStop != nil) {
+		return
+	}
+	if !enabled {
+		close(goroutineStop)
+		goroutineStop = nil
+		return
+	}
+	done := make(chan struct{})
+	goroutineStop = done
+	recordGoroutines(runtime.NumGoroutine())
+	go func() {
+		ticker := time.NewTicker(goroutineSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				goroutineMu.Lock()
+				recordGoroutines(runtime.NumGoroutine() - 1)
+				goroutineMu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// recordGoroutines folds one sample into the running stats. Callers must
+// hold goroutineMu.
+func recordGoroutines(n int) {
+	if goroutineN == 0 || n < goroutineMin {
+		goroutineMin = n
+	}
+	goroutineMax = max(goroutineMax, n)
+	goroutineSum += int64(n)
+	goroutineN++
+}
+
+// writeGoroutineSummary appends the goroutine count line to sb, taking a
+// final sample first when tracking is on.
+func writeGoroutineSummary(sb *strings.Builder) {
+	goroutineMu.Lock()
+	defer goroutineMu.Unlock()
+	if goroutineStop != nil {
+		recordGoroutines(runtime.NumGoroutine() - 1)
+	}
+	if goroutineN == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "  🧵 %s goroutines max   %s min   %s avg (%d samples)\n",
+		hotStyle.Render(fmt.Sprintf("%d", goroutineMax)),
+		fastStyle.Render(fmt.Sprintf("%d", goroutineMin)),
+		argsStyle.Render(fmt.Sprintf("%.1f", float64(goroutineSum)/float64(goroutineN))),
+		goroutineN)
+}
+
+// resetGoroutineCounts drops the samples taken so far; a running sampler
+// keeps going.
+func resetGoroutineCounts() {
+	goroutineMu.Lock()
+	goroutineMin, goroutineMax, goroutineSum, goroutineN = 0, 0, 0, 0
+	goroutineMu.Unlock()
+}
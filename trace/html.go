@@ -0,0 +1,188 @@
+package trace
+
+import (
+	"cmp"
+	"html/template"
+	"io"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// htmlFile, when set, receives an ExportHTML report from PrintSummary
+// (SetHTMLFile).
+var htmlFile atomic.Pointer[string]
+
+func init() {
+	if path := os.Getenv("GOTRACE_HTML_FILE"); path != "" {
+		SetHTMLFile(path)
+	}
+}
+
+// SetHTMLFile makes PrintSummary also write an ExportHTML report to path.
+// An empty path turns the report off again.
+func SetHTMLFile(path string) {
+	htmlFile.Store(&path)
+}
+
+// flameNode is one frame of the HTML flame graph: the time spent in a call
+// path, with Pct its share of the parent frame.
+type flameNode struct {
+	Name     string
+	Total    int64
+	Pct      float64
+	Children []*flameNode
+}
+
+// child returns the child frame for name, creating it if needed.
+func (n *flameNode) child(name string) *flameNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &flameNode{Name: name}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// buildFlame merges the call trees of entries into a tree of call paths.
+func buildFlame(entries []Entry) *flameNode {
+	root := &flameNode{Name: "all"}
+	var add func(parent *flameNode, calls []*callNode)
+	add = func(parent *flameNode, calls []*callNode) {
+		for _, c := range calls {
+			n := parent.child(c.e.Name)
+			n.Total += c.e.Duration
+			add(n, c.children)
+		}
+	}
+	roots := buildCallTrees(entries)
+	for _, r := range roots {
+		root.Total += r.e.Duration
+	}
+	add(root, roots)
+	setFlamePct(root)
+	return root
+}
+
+func setFlamePct(n *flameNode) {
+	slices.SortFunc(n.Children, func(a, b *flameNode) int { return cmp.Compare(b.Total, a.Total) })
+	for _, c := range n.Children {
+		if n.Total > 0 {
+			c.Pct = 100 * float64(c.Total) / float64(n.Total)
+		}
+		setFlamePct(c)
+	}
+}
+
+// htmlReport is the data rendered by htmlTemplate.
+type htmlReport struct {
+	Calls     int
+	Functions int
+	Total     int64
+	Wall      int64
+	Slowest   []Entry
+	Stats     []htmlStat
+	Flame     *flameNode
+}
+
+// htmlStat is a funcStat row of the call frequency table.
+type htmlStat struct {
+	Name            string
+	Count           int
+	Total, Avg, Max int64
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"dur": formatDuration,
+	"loc": entryLocation,
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>GoTrace Summary</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 4px 12px; border-bottom: 1px solid #ddd; text-align: left; }
+th { cursor: pointer; user-select: none; background: #f4f4f4; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+.flame { font-size: 12px; }
+.node { display: inline-flex; flex-direction: column; vertical-align: top; min-width: 0; }
+.bar { background: #f6a04d; border: 1px solid #fff; padding: 2px 4px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+.kids { display: flex; }
+</style>
+</head>
+<body>
+<h1>⚡ GoTrace Summary</h1>
+<p>{{.Calls}} total calls, {{dur .Total}} total time, {{.Functions}} unique functions{{if .Wall}}, {{dur .Wall}} wall clock{{end}}</p>
+
+<h2>🔥 Slowest Calls</h2>
+<table class="sortable">
+<thead><tr><th>#</th><th>Function</th><th>Duration</th><th>Location</th></tr></thead>
+<tbody>
+{{range $i, $e := .Slowest}}<tr><td class="num" data-sort="{{inc $i}}">{{inc $i}}</td><td>{{$e.Name}}</td><td class="num" data-sort="{{$e.Duration}}">{{dur $e.Duration}}</td><td>{{loc $e}}</td></tr>
+{{end}}</tbody>
+</table>
+
+<h2>📊 Call Frequency</h2>
+<table class="sortable">
+<thead><tr><th>Function</th><th>Calls</th><th>Total</th><th>Average</th><th>Max</th></tr></thead>
+<tbody>
+{{range .Stats}}<tr><td>{{.Name}}</td><td class="num" data-sort="{{.Count}}">{{.Count}}</td><td class="num" data-sort="{{.Total}}">{{dur .Total}}</td><td class="num" data-sort="{{.Avg}}">{{dur .Avg}}</td><td class="num" data-sort="{{.Max}}">{{dur .Max}}</td></tr>
+{{end}}</tbody>
+</table>
+{{if .Flame.Children}}
+<h2>🔥 Flame Graph</h2>
+<div class="flame"><div class="kids">{{range .Flame.Children}}{{template "node" .}}{{end}}</div></div>
+{{end}}
+<script>
+document.querySelectorAll("table.sortable").forEach(function (table) {
+  table.querySelectorAll("th").forEach(function (th, col) {
+    var asc = false;
+    th.addEventListener("click", function () {
+      asc = !asc;
+      var body = table.tBodies[0];
+      var rows = Array.from(body.rows);
+      var key = function (row) {
+        var cell = row.cells[col];
+        var v = cell.dataset.sort !== undefined ? cell.dataset.sort : cell.textContent;
+        var n = Number(v);
+        return isNaN(n) ? v : n;
+      };
+      rows.sort(function (a, b) {
+        var x = key(a), y = key(b);
+        var c = x < y ? -1 : x > y ? 1 : 0;
+        return asc ? c : -c;
+      });
+      rows.forEach(function (row) { body.appendChild(row); });
+    });
+  });
+});
+</script>
+</body>
+</html>
+{{define "node"}}<div class="node" style="width: {{.Pct}}%"><div class="bar" title="{{.Name}} {{dur .Total}}">{{.Name}}</div>{{if .Children}}<div class="kids">{{range .Children}}{{template "node" .}}{{end}}</div>{{end}}</div>{{end}}`))
+
+// ExportHTML writes a self-contained HTML report of the collected traces to
+// w: the summary totals, sortable tables of the slowest calls and of call
+// frequency, and a flame graph of time per call path.
+func ExportHTML(w io.Writer) error {
+	flushFold()
+	Flush()
+	mu.Lock()
+	stats, sorted := summaryStats()
+	wall, _ := wallAndBusy()
+	flame := buildFlame(traces)
+	mu.Unlock()
+
+	r := htmlReport{Functions: len(stats), Wall: wall, Slowest: sorted[:min(len(sorted), 50)], Flame: flame}
+	for _, s := range stats {
+		r.Calls += s.count
+		r.Total += s.total
+		r.Stats = append(r.Stats, htmlStat{s.name, s.count, s.total, s.total / int64(s.count), s.max})
+	}
+	return htmlTemplate.Execute(w, r)
+}
@@ -0,0 +1,36 @@
+package trace
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// interned holds one canonical copy of each string passed to intern.
+var interned sync.Map // string -> string
+
+// intern returns a canonical copy of s, so entries repeating the same name,
+// file, package or label share one string instead of each holding its own.
+func intern(s string) string {
+	if s == "" {
+		return s
+	}
+	if v, ok := interned.Load(s); ok {
+		return v.(string)
+	}
+	c := strings.Clone(s) // Don't keep a larger string s may be part of alive
+	v, _ := interned.LoadOrStore(c, c)
+	return v.(string)
+}
+
+// gidLabel returns "g<id>", the label of goroutines without pprof labels.
+// It is formatted per call rather than cached, since goroutine IDs are never
+// reused and a cache would grow with every goroutine traced.
+func gidLabel(gid uint64) string {
+	return "g" + strconv.FormatUint(gid, 10)
+}
+
+// resetInterned drops the interned strings.
+func resetInterned() {
+	interned.Clear()
+}
@@ -0,0 +1,163 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Identification of the JSON Lines export format, written as the first line
+// of ExportJSON output. Bump jsonFormatVersion whenever jsonEntry changes in
+// a way consumers can observe (fields added, renamed or retyped); older
+// versions stay readable. Version 2 added wait, goroutine and
+// receiver.
+const (
+	jsonFormat        = "gotrace.entries"
+	jsonFormatVersion = 2
+)
+
+// jsonHeader is the first line of an ExportJSON stream.
+type jsonHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// jsonEntry is the wire form of an Entry. Args, returns and panic values are
+// pre-formatted strings since arbitrary values can't be reliably marshaled.
+type jsonEntry struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args,omitempty"`
+	Returns  []string `json:"returns,omitempty"`
+	Depth    int32    `json:"depth"`
+	StartNs  int64    `json:"start_ns"`
+	EndNs    int64    `json:"end_ns"`
+	Duration int64    `json:"duration_ns"`
+	GID      uint64   `json:"gid"`
+	Label    string   `json:"label,omitempty"`
+	Package  string   `json:"package,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Panicked bool     `json:"panicked,omitempty"`
+	PanicVal string   `json:"panic,omitempty"`
+	Wait     string   `json:"wait,omitempty"`
+	Lifetime bool     `json:"goroutine,omitempty"`
+	Receiver bool     `json:"receiver,omitempty"`
+}
+
+func toJSONEntry(e Entry) jsonEntry {
+	je := jsonEntry{
+		Name: e.Name, Depth: e.Depth,
+		StartNs: e.StartNs, EndNs: e.EndNs, Duration: e.Duration,
+		GID: e.GID, Label: e.GoroutineLabel, Package: e.Package, File: e.File, Line: e.Line,
+		Panicked: e.Panicked, Wait: e.WaitReason, Lifetime: e.Goroutine, Receiver: e.Receiver,
+	}
+	for _, a := range e.Args {
+		je.Args = append(je.Args, formatArgs([]any{a}))
+	}
+	for _, r := range e.Returns {
+		je.Returns = append(je.Returns, formatArgs([]any{r}))
+	}
+	if e.Panicked {
+		je.PanicVal = formatArgs([]any{e.PanicVal})
+	}
+	return je
+}
+
+// fromJSONEntry converts the wire form back into an Entry. Args, returns and
+// panic values come back as their formatted strings. Names, files, packages
+// and labels are interned, since decoding allocates them for every line.
+func fromJSONEntry(je jsonEntry) Entry {
+	e := Entry{
+		Name: intern(je.Name), Depth: je.Depth,
+		StartNs: je.StartNs, EndNs: je.EndNs, Duration: je.Duration,
+		GID: je.GID, GoroutineLabel: intern(je.Label), Package: intern(je.Package), File: intern(je.File), Line: je.Line,
+		Panicked: je.Panicked, WaitReason: intern(je.Wait), Goroutine: je.Lifetime, Receiver: je.Receiver,
+	}
+	for _, a := range je.Args {
+		e.Args = append(e.Args, a)
+	}
+	for _, r := range je.Returns {
+		e.Returns = append(e.Returns, r)
+	}
+	if je.Panicked {
+		e.PanicVal = je.PanicVal
+	}
+	return e
+}
+
+// jsonFile, when set, receives an ExportJSON export from PrintSummary
+// (SetJSONFile).
+var jsonFile atomic.Pointer[string]
+
+func init() {
+	if path := os.Getenv("GOTRACE_JSON_FILE"); path != "" {
+		SetJSONFile(path)
+	}
+}
+
+// SetJSONFile makes PrintSummary also save the collected traces to path with
+// ExportJSON, e.g. as a baseline to compare later runs against. An empty
+// path turns the export off again.
+func SetJSONFile(path string) {
+	jsonFile.Store(&path)
+}
+
+// ExportJSON writes all collected traces to w as JSON Lines: a header line
+// {"format":"gotrace.entries","version":N} followed by one entry per line.
+func ExportJSON(w io.Writer) error {
+	return writeJSONEntries(w, GetTraces())
+}
+
+// writeJSONEntries writes entries in the ExportJSON format.
+func writeJSONEntries(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(jsonHeader{Format: jsonFormat, Version: jsonFormatVersion}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := enc.Encode(toJSONEntry(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSON parses JSON Lines produced by ExportJSON back into entries.
+// The header line is optional so collector streams can be read too, but a
+// header with an unknown format or a newer version is rejected. Blank lines
+// are ignored. Args, returns and panic values are restored as the strings
+// they were exported as.
+func ImportJSON(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	first := true
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		if first {
+			first = false
+			var h jsonHeader
+			if err := json.Unmarshal(sc.Bytes(), &h); err == nil && h.Format != "" {
+				if h.Format != jsonFormat || h.Version > jsonFormatVersion {
+					return nil, fmt.Errorf("unsupported export format %q version %d (want %q version <= %d)",
+						h.Format, h.Version, jsonFormat, jsonFormatVersion)
+				}
+				continue
+			}
+		}
+		var je jsonEntry
+		if err := json.Unmarshal(sc.Bytes(), &je); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, fromJSONEntry(je))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,25 @@
+package trace
+
+import (
+	"slices"
+	"strings"
+)
+
+// profLabel is a single pprof label key/value pair.
+type profLabel struct {
+	key, value string
+}
+
+// goroutineLabel returns the pprof labels of the current goroutine formatted
+// as "k=v,k2=v2", or "g<id>" when the goroutine carries no labels.
+func goroutineLabel(gid uint64) string {
+	if labels := profLabels(); len(labels) > 0 {
+		parts := make([]string, len(labels))
+		for i, l := range labels {
+			parts[i] = l.key + "=" + l.value
+		}
+		slices.Sort(parts)
+		return intern(strings.Join(parts, ","))
+	}
+	return gidLabel(gid)
+}
@@ -0,0 +1,12 @@
+//go:build portable || go1.28
+
+package trace
+
+// profLabelsSupported reports whether goroutine pprof labels can be read.
+const profLabelsSupported = false
+
+// profLabels is unavailable without linkname, or on toolchains whose label
+// layout hasn't been checked; goroutines are then labeled by ID.
+func profLabels() []profLabel {
+	return nil
+}
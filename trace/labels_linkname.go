@@ -0,0 +1,28 @@
+//go:build !portable && !go1.28
+
+package trace
+
+import "unsafe"
+
+// profLabelsSupported reports whether goroutine pprof labels can be read.
+// The mirrored layout below is checked against each toolchain it is built
+// for, so a new Go release falls back to ID labels until it is checked too.
+const profLabelsSupported = true
+
+//go:linkname runtime_getProfLabel runtime/pprof.runtime_getProfLabel
+func runtime_getProfLabel() unsafe.Pointer
+
+// profLabelSet mirrors the layout of runtime/pprof's label map: a struct
+// holding a slice of key/value string pairs. It matches Go 1.22 to 1.27.
+type profLabelSet struct {
+	list []profLabel
+}
+
+// profLabels returns the pprof labels attached to the current goroutine.
+func profLabels() []profLabel {
+	p := runtime_getProfLabel()
+	if p == nil {
+		return nil
+	}
+	return (*profLabelSet)(p).list
+}
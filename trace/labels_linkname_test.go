@@ -0,0 +1,43 @@
+//go:build !portable && !go1.28
+
+package trace
+
+import (
+	"context"
+	"reflect"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// TestTraceDebug_ProfLabelLayout fails when runtime/pprof's label layout
+// drifts from the profLabelSet mirror, so a toolchain is only added to the
+// labels_linkname.go build tag once it passes.
+func TestTraceDebug_ProfLabelLayout(t *testing.T) {
+	set := reflect.TypeOf(pprof.LabelSet{})
+	if set.NumField() != 1 || set.Field(0).Type.Kind() != reflect.Slice ||
+		set.Size() != unsafe.Sizeof(profLabelSet{}) {
+		t.Fatalf("pprof.LabelSet no longer holds a single label slice: %v", set)
+	}
+	label := set.Field(0).Type.Elem()
+	if label.NumField() != 2 || label.Size() != unsafe.Sizeof(profLabel{}) ||
+		label.Field(0).Type.Kind() != reflect.String || label.Field(1).Type.Kind() != reflect.String {
+		t.Fatalf("pprof labels are no longer key/value string pairs: %v", label)
+	}
+
+	pprof.Do(context.Background(), pprof.Labels("b", "2", "a", "1", "c", "3"), func(ctx context.Context) {
+		var want []profLabel
+		pprof.ForLabels(ctx, func(key, value string) bool {
+			want = append(want, profLabel{key, value})
+			return true
+		})
+		got := slices.Clone(profLabels())
+		slices.SortFunc(want, func(x, y profLabel) int { return strings.Compare(x.key, y.key) })
+		slices.SortFunc(got, func(x, y profLabel) int { return strings.Compare(x.key, y.key) })
+		if !slices.Equal(got, want) {
+			t.Fatalf("expected the goroutine labels %v, read %v", want, got)
+		}
+	})
+}
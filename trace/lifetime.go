@@ -0,0 +1,112 @@
+package trace
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// openGoroutines holds the spans of Goroutine calls whose goroutine hasn't
+// finished yet.
+var openGoroutines sync.Map // *span -> struct{}
+
+// Goroutine times a goroutine from start to finish. Use with defer as the
+// first statement of the goroutine's function:
+//
+//	go func() {
+//		defer trace.Goroutine("worker")()
+//		...
+//	}()
+//
+// It is recorded like a Region, with Entry.Goroutine set, and the summary
+// lists goroutine lifetimes, including the goroutines still running, which
+// points at leaks. gotrace --goroutines inserts it for go statements.
+func Goroutine(name string) func() {
+	s := startSpan(name, nil)
+	if s != nil {
+		s.lifetime = true
+		openGoroutines.Store(s, struct{}{})
+	}
+	return func() {
+		if s != nil {
+			openGoroutines.Delete(s)
+		}
+		s.finish(nil, recover())
+	}
+}
+
+// writeLifetimeSummary appends the lifetimes of the goroutines timed with
+// Goroutine, and how many are still running. Callers must hold mu.
+func writeLifetimeSummary(sb *strings.Builder) {
+	byName := make(map[string]*funcStat)
+	for _, e := range traces {
+		if !e.Goroutine {
+			continue
+		}
+		s, ok := byName[e.Name]
+		if !ok {
+			s = &funcStat{name: e.Name}
+			byName[e.Name] = s
+		}
+		s.count++
+		s.total += e.Duration
+		s.max = max(s.max, e.Duration)
+	}
+	running := make(map[string]int)
+	var oldest int64
+	openGoroutines.Range(func(key, _ any) bool {
+		s := key.(*span)
+		running[s.name]++
+		if oldest == 0 || s.start < oldest {
+			oldest = s.start
+		}
+		return true
+	})
+	if len(byName) == 0 && len(running) == 0 {
+		return
+	}
+
+	stats := make([]funcStat, 0, len(byName))
+	for _, s := range byName {
+		stats = append(stats, *s)
+	}
+	slices.SortFunc(stats, func(a, b funcStat) int {
+		return cmp.Or(cmp.Compare(b.max, a.max), cmp.Compare(a.name, b.name))
+	})
+	sb.WriteString("\n" + headerStyle.Render("🧵 Goroutine Lifetimes") + "\n")
+	sb.WriteString(summaryRule())
+	for _, s := range stats[:min(len(stats), 10)] {
+		avg := s.total / int64(s.count)
+		sb.WriteString(fmt.Sprintf("  %s %s %s avg %s max",
+			funcStyle.Render(nameColumn(s.name)),
+			argsStyle.Render(fmt.Sprintf("%8d", s.count)),
+			colorDuration(avg), colorDuration(s.max)))
+		if n := running[s.name]; n > 0 {
+			sb.WriteString(hotStyle.Render(fmt.Sprintf("   %d still running", n)))
+		}
+		sb.WriteString("\n")
+	}
+	var onlyRunning []string
+	total := 0
+	for name, n := range running {
+		total += n
+		if byName[name] == nil {
+			onlyRunning = append(onlyRunning, name)
+		}
+	}
+	slices.Sort(onlyRunning)
+	for _, name := range onlyRunning[:min(len(onlyRunning), 10)] {
+		sb.WriteString(fmt.Sprintf("  %s %s\n", funcStyle.Render(nameColumn(name)),
+			hotStyle.Render(fmt.Sprintf("%8d still running", running[name]))))
+	}
+	if total > 0 {
+		sb.WriteString(warmStyle.Render(fmt.Sprintf("  ⚠️  %d goroutine(s) still running, the oldest for %s", total, formatDuration(clock()-oldest))) + "\n")
+	}
+}
+
+// resetLifetimes forgets the goroutines still running.
+func resetLifetimes() {
+	openGoroutines.Clear()
+}
@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	maxCallsPerFunc atomic.Int64
+	callCounts      sync.Map // name -> *atomic.Int64
+)
+
+// SetMaxCallsPerFunc traces only the first n calls of each function name:
+// later calls are neither printed nor recorded, which keeps loops from
+// drowning out the structure of a run. They are still counted, and the
+// summary lists how many calls each function had past the limit. Zero (the
+// default) traces every call.
+func SetMaxCallsPerFunc(n int) {
+	maxCallsPerFunc.Store(int64(n))
+}
+
+// overCallLimit counts a call of name and reports whether it is past the
+// SetMaxCallsPerFunc limit.
+func overCallLimit(name string) bool {
+	limit := maxCallsPerFunc.Load()
+	if limit <= 0 {
+		return false
+	}
+	v, ok := callCounts.Load(name)
+	if !ok {
+		v, _ = callCounts.LoadOrStore(name, new(atomic.Int64))
+	}
+	return v.(*atomic.Int64).Add(1) > limit
+}
+
+// writeCallLimitSummary appends a line naming the functions with calls
+// past the SetMaxCallsPerFunc limit, most first.
+func writeCallLimitSummary(sb *strings.Builder) {
+	limit := maxCallsPerFunc.Load()
+	if limit <= 0 {
+		return
+	}
+	type skipped struct {
+		name  string
+		calls int64
+	}
+	var funcs []skipped
+	var total int64
+	callCounts.Range(func(key, value any) bool {
+		if n := value.(*atomic.Int64).Load() - limit; n > 0 {
+			funcs = append(funcs, skipped{key.(string), n})
+			total += n
+		}
+		return true
+	})
+	if total == 0 {
+		return
+	}
+	slices.SortFunc(funcs, func(a, b skipped) int {
+		return cmp.Or(cmp.Compare(b.calls, a.calls), cmp.Compare(a.name, b.name))
+	})
+	parts := make([]string, 0, min(len(funcs), 5))
+	for _, f := range funcs[:min(len(funcs), 5)] {
+		parts = append(parts, fmt.Sprintf("%s (%d)", f.name, f.calls))
+	}
+	if len(funcs) > 5 {
+		parts = append(parts, "...")
+	}
+	sb.WriteString(fileStyle.Render(fmt.Sprintf("  ✂️  %d calls past the first %d per function not traced: %s",
+		total, limit, strings.Join(parts, ", "))) + "\n")
+}
+
+// resetCallCounts drops the per-function call counts.
+func resetCallCounts() {
+	callCounts.Clear()
+}
@@ -0,0 +1,157 @@
+package trace
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemSample is a single heap measurement taken by the memory sampler.
+type MemSample struct {
+	TimeNs    int64  // Sample time in nanoseconds (same clock as Entry.StartNs)
+	HeapAlloc uint64 // Bytes of allocated heap objects
+}
+
+var (
+	memMu      sync.Mutex
+	memSamples []MemSample
+)
+
+func init() {
+	if v := os.Getenv("GOTRACE_PROFILE_MEM"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			fmt.Fprintf(os.Stderr, "gotrace: invalid GOTRACE_PROFILE_MEM %q\n", v)
+			return
+		}
+		StartMemProfile(interval)
+	}
+}
+
+// StartMemProfile samples runtime.MemStats.HeapAlloc every interval in a
+// background goroutine until the returned stop function is called.
+// Samples are correlated with traced calls by time in PrintSummary.
+func StartMemProfile(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	sampleMem()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sampleMem()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+			sampleMem()
+		})
+	}
+}
+
+func sampleMem() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	sample := MemSample{TimeNs: clock(), HeapAlloc: ms.HeapAlloc}
+	memMu.Lock()
+	memSamples = append(memSamples, sample)
+	memMu.Unlock()
+}
+
+// GetMemSamples returns a copy of all heap samples collected so far.
+func GetMemSamples() []MemSample {
+	memMu.Lock()
+	defer memMu.Unlock()
+	return slices.Clone(memSamples)
+}
+
+// nearestSample returns the sample closest in time to ns. samples must be
+// sorted by time and non-empty.
+func nearestSample(samples []MemSample, ns int64) MemSample {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].TimeNs >= ns })
+	if i == len(samples) {
+		return samples[i-1]
+	}
+	if i > 0 && ns-samples[i-1].TimeNs < samples[i].TimeNs-ns {
+		return samples[i-1]
+	}
+	return samples[i]
+}
+
+// writeMemSummary appends the heap growth section to sb. Callers must hold mu.
+func writeMemSummary(sb *strings.Builder) {
+	samples := GetMemSamples()
+	if len(samples) == 0 {
+		return
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	peak := first.HeapAlloc
+	for _, s := range samples {
+		peak = max(peak, s.HeapAlloc)
+	}
+
+	sb.WriteString("\n" + headerStyle.Render("💾 Memory") + "\n")
+	sb.WriteString(summaryRule())
+	fmt.Fprintf(sb, "  Heap: %s → %s (peak %s, %s) over %d samples\n",
+		formatBytes(int64(first.HeapAlloc)), formatBytes(int64(last.HeapAlloc)),
+		formatBytes(int64(peak)), formatByteDelta(int64(last.HeapAlloc)-int64(first.HeapAlloc)),
+		len(samples))
+
+	// Attribute heap growth to functions by the samples nearest their start and end
+	growth := make(map[string]int64)
+	for _, e := range traces {
+		delta := int64(nearestSample(samples, e.EndNs).HeapAlloc) - int64(nearestSample(samples, e.StartNs).HeapAlloc)
+		growth[e.Name] += delta
+	}
+	type memStat struct {
+		name  string
+		delta int64
+	}
+	var stats []memStat
+	for name, delta := range growth {
+		if delta > 0 {
+			stats = append(stats, memStat{name, delta})
+		}
+	}
+	slices.SortFunc(stats, func(a, b memStat) int {
+		return cmp.Compare(b.delta, a.delta) // Descending order
+	})
+	for _, s := range stats[:min(len(stats), 5)] {
+		fmt.Fprintf(sb, "  %s %s\n",
+			funcStyle.Render(nameColumn(s.name)),
+			warmStyle.Render(fmt.Sprintf("%12s", formatByteDelta(s.delta))))
+	}
+}
+
+func formatBytes(b int64) string {
+	switch {
+	case b < 1<<10:
+		return fmt.Sprintf("%dB", b)
+	case b < 1<<20:
+		return fmt.Sprintf("%.2fKB", float64(b)/(1<<10))
+	case b < 1<<30:
+		return fmt.Sprintf("%.2fMB", float64(b)/(1<<20))
+	default:
+		return fmt.Sprintf("%.2fGB", float64(b)/(1<<30))
+	}
+}
+
+func formatByteDelta(b int64) string {
+	if b < 0 {
+		return "-" + formatBytes(-b)
+	}
+	return "+" + formatBytes(b)
+}
@@ -0,0 +1,45 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+)
+
+// MergeRuns reads ExportJSON streams from several runs, e.g. the shards of
+// a load test, and returns their entries concatenated in order. Goroutine
+// IDs of each run are offset past those of the runs before it, since IDs
+// from different processes never name the same goroutine; default "g<id>"
+// labels follow. Add the result with AddEntries for a combined summary,
+// or concatenate ImportJSON results instead to keep the recorded IDs.
+func MergeRuns(readers ...io.Reader) ([]Entry, error) {
+	var merged []Entry
+	var offset uint64
+	for i, r := range readers {
+		entries, err := ImportJSON(r)
+		if err != nil {
+			return nil, fmt.Errorf("run %d: %w", i+1, err)
+		}
+		var maxGID uint64
+		for _, e := range entries {
+			maxGID = max(maxGID, e.GID)
+			if offset > 0 {
+				if e.GoroutineLabel == gidLabel(e.GID) {
+					e.GoroutineLabel = intern(gidLabel(e.GID + offset))
+				}
+				e.GID += offset
+			}
+			merged = append(merged, e)
+		}
+		offset += maxGID
+	}
+	return merged, nil
+}
+
+// AddEntries adds saved entries (e.g. from ImportJSON or MergeRuns) to the
+// trace set without printing them, so PrintSummary and PrintFunctionStats
+// report on them. Use Replay to also render them as live output.
+func AddEntries(entries []Entry) {
+	mu.Lock()
+	traces = append(traces, entries...)
+	mu.Unlock()
+}
@@ -0,0 +1,57 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Writers for trace output (SetOutput) and for panic dumps and failure
+// reports (SetErrorOutput). Nil means os.Stdout and os.Stderr, looked up on
+// every write. outMu serializes the writes, so lines from concurrent calls
+// never interleave.
+var (
+	outMu     sync.Mutex
+	output    io.Writer
+	errOutput io.Writer
+)
+
+// SetOutput sends live trace lines and the summaries to w instead of
+// stdout, e.g. a file or a test buffer. Nil restores stdout.
+func SetOutput(w io.Writer) {
+	outMu.Lock()
+	output = w
+	outMu.Unlock()
+}
+
+// SetErrorOutput sends the TraceOnPanic panic dump, PrintPanicStacks and
+// the SetExitOnSlow and SetFailOnHot reports to w instead of stderr. Nil
+// restores stderr.
+func SetErrorOutput(w io.Writer) {
+	outMu.Lock()
+	errOutput = w
+	outMu.Unlock()
+}
+
+// printOut formats to the SetOutput writer.
+func printOut(format string, args ...any) {
+	outMu.Lock()
+	defer outMu.Unlock()
+	w := output
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, format, args...)
+}
+
+// printErr formats to the SetErrorOutput writer.
+func printErr(format string, args ...any) {
+	outMu.Lock()
+	defer outMu.Unlock()
+	w := errOutput
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, format, args...)
+}
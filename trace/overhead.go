@@ -0,0 +1,27 @@
+package trace
+
+// calibrating is set only while init measures the tracing overhead; Trace
+// then skips printing and recording. It is never written after init.
+var calibrating bool
+
+// overheadNs is the estimated cost of one Trace/closure pair in nanoseconds,
+// excluding live output.
+var overheadNs int64
+
+func init() {
+	calibrateOverhead()
+}
+
+// calibrateOverhead times empty traced calls to estimate per-call overhead.
+func calibrateOverhead() {
+	const iterations = 200
+
+	calibrating = true
+	start := nanotime()
+	for range iterations {
+		Trace("gotrace.calibrate")()
+	}
+	overheadNs = max(0, (nanotime()-start)/iterations)
+	calibrating = false
+	firstTraceNs.Store(0)
+}
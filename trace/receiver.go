@@ -0,0 +1,58 @@
+package trace
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+)
+
+// groupByReceiver splits the summary's per-function rows by receiver
+// (SetGroupByReceiver).
+var groupByReceiver atomic.Bool
+
+func init() {
+	groupByReceiver.Store(os.Getenv("GOTRACE_GROUP_RECEIVER") == "1")
+}
+
+// Method logs a method's entry/exit like Trace, passing its receiver ahead
+// of the arguments so the entry records it as Args[0]. Use with defer:
+//
+//	defer trace.Method("Calculator.Add", c, x)()
+func Method(name string, recv any, args ...any) func(...any) {
+	s := startSpan(name, append([]any{recv}, args...))
+	if s != nil {
+		s.receiver = true
+	}
+	return func(returns ...any) {
+		s.finish(returns, recover())
+	}
+}
+
+// SetGroupByReceiver makes the summary count method calls per receiver, so
+// each instance gets its own row: "Calculator.Add@0xc000012080". It needs
+// entries recorded with Method, as --capture-receiver instruments them.
+// Pointer receivers are told apart by address, which stays the same however
+// the value changes; value receivers by their formatted value. Functions
+// recorded by SetAggregateOnly or SetKeepSlowestOnly keep no arguments and
+// stay in one row.
+func SetGroupByReceiver(enabled bool) {
+	groupByReceiver.Store(enabled)
+}
+
+// statName returns the name e is counted under in the summary.
+func statName(e Entry) string {
+	if !groupByReceiver.Load() || !e.Receiver || len(e.Args) == 0 {
+		return e.Name
+	}
+	return e.Name + "@" + receiverKey(e.Args[0])
+}
+
+// receiverKey formats a receiver so every call on the same instance gets the
+// same key.
+func receiverKey(recv any) string {
+	if v := reflect.ValueOf(recv); v.Kind() == reflect.Pointer && !v.IsNil() {
+		return fmt.Sprintf("%p", recv)
+	}
+	return formatArgs([]any{recv})
+}
@@ -0,0 +1,55 @@
+package trace
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// collapseRecursion hides the live lines of direct recursion
+// (SetCollapseRecursion).
+var collapseRecursion atomic.Bool
+
+// SetCollapseRecursion collapses the live output of a function that calls
+// itself directly: the outermost call keeps its entry and exit lines, and
+// everything below it is replaced by one "name (recursion depth N)" line
+// printed when it exits. Every call is still recorded for the summary.
+func SetCollapseRecursion(enabled bool) {
+	collapseRecursion.Store(enabled)
+	updateStackTracking()
+}
+
+// collapseSpan marks s as hidden if it runs inside a collapsed recursion:
+// a direct recursive call of its parent, or a call made below one.
+func collapseSpan(s *span) {
+	if !collapseRecursion.Load() {
+		return
+	}
+	parent := innermostSpan(s.gid)
+	if parent == nil {
+		return
+	}
+	switch {
+	case parent.recRoot != nil:
+		s.recRoot, s.recLevel = parent.recRoot, parent.recLevel
+	case parent.name == s.name:
+		s.recRoot, s.recLevel = parent, 1
+	default:
+		return
+	}
+	if s.name == s.recRoot.name {
+		s.recLevel++
+		s.recRoot.recDepth = max(s.recRoot.recDepth, s.recLevel)
+	}
+}
+
+// printRecursion prints the line standing in for the collapsed recursion
+// below s.
+func printRecursion(s *span) {
+	indent := indentFor(s.d + 1)
+	depth := fmt.Sprintf("(recursion depth %d)", s.recDepth)
+	if colorize.Load() {
+		printLine("%s%s %s %s", indent, exitStyle.Render("↻"), funcStyle.Render(s.name), argsStyle.Render(depth))
+	} else {
+		printLine("%s↻ %s %s", indent, s.name, depth)
+	}
+}
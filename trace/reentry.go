@@ -0,0 +1,25 @@
+package trace
+
+import "sync"
+
+// printing holds the goroutines currently inside the trace package's own
+// output path (formatting arguments, printing, streaming to a collector).
+// Traced calls made from there, such as an instrumented String method of an
+// argument, are not traced again: tracing them would format the same
+// arguments and recurse until the stack overflows.
+var printing sync.Map // uint64 -> struct{}
+
+// isPrinting reports whether goroutine gid is inside trace output.
+func isPrinting(gid uint64) bool {
+	_, ok := printing.Load(gid)
+	return ok
+}
+
+// beginPrinting marks gid as inside trace output until endPrinting.
+func beginPrinting(gid uint64) {
+	printing.Store(gid, struct{}{})
+}
+
+func endPrinting(gid uint64) {
+	printing.Delete(gid)
+}
@@ -0,0 +1,86 @@
+package trace
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// replayEvent is the entry or exit of one replayed call.
+type replayEvent struct {
+	ns    int64
+	exit  bool
+	index int // Position of the entry in the replayed slice, for stable ties
+	e     *Entry
+}
+
+// Replay re-renders saved entries (e.g. from ImportJSON) as live output,
+// printing each call's entry and exit line in the order they happened, and
+// then adds the entries to the trace set so PrintSummary reports on them.
+// speed scales the recorded timing: 1 replays in real time, 2 twice as fast,
+// and zero or less prints everything without delay.
+func Replay(entries []Entry, speed float64) {
+	events := make([]replayEvent, 0, 2*len(entries))
+	for i := range entries {
+		e := &entries[i]
+		events = append(events,
+			replayEvent{ns: e.StartNs, index: i, e: e},
+			replayEvent{ns: e.EndNs, exit: true, index: i, e: e})
+	}
+	slices.SortFunc(events, compareReplayEvents)
+
+	if len(events) > 0 {
+		firstTraceNs.CompareAndSwap(0, events[0].ns)
+	}
+	var last int64
+	for i, ev := range events {
+		if speed > 0 && i > 0 && ev.ns > last {
+			time.Sleep(time.Duration(float64(ev.ns-last) / speed))
+		}
+		last = ev.ns
+
+		e := ev.e
+		indent := indentFor(max(e.Depth, 1))
+		switch {
+		case !ev.exit:
+			printEntry(indent, e.Name, e.Args, e.File, e.Line, e.GoroutineLabel, e.StartNs)
+		case e.Panicked:
+			printPanic(indent, e.Name, e.Duration, e.PanicVal)
+		default:
+			printExit(indent, e.Name, e.Duration, e.Returns)
+		}
+	}
+
+	AddEntries(entries)
+}
+
+// compareReplayEvents orders events by time. At the same instant, calls
+// that already ran exit first (inner before outer), then calls start (outer
+// before inner), then zero-length calls started at that instant exit.
+func compareReplayEvents(a, b replayEvent) int {
+	return cmp.Or(
+		cmp.Compare(a.ns, b.ns),
+		cmp.Compare(a.phase(), b.phase()),
+		cmp.Compare(a.depthKey(), b.depthKey()),
+		cmp.Compare(a.index, b.index),
+	)
+}
+
+func (ev replayEvent) phase() int {
+	switch {
+	case !ev.exit:
+		return 1
+	case ev.e.EndNs == ev.e.StartNs:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// depthKey sorts entries outer-first and exits inner-first.
+func (ev replayEvent) depthKey() int32 {
+	if ev.exit {
+		return -ev.e.Depth
+	}
+	return ev.e.Depth
+}
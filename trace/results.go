@@ -0,0 +1,38 @@
+package trace
+
+import "reflect"
+
+// namedResults holds pointers to a traced function's named results (Results).
+type namedResults []any
+
+// Results captures named results by pointer for the func returned by Trace,
+// which reads them when the deferred call runs. By then every return path,
+// bare or with values, has assigned their final values:
+//
+//	func f() (n int, err error) {
+//		defer trace.Trace("f")(trace.Results(&n, &err))
+//		n = 2
+//		return
+//	}
+func Results(ptrs ...any) any {
+	return namedResults(ptrs)
+}
+
+// resolveResults replaces a Results value with the values its pointers
+// currently point to. Other returns are passed through unchanged.
+func resolveResults(returns []any) []any {
+	if len(returns) != 1 {
+		return returns
+	}
+	ptrs, ok := returns[0].(namedResults)
+	if !ok {
+		return returns
+	}
+	values := make([]any, len(ptrs))
+	for i, p := range ptrs {
+		if v := reflect.ValueOf(p); v.Kind() == reflect.Pointer && !v.IsNil() {
+			values[i] = v.Elem().Interface()
+		}
+	}
+	return values
+}
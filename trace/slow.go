@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	slowLimitNs atomic.Int64 // 0 disables the check
+	panicOnSlow atomic.Bool
+	failOnHot   atomic.Bool
+	exitFunc    = os.Exit // Replaced in tests
+)
+
+func init() {
+	failOnHot.Store(os.Getenv("GOTRACE_FAIL_ON_HOT") == "1")
+}
+
+// SlowCallError describes a call that exceeded the SetExitOnSlow limit.
+// It is the panic value when SetPanicOnSlow is enabled.
+type SlowCallError struct {
+	Entry Entry
+	Limit time.Duration
+}
+
+func (e *SlowCallError) Error() string {
+	return fmt.Sprintf("%s took %s, exceeding limit of %s [%s:%d]",
+		e.Entry.Name, formatDuration(e.Entry.Duration), formatDuration(int64(e.Limit)), e.Entry.File, e.Entry.Line)
+}
+
+// SetExitOnSlow makes the program fail fast when any traced call takes
+// longer than limit: the offending call is printed to stderr and the process
+// exits with status 3 (or panics, see SetPanicOnSlow). Zero disables the check.
+func SetExitOnSlow(limit time.Duration) {
+	slowLimitNs.Store(int64(limit))
+}
+
+// SetPanicOnSlow makes a SetExitOnSlow violation panic with a *SlowCallError
+// instead of exiting, so tests can recover it.
+func SetPanicOnSlow(enabled bool) {
+	panicOnSlow.Store(enabled)
+}
+
+// checkSlow enforces the SetExitOnSlow limit for a finished call.
+func checkSlow(e Entry) {
+	limit := slowLimitNs.Load()
+	if limit <= 0 || e.Duration <= limit {
+		return
+	}
+	err := &SlowCallError{Entry: e, Limit: time.Duration(limit)}
+	if panicOnSlow.Load() {
+		panic(err)
+	}
+	printErr("\n%s %s\n", panicStyle.Render("⏱ SLOW CALL"), err.Error())
+	exitFunc(3)
+}
+
+// SetFailOnHot makes PrintSummary fail the program when any recorded call
+// reached the hot threshold (see SetThresholds): after the summary, the
+// offending functions are printed to stderr and the process exits with
+// status 4. Use it as a latency gate in CI.
+func SetFailOnHot(enabled bool) {
+	failOnHot.Store(enabled)
+}
+
+// checkHot enforces SetFailOnHot once the summary has been printed.
+func checkHot() {
+	if !failOnHot.Load() {
+		return
+	}
+	hot := GetHotPaths()
+	if len(hot) == 0 {
+		return
+	}
+	slowest := make(map[string]Entry)
+	var names []string
+	for _, e := range hot {
+		s, ok := slowest[e.Name]
+		if !ok {
+			names = append(names, e.Name)
+		}
+		if !ok || e.Duration > s.Duration {
+			slowest[e.Name] = e
+		}
+	}
+	printErr("\n%s %d calls in %d functions reached the hot threshold of %s:\n",
+		panicStyle.Render("🔥 FAIL ON HOT"), len(hot), len(names), formatDuration(hotThresholdNs.Load()))
+	for _, name := range names {
+		e := slowest[name]
+		printErr("  %s %s [%s:%d]\n", name, formatDuration(e.Duration), e.File, e.Line)
+	}
+	exitFunc(4)
+}
@@ -0,0 +1,221 @@
+package trace
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// callStacks holds each goroutine's open Trace and Region calls, innermost
+// last. Stacks are only kept while a feature reading them is on (see
+// updateStackTracking), and an emptied stack stays in place for the next
+// top-level call until sweepStacks removes it.
+var callStacks sync.Map // uint64 -> *callStack
+
+var (
+	// trackStacks is set while error paths, recursion collapsing or wait
+	// reason capture need the open calls of each goroutine
+	trackStacks atomic.Bool
+	// errorPaths is set by SetErrorPaths or the first WrapError call
+	errorPaths atomic.Bool
+	// newStacks counts the stacks created, to sweep empty ones now and then
+	newStacks atomic.Uint64
+)
+
+// sweepEvery is how many new stacks are created between sweeps of the
+// empty ones left by finished goroutines.
+const sweepEvery = 1024
+
+// callStack is one goroutine's open calls. It is locked because a Watch can
+// be stopped from another goroutine and the wait sampler reads every stack.
+type callStack struct {
+	mu    sync.Mutex
+	spans []*span
+	dead  bool // Swept from callStacks; pushSpan must fetch a new stack
+}
+
+// SetErrorPaths makes Trace and Region keep each goroutine's open calls so
+// WrapError can prefix errors with them. The first WrapError call turns it
+// on as well, but calls already open then are missing from the paths.
+func SetErrorPaths(enabled bool) {
+	errorPaths.Store(enabled)
+	updateStackTracking()
+}
+
+// updateStackTracking turns the per-goroutine stacks on while a feature
+// needs them, so traced calls skip their bookkeeping otherwise.
+func updateStackTracking() {
+	trackStacks.Store(errorPaths.Load() || collapseRecursion.Load() || waitCapture.Load())
+}
+
+// pushSpan records s as the innermost open call of its goroutine.
+func pushSpan(s *span) {
+	if !trackStacks.Load() {
+		return
+	}
+	for {
+		v, ok := callStacks.Load(s.gid)
+		if !ok {
+			if newStacks.Add(1)%sweepEvery == 0 {
+				sweepStacks()
+			}
+			v, _ = callStacks.LoadOrStore(s.gid, &callStack{})
+		}
+		stack := v.(*callStack)
+		stack.mu.Lock()
+		if !stack.dead {
+			stack.spans = append(stack.spans, s)
+			stack.mu.Unlock()
+			s.stack = stack
+			return
+		}
+		stack.mu.Unlock()
+	}
+}
+
+// popSpan removes s, and anything opened after it, from its goroutine's
+// stack. A Stopwatch span only removes itself, since it may be stopped out
+// of order or from another goroutine.
+func popSpan(s *span) {
+	stack := s.stack
+	if stack == nil {
+		return
+	}
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	for i := len(stack.spans) - 1; i >= 0; i-- {
+		if stack.spans[i] != s {
+			continue
+		}
+		end := i + 1
+		if !s.detached {
+			end = len(stack.spans)
+		}
+		n := copy(stack.spans[i:], stack.spans[end:])
+		clear(stack.spans[i+n:])
+		stack.spans = stack.spans[:i+n]
+		return
+	}
+}
+
+// sweepStacks drops the empty stacks of goroutines with no open calls.
+func sweepStacks() {
+	callStacks.Range(func(gid, v any) bool {
+		stack := v.(*callStack)
+		stack.mu.Lock()
+		if len(stack.spans) == 0 {
+			stack.dead = true
+			callStacks.CompareAndDelete(gid, stack)
+		}
+		stack.mu.Unlock()
+		return true
+	})
+}
+
+// openSpans returns a copy of the open calls of goroutine gid, outermost
+// first.
+func openSpans(gid uint64) []*span {
+	v, ok := callStacks.Load(gid)
+	if !ok {
+		return nil
+	}
+	stack := v.(*callStack)
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	return append([]*span(nil), stack.spans...)
+}
+
+// innermostSpan returns the innermost open call of goroutine gid, or nil.
+func innermostSpan(gid uint64) *span {
+	v, ok := callStacks.Load(gid)
+	if !ok {
+		return nil
+	}
+	stack := v.(*callStack)
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	if len(stack.spans) == 0 {
+		return nil
+	}
+	return stack.spans[len(stack.spans)-1]
+}
+
+// outermostSpan returns the outermost open call of goroutine gid, or nil.
+func outermostSpan(gid uint64) *span {
+	v, ok := callStacks.Load(gid)
+	if !ok {
+		return nil
+	}
+	stack := v.(*callStack)
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	if len(stack.spans) == 0 {
+		return nil
+	}
+	return stack.spans[0]
+}
+
+// callPath returns the names of the current goroutine's open calls,
+// outermost first, from Trace/Region or else from TraceOnPanic.
+func callPath() []string {
+	gid := getGID()
+	if stack := openSpans(gid); len(stack) > 0 {
+		names := make([]string, len(stack))
+		for i, s := range stack {
+			names[i] = s.name
+		}
+		return names
+	}
+	panicMu.Lock()
+	defer panicMu.Unlock()
+	var names []string
+	for _, msg := range panicStacks[gid] {
+		// Buffered as "<indent>→ name(args) [file:line g1]"
+		_, rest, _ := strings.Cut(msg, "→ ")
+		name, _, _ := strings.Cut(rest, "(")
+		names = append(names, name)
+	}
+	return names
+}
+
+// TracedError is an error annotated with the traced call path it was
+// wrapped in (WrapError).
+type TracedError struct {
+	Path []string // Open traced calls, outermost first
+	Err  error
+}
+
+func (e *TracedError) Error() string {
+	return strings.Join(e.Path, " → ") + ": " + e.Err.Error()
+}
+
+func (e *TracedError) Unwrap() error {
+	return e.Err
+}
+
+// WrapError prefixes err with the traced calls the current goroutine is in,
+// outermost first, so an error carries where it came from:
+//
+//	return trace.WrapError(err) // "main → handler.Serve → db.Query: timeout"
+//
+// It returns err unchanged when it is nil, when no traced call is open, or
+// when err was already wrapped. Open calls are only kept once SetErrorPaths
+// or a first WrapError call has turned them on.
+func WrapError(err error) error {
+	if !errorPaths.Load() {
+		SetErrorPaths(true)
+	}
+	if err == nil {
+		return nil
+	}
+	var traced *TracedError
+	if errors.As(err, &traced) {
+		return err
+	}
+	path := callPath()
+	if len(path) == 0 {
+		return err
+	}
+	return &TracedError{Path: path, Err: err}
+}
@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Theme recolors the output styles (SetTheme, LoadTheme). Colors are
+// lipgloss colors: hex ("#FF6B6B") or ANSI 256 numbers ("203"). Empty
+// fields keep the built-in color.
+type Theme struct {
+	Func   string `json:"func"`   // Function names
+	Args   string `json:"args"`   // Arguments and counts
+	File   string `json:"file"`   // Locations and rules
+	Fast   string `json:"fast"`   // Durations below the warn threshold
+	Warn   string `json:"warn"`   // Durations above the warn threshold
+	Hot    string `json:"hot"`    // Durations above the hot threshold
+	Enter  string `json:"enter"`  // Entry arrows
+	Exit   string `json:"exit"`   // Exit arrows
+	Panic  string `json:"panic"`  // Background of panic markers
+	Title  string `json:"title"`  // Summary title and its border
+	Header string `json:"header"` // Summary section headers
+}
+
+// defaultStyles holds the built-in styles SetTheme starts from.
+var defaultStyles = struct {
+	fn, args, file, fast, warm, hot, enter, exit, panic, title, header lipgloss.Style
+}{funcStyle, argsStyle, fileStyle, fastStyle, warmStyle, hotStyle, enterStyle, exitStyle, panicStyle, titleStyle, headerStyle}
+
+// SetTheme recolors live output and summaries. Fields left empty use the
+// built-in colors, so SetTheme(Theme{}) restores the defaults. Call it
+// before tracing starts; it is not safe to change while output is printed.
+func SetTheme(th Theme) {
+	d := defaultStyles
+	funcStyle = recolor(d.fn, th.Func)
+	argsStyle = recolor(d.args, th.Args)
+	fileStyle = recolor(d.file, th.File)
+	fastStyle = recolor(d.fast, th.Fast)
+	warmStyle = recolor(d.warm, th.Warn)
+	hotStyle = recolor(d.hot, th.Hot)
+	enterStyle = recolor(d.enter, th.Enter)
+	exitStyle = recolor(d.exit, th.Exit)
+	headerStyle = recolor(d.header, th.Header)
+	panicStyle = d.panic
+	if th.Panic != "" {
+		panicStyle = panicStyle.Background(lipgloss.Color(th.Panic))
+	}
+	titleStyle = recolor(d.title, th.Title)
+	if th.Title != "" {
+		titleStyle = titleStyle.BorderForeground(lipgloss.Color(th.Title))
+	}
+}
+
+// LoadTheme reads a Theme from a JSON file mapping style names to colors,
+// such as {"hot": "#FF0000", "func": "39"}, and applies it with SetTheme.
+// Unknown style names are rejected.
+func LoadTheme(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var th Theme
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&th); err != nil {
+		return fmt.Errorf("theme %s: %w", path, err)
+	}
+	SetTheme(th)
+	return nil
+}
+
+// recolor returns s with its foreground set to color, or s if color is empty.
+func recolor(s lipgloss.Style, color string) lipgloss.Style {
+	if color == "" {
+		return s
+	}
+	return s.Foreground(lipgloss.Color(color))
+}
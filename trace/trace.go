@@ -3,20 +3,27 @@ package trace
 import (
 	"cmp"
 	"fmt"
+	"io"
+	"maps"
 	"math"
 	"os"
+	"reflect"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	_ "unsafe"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
 )
 
-//go:linkname nanotime runtime.nanotime
-func nanotime() int64
+// gotraceRuntime marks this as gotrace's trace package. The instrumenter
+// leaves any package declaring it alone, whatever module path a fork or
+// vendored copy lives under.
+const gotraceRuntime = true
 
 // Styles using lipgloss
 var (
@@ -39,6 +46,60 @@ var (
 	hotThresholdNs  atomic.Int64 // Default: 10ms
 )
 
+// clock returns the current time in nanoseconds. Tests may replace it.
+var clock = nanotime
+
+// Relative time display (SetRelativeTime)
+var (
+	relativeTime atomic.Bool
+	firstTraceNs atomic.Int64 // Start of the first traced call, 0 until then
+)
+
+// argDepth limits how many levels argument formatting descends into
+// structs, slices, arrays and maps. Zero means no limit.
+var argDepth atomic.Int32
+
+// summaryFile, when set, receives PrintSummary's output (SetSummaryFile).
+var summaryFile atomic.Pointer[string]
+
+// flat replaces indentation with a depth prefix (SetFlat).
+var flat atomic.Bool
+
+// maxLineWidth truncates live output lines to this many display columns
+// (SetMaxLineWidth). Zero means no limit.
+var maxLineWidth atomic.Int32
+
+// summaryTopN, when positive, limits the summary to the N slowest calls
+// (SetSummaryTopN).
+var summaryTopN atomic.Int32
+
+// summaryMinCount hides functions called fewer times from the summary's
+// call frequency table (SetSummaryMinCount).
+var summaryMinCount atomic.Int32
+
+// summaryNameWidth is the width of the function name column of the summary
+// tables (SetSummaryWidth).
+var summaryNameWidth atomic.Int32
+
+// defaultSummaryNameWidth is the summary's name column width unless
+// SetSummaryWidth changes it.
+const defaultSummaryNameWidth = 28
+
+// maxLiveLines caps the number of live output lines (SetMaxLiveLines).
+// Zero means no limit. printedLines counts the lines printed so far.
+var (
+	maxLiveLines atomic.Int64
+	printedLines atomic.Int64
+)
+
+// timeUnit fixes the unit durations are printed in (SetTimeUnit).
+// Zero means auto-scale.
+var timeUnit atomic.Int64
+
+// durationPrecision is the number of decimals in formatted durations
+// (SetDurationPrecision).
+var durationPrecision atomic.Int32
+
 var (
 	depth        int32
 	mu           sync.Mutex
@@ -50,84 +111,270 @@ var (
 )
 
 func init() {
+	durationPrecision.Store(2)
+	summaryNameWidth.Store(defaultSummaryNameWidth)
 	warnThresholdNs.Store(1_000_000) // 1ms
 	hotThresholdNs.Store(10_000_000) // 10ms
-	colorize.Store(os.Getenv("NO_COLOR") == "")
+	applyColorEnv()
+	flat.Store(os.Getenv("GOTRACE_FLAT") == "1")
+	if path := os.Getenv("GOTRACE_SUMMARY_FILE"); path != "" {
+		SetSummaryFile(path)
+	}
+	if n, err := strconv.Atoi(os.Getenv("GOTRACE_SUMMARY_TOP")); err == nil {
+		SetSummaryTopN(n)
+	}
 	panicStacks = make(map[uint64][]string)
 }
 
 // Entry represents a single trace record for a function call.
 type Entry struct {
-	Name     string // Function name
-	Args     []any  // Arguments passed to the function
-	Returns  []any  // Return values (if captured)
-	Depth    int32  // Call stack depth
-	StartNs  int64  // Start time in nanoseconds
-	EndNs    int64  // End time in nanoseconds
-	Duration int64  // Duration in nanoseconds
-	GID      uint64 // Goroutine ID
-	File     string // Source file name
-	Line     int    // Line number
-	Panicked bool   // Whether the function panicked
-	PanicVal any    // Panic value if panicked
+	Name           string // Function name
+	Args           []any  // Arguments passed to the function
+	Returns        []any  // Return values (if captured)
+	Depth          int32  // Call stack depth
+	StartNs        int64  // Start time in nanoseconds
+	EndNs          int64  // End time in nanoseconds
+	Duration       int64  // Wall-clock duration in nanoseconds, including time blocked
+	GID            uint64 // Goroutine ID
+	GoroutineLabel string // pprof labels of the goroutine ("worker=3"), or "g<id>"
+	Package        string // Import path of the traced function's package
+	File           string // Source file name
+	Line           int    // Line number
+	Panicked       bool   // Whether the function panicked
+	PanicVal       any    // Panic value if panicked
+	WaitReason     string // Status sampled most during a slow call ("chan receive"), see SetCaptureWaitReason
+	Goroutine      bool   // Whether the entry spans a whole goroutine (Goroutine)
+	Receiver       bool   // Whether Args[0] is the method's receiver (Method)
 }
 
 // Trace logs function entry/exit with timing. Use with defer:
 //
 //	defer trace.Trace("functionName", args...)()
+//
+// As the first defer of the function it runs last, after the function's
+// own defers, so their time is included and a panic they raise is
+// recorded against the function before being re-raised. A panic the
+// function recovers in one of its own defers is not seen at all.
 func Trace(name string, args ...any) func(...any) {
-	d := atomic.AddInt32(&depth, 1)
-	start := nanotime()
+	s := startSpan(name, args)
+	return func(returns ...any) {
+		s.finish(returns, recover())
+	}
+}
+
+// Region times a block inside a function as if it were a nested call. Use
+// with defer:
+//
+//	defer trace.Region("parse-headers")()
+func Region(name string) func() {
+	s := startSpan(name, nil)
+	return func() {
+		s.finish(nil, recover())
+	}
+}
+
+// Watch is a running Stopwatch.
+type Watch struct {
+	s *span
+}
+
+// Stopwatch starts timing a span of code that ends at an explicit Stop
+// rather than a defer, such as one loop iteration:
+//
+//	sw := trace.Stopwatch("phase")
+//	...
+//	sw.Stop()
+//
+// It is recorded and summarized like a Region.
+func Stopwatch(name string) *Watch {
+	s := startSpan(name, nil)
+	if s != nil {
+		s.detached = true
+	}
+	return &Watch{s: s}
+}
+
+// Stop ends the timed span and records it. Later calls do nothing.
+func (w *Watch) Stop() {
+	if s := w.s; s != nil {
+		w.s = nil
+		s.finish(nil, nil)
+	}
+}
+
+// span is a call started by Trace or Region that has not finished yet.
+type span struct {
+	name      string
+	args      []any
+	d         int32
+	start     int64
+	gid       uint64
+	label     string
+	pkg, file string
+	line      int
+	indent    string
+	recRoot   *span // Outermost call of the collapsed recursion s is hidden in
+	recLevel  int32 // Recursion level of s below recRoot, which is level 1
+	recDepth  int32 // Deepest recursion level below s, if s is a recRoot
+	lifetime  bool  // Started by Goroutine
+	detached  bool  // Started by Stopwatch, so it may end out of order
+	receiver  bool  // Started by Method, so args[0] is the receiver
+	stack     *callStack
+}
+
+// startSpan enters a traced call. It must be called directly by Trace,
+// Region, Method, Stopwatch or Goroutine so the recorded location is their
+// caller. It returns nil, a span that records nothing, when called from
+// within trace output or skipped by the entry filter or the per-function
+// call limit.
+func startSpan(name string, args []any) *span {
 	gid := getGID()
-	_, file, line, _ := runtime.Caller(1)
+	if isPrinting(gid) || filteredOut(gid, name, args) || overCallLimit(name) {
+		return nil
+	}
+	d := atomic.AddInt32(&depth, 1)
+	s := &span{name: name, args: args, d: d, gid: gid, label: goroutineLabel(gid)}
+	pc, file, line, _ := runtime.Caller(2)
 	if idx := strings.LastIndex(file, "/"); idx >= 0 {
 		file = file[idx+1:]
 	}
+	s.pkg, s.file, s.line = funcPackage(pc), file, line
+
+	s.indent = indentFor(d)
+	collapseSpan(s)
+	now := clock()
+	firstTraceNs.CompareAndSwap(0, now)
+	if !calibrating && !collecting.Load() && s.recRoot == nil && !foldEnter(name, d) {
+		beginPrinting(gid)
+		printEntry(s.indent, name, args, file, line, s.label, now)
+		endPrinting(gid)
+	}
+	pushSpan(s)
+	// Started last so the entry line and the span's own setup aren't
+	// charged to the call
+	s.start = clock()
+	return s
+}
 
-	indent := strings.Repeat("  ", int(d-1))
-	printEntry(indent, name, args, file, line, gid)
-
-	return func(returns ...any) {
-		end := nanotime()
-		dur := end - start
+// finish exits the call, recording it and re-raising r if the call panicked.
+func (s *span) finish(returns []any, r any) {
+	if s == nil {
+		// Untraced re-entrant or filtered call; only the panic needs passing on
+		if r != nil {
+			panic(r)
+		}
+		return
+	}
+	end := clock()
+	popSpan(s)
+	returns = resolveResults(returns)
+	e := Entry{
+		Name: s.name, Args: s.args, Returns: returns,
+		Depth: s.d, StartNs: s.start, EndNs: end, Duration: end - s.start,
+		GID: s.gid, GoroutineLabel: s.label, Package: s.pkg, File: s.file, Line: s.line,
+		Goroutine: s.lifetime, Receiver: s.receiver,
+	}
 
-		var panicked bool
-		var panicVal any
-		if r := recover(); r != nil {
-			panicked = true
-			panicVal = r
-			printPanic(indent, name, dur, r)
-			defer panic(r)
+	if r != nil {
+		e.Panicked = true
+		e.PanicVal = r
+	}
+	if waitCapture.Load() {
+		e.WaitReason = takeWaitReason(s, e.Duration >= warnThresholdNs.Load())
+	}
+	if calibrating {
+		atomic.AddInt32(&depth, -1)
+		return
+	}
+	beginPrinting(s.gid)
+	if !sendToCollector(e) && s.recRoot == nil && !foldExit(s.name, s.d) {
+		if s.recDepth > 0 {
+			printRecursion(s)
+		}
+		if r != nil {
+			printPanic(s.indent, s.name, e.Duration, r)
 		} else {
-			printExit(indent, name, dur, returns)
+			printExit(s.indent, s.name, e.Duration, returns)
 		}
+	}
+	endPrinting(s.gid)
 
-		mu.Lock()
-		traces = append(traces, Entry{
-			Name: name, Args: args, Returns: returns,
-			Depth: d, StartNs: start, EndNs: end, Duration: dur,
-			GID: gid, File: file, Line: line,
-			Panicked: panicked, PanicVal: panicVal,
-		})
-		mu.Unlock()
-		atomic.AddInt32(&depth, -1)
+	record(e)
+	atomic.AddInt32(&depth, -1)
+	if r != nil {
+		panic(r)
+	}
+	checkSlow(e)
+}
+
+// record stores a finished entry, or folds it into the per-function
+// aggregates in aggregate-only and keep-slowest-only mode. Stored entries
+// share one copy of each name, file and label, so strings built per call
+// (Region(fmt.Sprintf(...)), "g<id>") aren't kept once per entry.
+func record(e Entry) {
+	if !aggregating() {
+		e.Name, e.File, e.GoroutineLabel = intern(e.Name), intern(e.File), intern(e.GoroutineLabel)
+		if bufferEntry(e) {
+			return
+		}
+	}
+	lockTraces()
+	if aggregating() {
+		recordAggregate(e)
+	} else {
+		traces = append(traces, e)
+	}
+	mu.Unlock()
+}
+
+// indentFor returns the prefix of a live line for a call at depth d: two
+// spaces per level, or "[d] " in flat mode.
+func indentFor(d int32) string {
+	if flat.Load() {
+		return fmt.Sprintf("[%d] ", d)
 	}
+	return strings.Repeat("  ", int(d-1))
 }
 
-func printEntry(indent, name string, args []any, file string, line int, gid uint64) {
+// printLine prints one live output line, truncated to the SetMaxLineWidth
+// limit. Width is measured in display columns, ignoring color codes.
+func printLine(format string, args ...any) {
+	if limit := maxLiveLines.Load(); limit > 0 {
+		if n := printedLines.Add(1); n > limit {
+			if n == limit+1 {
+				printOut("... output truncated after %d lines, still recording ...\n", limit)
+			}
+			return
+		}
+	}
+	line := fmt.Sprintf(format, args...)
+	if w := int(maxLineWidth.Load()); w > 0 && lipgloss.Width(line) > w {
+		line = ansi.Truncate(line, w, "…")
+	}
+	printOut("%s\n", line)
+}
+
+func printEntry(indent, name string, args []any, file string, line int, label string, start int64) {
 	argsStr := ""
 	if len(args) > 0 {
 		argsStr = formatArgs(args)
 	}
+	if relativeTime.Load() {
+		rel := fmt.Sprintf("+%.3fs ", float64(start-firstTraceNs.Load())/1e9)
+		if colorize.Load() {
+			rel = fileStyle.Render(rel)
+		}
+		indent = rel + indent
+	}
 	if colorize.Load() {
-		fmt.Printf("%s%s %s%s %s\n",
+		printLine("%s%s %s%s %s",
 			indent,
 			enterStyle.Render("→"),
 			funcStyle.Render(name),
 			argsStyle.Render("("+argsStr+")"),
-			fileStyle.Render(fmt.Sprintf("[%s:%d g%d]", file, line, gid)))
+			fileStyle.Render(fmt.Sprintf("[%s:%d %s]", file, line, label)))
 	} else {
-		fmt.Printf("%s→ %s(%s) [%s:%d g%d]\n", indent, name, argsStr, file, line, gid)
+		printLine("%s→ %s(%s) [%s:%d %s]", indent, name, argsStr, file, line, label)
 	}
 }
 
@@ -135,7 +382,16 @@ func printExit(indent, name string, dur int64, returns []any) {
 	durStr := formatDuration(dur)
 	retStr := ""
 	if len(returns) > 0 {
-		retStr = " → " + argsStyle.Render(formatArgs(returns))
+		// Non-nil errors stand out from the other return values
+		parts := make([]string, len(returns))
+		for i, r := range returns {
+			if isError(r) {
+				parts[i] = hotStyle.Render(formatArgs([]any{r}))
+			} else {
+				parts[i] = argsStyle.Render(formatArgs([]any{r}))
+			}
+		}
+		retStr = " → " + strings.Join(parts, ", ")
 	}
 
 	var styledDur, hotTag string
@@ -149,41 +405,150 @@ func printExit(indent, name string, dur int64, returns []any) {
 	}
 
 	if colorize.Load() {
-		fmt.Printf("%s%s %s%s %s%s\n", indent, exitStyle.Render("←"), fileStyle.Render(name), retStr, styledDur, hotTag)
+		printLine("%s%s %s%s %s%s", indent, exitStyle.Render("←"), fileStyle.Render(name), retStr, styledDur, hotTag)
 	} else {
-		fmt.Printf("%s← %s%s (%s)\n", indent, name, retStr, durStr)
+		printLine("%s← %s%s (%s)", indent, name, retStr, durStr)
 	}
 }
 
+// isError reports whether v is a non-nil error.
+func isError(v any) bool {
+	err, ok := v.(error)
+	return ok && err != nil
+}
+
 func printPanic(indent, name string, dur int64, panicVal any) {
 	if colorize.Load() {
-		fmt.Printf("%s%s %s: %s (%s)\n", indent, panicStyle.Render("💥 PANIC"), funcStyle.Render(name), hotStyle.Render(fmt.Sprintf("%v", panicVal)), formatDuration(dur))
+		printLine("%s%s %s: %s (%s)", indent, panicStyle.Render("💥 PANIC"), funcStyle.Render(name), hotStyle.Render(fmt.Sprintf("%v", panicVal)), formatDuration(dur))
 	} else {
-		fmt.Printf("%s💥 PANIC %s: %v (%s)\n", indent, name, panicVal, formatDuration(dur))
+		printLine("%s💥 PANIC %s: %v (%s)", indent, name, panicVal, formatDuration(dur))
 	}
 }
 
 func formatDuration(ns int64) string {
+	p := int(durationPrecision.Load())
+	switch time.Duration(timeUnit.Load()) {
+	case time.Nanosecond:
+		return fmt.Sprintf("%dns", ns)
+	case time.Microsecond:
+		return fmt.Sprintf("%.*fµs", p, float64(ns)/1e3)
+	case time.Millisecond:
+		return fmt.Sprintf("%.*fms", p, float64(ns)/1e6)
+	case time.Second:
+		return fmt.Sprintf("%.*fs", p, float64(ns)/1e9)
+	}
 	switch {
 	case ns < 1_000:
 		return fmt.Sprintf("%dns", ns)
 	case ns < 1_000_000:
-		return fmt.Sprintf("%.2fµs", float64(ns)/1e3)
+		return fmt.Sprintf("%.*fµs", p, float64(ns)/1e3)
 	case ns < 1_000_000_000:
-		return fmt.Sprintf("%.2fms", float64(ns)/1e6)
+		return fmt.Sprintf("%.*fms", p, float64(ns)/1e6)
 	default:
-		return fmt.Sprintf("%.2fs", float64(ns)/1e9)
+		return fmt.Sprintf("%.*fs", p, float64(ns)/1e9)
 	}
 }
 
 func formatArgs(args []any) string {
+	maxDepth := int(argDepth.Load())
 	parts := make([]string, len(args))
 	for i, arg := range args {
-		parts[i] = fmt.Sprintf("%v", arg)
+		if maxDepth <= 0 {
+			parts[i] = fmt.Sprintf("%v", arg)
+		} else {
+			parts[i] = formatValue(reflect.ValueOf(arg), maxDepth)
+		}
 	}
 	return strings.Join(parts, ", ")
 }
 
+// formatValue renders v like %v but only descends depth levels into
+// composite values; anything deeper is summarized as "...". Errors and
+// Stringers, such as time.Time, print through their method as %v would.
+func formatValue(v reflect.Value, depth int) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case error, fmt.Stringer:
+			return fmt.Sprintf("%v", x)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "<nil>"
+		}
+		switch v.Elem().Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+			return "&" + formatValue(v.Elem(), depth)
+		}
+		return fmt.Sprintf("%v", v)
+	case reflect.Interface:
+		if v.IsNil() {
+			return "<nil>"
+		}
+		return formatValue(v.Elem(), depth)
+	case reflect.Struct:
+		if depth <= 0 {
+			return "..."
+		}
+		parts := make([]string, v.NumField())
+		for i := range parts {
+			parts[i] = formatValue(v.Field(i), depth-1)
+		}
+		return "{" + strings.Join(parts, " ") + "}"
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return "[]"
+		}
+		if depth <= 0 {
+			return "..."
+		}
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = formatValue(v.Index(i), depth-1)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	case reflect.Map:
+		if v.IsNil() {
+			return "map[]"
+		}
+		if depth <= 0 {
+			return "..."
+		}
+		parts := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			parts = append(parts, formatValue(iter.Key(), depth-1)+":"+formatValue(iter.Value(), depth-1))
+		}
+		slices.Sort(parts)
+		return "map[" + strings.Join(parts, " ") + "]"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// funcPackage returns the import path of the package containing pc.
+func funcPackage(pc uintptr) string {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	return packageOf(fn.Name())
+}
+
+// packageOf extracts the import path from a fully qualified function name
+// such as "github.com/me/app/util.(*T).Method".
+func packageOf(qualified string) string {
+	slash := strings.LastIndex(qualified, "/")
+	if dot := strings.Index(qualified[slash+1:], "."); dot >= 0 {
+		return qualified[:slash+1+dot]
+	}
+	return qualified
+}
+
 func getGID() uint64 {
 	b := make([]byte, 64)
 	b = b[:runtime.Stack(b, false)]
@@ -195,33 +560,61 @@ func getGID() uint64 {
 // GetTraces returns a copy of all collected trace entries.
 // The returned slice is safe to modify.
 func GetTraces() []Entry {
+	Flush()
 	mu.Lock()
 	defer mu.Unlock()
 	cp := make([]Entry, len(traces))
 	copy(cp, traces)
-	return cp
+	return append(cp, slowestEntries()...)
 }
 
-// Reset clears all traces, resets call depth, and clears panic state.
+// Reset clears all traces, resets call depth, and clears panic and exit state.
 // Call this between test runs or to start fresh.
 func Reset() {
+	resetBuffers()
 	mu.Lock()
 	traces = traces[:0]
+	clear(aggregates)
 	mu.Unlock()
 	atomic.StoreInt32(&depth, 0)
+	firstTraceNs.Store(0)
+	printedLines.Store(0)
+	exitDumped.Store(false)
 
 	panicMu.Lock()
 	panicPrinted.Store(false)
 	panicStacks = make(map[uint64][]string)
 	panicMu.Unlock()
+
+	memMu.Lock()
+	memSamples = nil
+	memMu.Unlock()
+	resetGoroutineCounts()
+	resetContention()
+	resetCallCounts()
+	resetWaitSamples()
+	resetLifetimes()
+	resetExitHooks()
+
+	foldMu.Lock()
+	foldLastName, foldLastDepth, foldCount, foldInside = "", 0, 0, 0
+	foldMu.Unlock()
+
+	annotationsMu.Lock()
+	annotations = nil
+	annotationsMu.Unlock()
+
+	callStacks.Clear()
+	resetInterned()
 }
 
 // GetHotPaths returns entries whose duration exceeds the hot threshold (default 10ms).
 func GetHotPaths() []Entry {
+	Flush()
 	mu.Lock()
 	defer mu.Unlock()
 	var hot []Entry
-	for _, e := range traces {
+	for _, e := range append(slices.Clone(traces), slowestEntries()...) {
 		if e.Duration >= hotThresholdNs.Load() {
 			hot = append(hot, e)
 		}
@@ -237,52 +630,182 @@ func SetThresholds(warnNs, hotNs int64) {
 	hotThresholdNs.Store(hotNs)
 }
 
+// SetArgDepth limits how many levels arguments and return values are expanded
+// into structs, slices and maps. Deeper values are printed as "...".
+// Zero (the default) disables the limit and uses plain %v formatting.
+func SetArgDepth(n int) {
+	argDepth.Store(int32(n))
+}
+
+// SetRelativeTime prefixes live entry lines with the time elapsed since the
+// first traced call (e.g. "+1.234s") to line traces up with wall-clock logs.
+func SetRelativeTime(enabled bool) {
+	relativeTime.Store(enabled)
+}
+
+// SetSummaryFile makes PrintSummary write the summary, without color codes,
+// to path instead of stdout, keeping it apart from the live trace. An empty
+// path prints to stdout again.
+func SetSummaryFile(path string) {
+	summaryFile.Store(&path)
+}
+
+// SetSummaryTopN makes the summary print only the n slowest calls, leaving
+// out the call frequency and later tables, for a quick look at the headline
+// hotspots.
+// Zero (the default) prints the full summary with the top 10.
+func SetSummaryTopN(n int) {
+	summaryTopN.Store(int32(n))
+}
+
+// SetSummaryMinCount leaves functions called fewer than n times out of the
+// summary's call frequency table, so one-off setup calls don't crowd out
+// the functions that run in loops. Zero or less lists every function.
+func SetSummaryMinCount(n int) {
+	summaryMinCount.Store(int32(n))
+}
+
+// SetSummaryWidth sets the width of the function name column in the summary
+// tables, so long package-qualified names can be shown in full; longer
+// names are still cut with "…". The table rules widen with it. Zero or less
+// restores the default of 28.
+func SetSummaryWidth(nameCol int) {
+	if nameCol <= 0 {
+		nameCol = defaultSummaryNameWidth
+	}
+	summaryNameWidth.Store(int32(max(nameCol, 2)))
+}
+
+// SetFlat prints live lines left-aligned with a "[depth]" prefix instead of
+// indenting them, which keeps deep traces readable and greppable in files.
+func SetFlat(enabled bool) {
+	flat.Store(enabled)
+}
+
+// SetMaxLineWidth truncates each live output line, indentation included, to
+// n terminal columns so deep or argument-heavy calls don't wrap. Zero (the
+// default) disables the limit. The summary is not affected.
+func SetMaxLineWidth(n int) {
+	maxLineWidth.Store(int32(n))
+}
+
+// SetMaxLiveLines stops live output after n lines, printing a notice once,
+// so a runaway loop can't flood the terminal or a log file. Calls are still
+// recorded for the summary. Zero (the default) disables the limit.
+func SetMaxLiveLines(n int) {
+	maxLiveLines.Store(int64(n))
+}
+
+// SetTimeUnit formats every duration in live output and summaries in a fixed
+// unit (time.Nanosecond, time.Microsecond, time.Millisecond or time.Second)
+// so columns line up across rows and runs. Zero (the default) and any other
+// value auto-scale to the most readable unit.
+func SetTimeUnit(unit time.Duration) {
+	timeUnit.Store(int64(unit))
+}
+
+// SetDurationPrecision sets how many decimals durations are printed with in
+// live output and summaries, e.g. 0 for a coarse "12ms" or 4 for
+// "12.3456ms". The default is 2; negative values are treated as 0.
+// Nanoseconds are always whole.
+func SetDurationPrecision(digits int) {
+	durationPrecision.Store(int32(max(digits, 0)))
+}
+
 // SetColorize enables/disables color output.
 // Color is enabled by default unless NO_COLOR environment variable is set.
+// FORCE_COLOR forces it on when output isn't a terminal, and
+// GOTRACE_COLOR=always or never overrides both.
 func SetColorize(enabled bool) {
 	colorize.Store(enabled)
 }
 
 // PrintSummary displays a formatted summary of all traces including
-// top slowest calls and call frequency statistics.
+// top slowest calls and call frequency statistics. With SetSummaryFile it
+// writes the summary, without color codes, to that file instead, and with
+// SetHTMLFile and SetJSONFile it also writes those exports. With
+// SetFailOnHot it then exits if any call was hot, after running the OnExit
+// funcs.
 func PrintSummary() {
-	mu.Lock()
-	defer mu.Unlock()
+	defer checkHot()
+	defer runExitHooks()
+	summary := SnapshotSummary()
+	writeExportFile(&htmlFile, "HTML report", ExportHTML)
+	writeExportFile(&jsonFile, "JSON traces", ExportJSON)
+	if path := summaryFile.Load(); path != nil && *path != "" {
+		err := os.WriteFile(*path, []byte(ansi.Strip(summary)), 0644)
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "gotrace: writing summary file, printing instead: %v\n", err)
+	}
+	printOut("%s", summary)
+}
 
-	if len(traces) == 0 {
-		fmt.Println("No traces collected")
+// writeExportFile writes export to the file path points to, if set.
+func writeExportFile(path *atomic.Pointer[string], what string, export func(io.Writer) error) {
+	p := path.Load()
+	if p == nil || *p == "" {
 		return
 	}
+	f, err := os.Create(*p)
+	if err == nil {
+		err = export(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gotrace: writing %s: %v\n", what, err)
+	}
+}
 
-	sorted := slices.Clone(traces)
-	slices.SortFunc(sorted, func(a, b Entry) int {
-		return cmp.Compare(b.Duration, a.Duration) // Descending order
-	})
+// SnapshotSummary returns the summary PrintSummary would print for the
+// traces collected so far.
+func SnapshotSummary() string {
+	flushFold()
+	Flush()
+	mu.Lock()
+	defer mu.Unlock()
+
+	stats, sorted := summaryStats()
+	if len(stats) == 0 {
+		return "No traces collected\n"
+	}
 
-	counts := make(map[string]int)
-	totalTime := make(map[string]int64)
-	maxTime := make(map[string]int64)
+	var totalCalls int
 	var totalDuration int64
-	for _, e := range traces {
-		counts[e.Name]++
-		totalTime[e.Name] += e.Duration
-		totalDuration += e.Duration
-		if e.Duration > maxTime[e.Name] {
-			maxTime[e.Name] = e.Duration
-		}
+	for _, s := range stats {
+		totalCalls += s.count
+		totalDuration += s.total
 	}
 
 	var sb strings.Builder
 	sb.WriteString("\n" + titleStyle.Render("⚡ GoTrace Summary") + "\n\n")
-	sb.WriteString(fmt.Sprintf("  📈 %s total calls   ⏱  %s total time   📦 %s unique functions\n\n",
-		funcStyle.Render(fmt.Sprintf("%d", len(traces))),
+	sb.WriteString(fmt.Sprintf("  📈 %s total calls   ⏱  %s total time   📦 %s unique functions\n",
+		funcStyle.Render(fmt.Sprintf("%d", totalCalls)),
 		fastStyle.Render(formatDuration(totalDuration)),
-		argsStyle.Render(fmt.Sprintf("%d", len(counts)))))
-
-	sb.WriteString(headerStyle.Render("🔥 Top 10 Slowest Calls") + "\n")
-	sb.WriteString(fileStyle.Render("  "+strings.Repeat("─", 60)) + "\n")
+		argsStyle.Render(fmt.Sprintf("%d", len(stats)))))
+	if wall, busy := wallAndBusy(); wall > 0 {
+		sb.WriteString(fmt.Sprintf("  🕐 %s wall clock   🔀 %s concurrency (busy time / wall)\n",
+			fastStyle.Render(formatDuration(wall)),
+			argsStyle.Render(fmt.Sprintf("%.2fx", float64(busy)/float64(wall)))))
+	}
+	writeGoroutineSummary(&sb)
+	sb.WriteString(fileStyle.Render(fmt.Sprintf("  🧮 ~%s estimated tracing overhead (%d calls × %s, excluding live output)",
+		formatDuration(int64(totalCalls)*overheadNs), totalCalls, formatDuration(overheadNs))) + "\n")
+	writeContentionWarning(&sb, totalDuration)
+	writeCallLimitSummary(&sb)
+	sb.WriteString("\n")
 
+	topN := int(summaryTopN.Load())
 	limit := 10
+	if topN > 0 {
+		limit = topN
+	}
+	sb.WriteString(headerStyle.Render(fmt.Sprintf("🔥 Top %d Slowest Calls", limit)) + "\n")
+	sb.WriteString(summaryRule())
+
 	if len(sorted) < limit {
 		limit = len(sorted)
 	}
@@ -298,36 +821,36 @@ func PrintSummary() {
 		} else {
 			styledDur = fastStyle.Render(fmt.Sprintf("%12s", formatDuration(e.Duration)))
 		}
-		sb.WriteString(fmt.Sprintf("  %s %s %s  %s\n",
+		var wait string
+		if e.WaitReason != "" {
+			wait = "  " + argsStyle.Render("⏳ "+e.WaitReason)
+		}
+		sb.WriteString(fmt.Sprintf("  %s %s %s  %s%s\n",
 			fileStyle.Render(fmt.Sprintf("%2d.", i+1)),
-			funcStyle.Render(fmt.Sprintf("%-28s", truncate(e.Name, 28))),
+			funcStyle.Render(nameColumn(e.Name)),
 			styledDur,
-			fileStyle.Render(fmt.Sprintf("[%s:%d]", e.File, e.Line))))
+			fileStyle.Render(fmt.Sprintf("[%s]", entryLocation(e))),
+			wait))
+	}
+
+	if topN > 0 {
+		sb.WriteString("\n")
+		return sb.String()
 	}
 
 	sb.WriteString("\n" + headerStyle.Render("📊 Call Frequency") + "\n")
-	sb.WriteString(fileStyle.Render("  "+strings.Repeat("─", 60)) + "\n")
+	sb.WriteString(summaryRule())
 
-	type funcStat struct {
-		name  string
-		count int
-		total int64
-		max   int64
-	}
-	var stats []funcStat
-	for name, count := range counts {
-		stats = append(stats, funcStat{name, count, totalTime[name], maxTime[name]})
+	frequent := stats
+	if minCount := int(summaryMinCount.Load()); minCount > 1 {
+		frequent = slices.DeleteFunc(slices.Clone(stats), func(s funcStat) bool { return s.count < minCount })
 	}
-	slices.SortFunc(stats, func(a, b funcStat) int {
-		return cmp.Compare(b.total, a.total) // Descending order
-	})
-
 	limit = 10
-	if len(stats) < limit {
-		limit = len(stats)
+	if len(frequent) < limit {
+		limit = len(frequent)
 	}
 	for i := 0; i < limit; i++ {
-		s := stats[i]
+		s := frequent[i]
 		avg := s.total / int64(s.count)
 		var totalStyled, avgStyled string
 		if s.max >= hotThreshold {
@@ -341,94 +864,382 @@ func PrintSummary() {
 			avgStyled = fastStyle.Render(fmt.Sprintf("%12s", formatDuration(avg)))
 		}
 		sb.WriteString(fmt.Sprintf("  %s %s %s %s\n",
-			funcStyle.Render(fmt.Sprintf("%-28s", truncate(s.name, 28))),
+			funcStyle.Render(nameColumn(s.name)),
 			argsStyle.Render(fmt.Sprintf("%8d", s.count)),
 			totalStyled, avgStyled))
 	}
+	if hidden := len(stats) - len(frequent); hidden > 0 {
+		sb.WriteString(fileStyle.Render(fmt.Sprintf("  (%d functions called fewer than %d times not shown)", hidden, summaryMinCount.Load())) + "\n")
+	}
+	writeUntracedSummary(&sb)
+	writeLifetimeSummary(&sb)
+	writePanicSummary(&sb)
+	writeErrorSummary(&sb)
+	writePackageSummary(&sb, stats)
+	writeMemSummary(&sb)
 	sb.WriteString("\n")
-	fmt.Print(sb.String())
+	return sb.String()
+}
+
+// funcStat summarizes all calls of one function.
+type funcStat struct {
+	name  string
+	pkg   string // Import path of the function's package, if recorded
+	count int
+	total int64
+	max   int64
+}
+
+// summaryStats returns per-function stats sorted by total time, and the
+// calls to rank as slowest sorted by duration. Both come from the recorded
+// traces plus any aggregate-only recordings, which contribute their slowest
+// call. Callers must hold mu.
+func summaryStats() ([]funcStat, []Entry) {
+	byName := make(map[string]*funcStat)
+	sorted := slices.Clone(traces)
+	for _, e := range traces {
+		name := statName(e)
+		s, ok := byName[name]
+		if !ok {
+			s = &funcStat{name: name, pkg: e.Package}
+			byName[name] = s
+		}
+		s.count++
+		s.total += e.Duration
+		s.max = max(s.max, e.Duration)
+	}
+	for name, a := range aggregates {
+		s, ok := byName[name]
+		if !ok {
+			s = &funcStat{name: name, pkg: a.slowest.Package}
+			byName[name] = s
+		}
+		s.count += a.count
+		s.total += a.total
+		s.max = max(s.max, a.max)
+		sorted = append(sorted, a.slowest)
+	}
+
+	stats := make([]funcStat, 0, len(byName))
+	for _, s := range byName {
+		stats = append(stats, *s)
+	}
+	slices.SortFunc(stats, func(a, b funcStat) int {
+		return cmp.Compare(b.total, a.total) // Descending order
+	})
+	slices.SortFunc(sorted, func(a, b Entry) int {
+		return cmp.Compare(b.Duration, a.Duration) // Descending order
+	})
+	return stats, sorted
+}
+
+// wallAndBusy returns the wall-clock span of the recorded traces, from the
+// first start to the last end, and their busy time: the time each goroutine
+// spent in any traced call, summed over goroutines. Each goroutine counts
+// the union of its calls' intervals, so nested calls add nothing beyond
+// their callers. Callers must hold mu.
+func wallAndBusy() (wall, busy int64) {
+	if len(traces) == 0 {
+		return 0, 0
+	}
+	byGID := make(map[uint64][]Entry)
+	first, last := traces[0].StartNs, traces[0].EndNs
+	for _, e := range traces {
+		first, last = min(first, e.StartNs), max(last, e.EndNs)
+		byGID[e.GID] = append(byGID[e.GID], e)
+	}
+	for _, entries := range byGID {
+		slices.SortFunc(entries, func(a, b Entry) int {
+			return cmp.Compare(a.StartNs, b.StartNs)
+		})
+		var covered int64 // End of the time already counted
+		for _, e := range entries {
+			start := max(e.StartNs, covered)
+			if e.EndNs > start {
+				busy += e.EndNs - start
+				covered = e.EndNs
+			}
+		}
+	}
+	return last - first, busy
+}
+
+// writePackageSummary appends a per-package rollup of the function stats
+// to sb when they span more than one package, so it counts the same calls
+// as the function tables, aggregated ones included. Callers must hold mu.
+func writePackageSummary(sb *strings.Builder, funcs []funcStat) {
+	type pkgStat struct {
+		name  string
+		count int
+		total int64
+	}
+	byPkg := make(map[string]*pkgStat)
+	for _, f := range funcs {
+		if f.pkg == "" {
+			continue
+		}
+		s, ok := byPkg[f.pkg]
+		if !ok {
+			s = &pkgStat{name: f.pkg}
+			byPkg[f.pkg] = s
+		}
+		s.count += f.count
+		s.total += f.total
+	}
+	if len(byPkg) < 2 {
+		return
+	}
+
+	stats := make([]*pkgStat, 0, len(byPkg))
+	for _, s := range byPkg {
+		stats = append(stats, s)
+	}
+	slices.SortFunc(stats, func(a, b *pkgStat) int {
+		return cmp.Compare(b.total, a.total) // Descending order
+	})
+
+	sb.WriteString("\n" + headerStyle.Render("📦 Time by Package") + "\n")
+	sb.WriteString(summaryRule())
+	for _, s := range stats[:min(len(stats), 10)] {
+		sb.WriteString(fmt.Sprintf("  %s %s %s\n",
+			funcStyle.Render(nameColumnLeft(s.name)),
+			argsStyle.Render(fmt.Sprintf("%8d", s.count)),
+			colorDuration(s.total)))
+	}
+}
+
+// writePanicSummary appends the functions that panicked, how often, and
+// their distinct panic values to sb. Callers must hold mu.
+func writePanicSummary(sb *strings.Builder) {
+	type panicStat struct {
+		name   string
+		count  int
+		values []string
+	}
+	byName := make(map[string]*panicStat)
+	for _, e := range traces {
+		if !e.Panicked {
+			continue
+		}
+		s, ok := byName[e.Name]
+		if !ok {
+			s = &panicStat{name: e.Name}
+			byName[e.Name] = s
+		}
+		s.count++
+		if v := formatArgs([]any{e.PanicVal}); !slices.Contains(s.values, v) {
+			s.values = append(s.values, v)
+		}
+	}
+	if len(byName) == 0 {
+		return
+	}
+
+	stats := make([]*panicStat, 0, len(byName))
+	for _, s := range byName {
+		stats = append(stats, s)
+	}
+	slices.SortFunc(stats, func(a, b *panicStat) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), cmp.Compare(a.name, b.name))
+	})
+
+	sb.WriteString("\n" + headerStyle.Render("💥 Panics") + "\n")
+	sb.WriteString(summaryRule())
+	for _, s := range stats[:min(len(stats), 10)] {
+		sb.WriteString(fmt.Sprintf("  %s %s  %s\n",
+			funcStyle.Render(nameColumn(s.name)),
+			argsStyle.Render(fmt.Sprintf("%8d", s.count)),
+			hotStyle.Render(truncate(strings.Join(s.values, ", "), 40))))
+	}
+}
+
+// writeErrorSummary appends the functions that returned a non-nil error, as
+// error returns out of all calls, with the latest error. Callers must hold mu.
+func writeErrorSummary(sb *strings.Builder) {
+	type errorStat struct {
+		name   string
+		errors int
+		calls  int
+		last   string
+	}
+	byName := make(map[string]*errorStat)
+	for _, e := range traces {
+		s, ok := byName[e.Name]
+		if !ok {
+			s = &errorStat{name: e.Name}
+			byName[e.Name] = s
+		}
+		s.calls++
+		for _, r := range e.Returns {
+			if isError(r) {
+				s.errors++
+				s.last = formatArgs([]any{r})
+				break
+			}
+		}
+	}
+
+	var stats []*errorStat
+	for _, s := range byName {
+		if s.errors > 0 {
+			stats = append(stats, s)
+		}
+	}
+	if len(stats) == 0 {
+		return
+	}
+	slices.SortFunc(stats, func(a, b *errorStat) int {
+		return cmp.Or(cmp.Compare(b.errors, a.errors), cmp.Compare(a.name, b.name))
+	})
+
+	sb.WriteString("\n" + headerStyle.Render("⚠️  Functions Returning Errors") + "\n")
+	sb.WriteString(summaryRule())
+	for _, s := range stats[:min(len(stats), 10)] {
+		sb.WriteString(fmt.Sprintf("  %s %s  %s\n",
+			funcStyle.Render(nameColumn(s.name)),
+			argsStyle.Render(fmt.Sprintf("%8s", fmt.Sprintf("%d/%d", s.errors, s.calls))),
+			hotStyle.Render(truncate(s.last, 40))))
+	}
 }
 
 // PrintFunctionStats displays detailed statistics for a specific function.
-// This is used with --function flag for micro-benchmark mode.
+// This is used with --function flag for micro-benchmark mode. Durations are
+// wall-clock, so time spent blocked on channels, locks or I/O counts too;
+// run with --pmu for the process's on-CPU share. The OnExit funcs run after
+// it.
 func PrintFunctionStats(name string) {
+	defer runExitHooks()
+	Flush()
 	mu.Lock()
 	defer mu.Unlock()
 
-	// Filter entries for the target function
-	var durations []int64
-	for _, e := range traces {
-		if e.Name == name {
-			durations = append(durations, e.Duration)
+	var dist distribution
+	approx, slowestOnly := false, false
+	if a, ok := aggregates[name]; ok {
+		dist = a.distribution()
+		approx, slowestOnly = !a.slowestOnly, a.slowestOnly
+	} else {
+		// Filter entries for the target function
+		var durations []int64
+		for _, e := range traces {
+			if e.Name == name {
+				durations = append(durations, e.Duration)
+			}
+		}
+		if len(durations) > 0 {
+			dist = exactDistribution(durations)
 		}
 	}
 
-	if len(durations) == 0 {
-		fmt.Printf("\n🎯 Function: %s\n", name)
-		fmt.Println("  No invocations recorded")
+	if dist.count == 0 {
+		printOut("\n🎯 Function: %s\n  No invocations recorded\n", name)
 		return
 	}
 
+	// Build output
+	var sb strings.Builder
+	sb.WriteString("\n" + titleStyle.Render("🎯 Function Micro-Benchmark") + "\n\n")
+	sb.WriteString(fmt.Sprintf("  Function: %s\n", funcStyle.Render(name)))
+	sb.WriteString(summaryRule())
+
+	sb.WriteString(fmt.Sprintf("  Invocations:     %s\n", argsStyle.Render(fmt.Sprintf("%d", dist.count))))
+	sb.WriteString(fmt.Sprintf("  Total Time:      %s\n\n", fastStyle.Render(formatDuration(dist.total))))
+
+	header := "  📊 Timing Distribution"
+	if approx {
+		header += " (approximate percentiles)"
+	}
+	sb.WriteString(headerStyle.Render(header) + "\n")
+	sb.WriteString(summaryRule())
+
+	sb.WriteString(fmt.Sprintf("    Min:           %s\n", fastStyle.Render(formatDuration(dist.min))))
+	sb.WriteString(fmt.Sprintf("    Max:           %s\n", colorDuration(dist.max)))
+	sb.WriteString(fmt.Sprintf("    Mean:          %s\n", colorDuration(dist.mean)))
+	if !slowestOnly {
+		// Keep-slowest-only mode has no data for percentiles
+		sb.WriteString(fmt.Sprintf("    Median:        %s\n", colorDuration(dist.median)))
+		sb.WriteString(fmt.Sprintf("    P95:           %s\n", colorDuration(dist.p95)))
+		sb.WriteString(fmt.Sprintf("    P99:           %s\n", colorDuration(dist.p99)))
+	}
+	sb.WriteString(fmt.Sprintf("    Std Dev:       %s\n", fastStyle.Render(formatDuration(dist.stdDev))))
+
+	// A coarse clock rounds fast calls down to 0, dragging the percentiles with them
+	if dist.zeros*100 >= dist.count*zeroDurationWarnPct {
+		sb.WriteString("\n" + warmStyle.Render(fmt.Sprintf("  ⚠️  %d of %d calls (%.0f%%) measured 0ns: the clock resolution is too coarse for this function.",
+			dist.zeros, dist.count, 100*float64(dist.zeros)/float64(dist.count))) + "\n")
+		sb.WriteString(fileStyle.Render("     Time a loop of many calls in one traced function and divide by the iterations instead.") + "\n")
+	}
+
+	sb.WriteString("\n")
+	printOut("%s", sb.String())
+}
+
+// zeroDurationWarnPct is the share of 0ns calls, in percent, from which
+// PrintFunctionStats warns that the clock is too coarse.
+const zeroDurationWarnPct = 25
+
+// distribution is the timing distribution of one function's calls.
+type distribution struct {
+	count, zeros             int // zeros counts calls that measured 0ns
+	total, min, max, mean    int64
+	median, p95, p99, stdDev int64
+}
+
+// exactDistribution computes the distribution of durations, sorting it in place.
+func exactDistribution(durations []int64) distribution {
 	// Sort for percentile calculations
 	slices.Sort(durations)
 
-	// Calculate statistics
 	count := len(durations)
 	var total int64
 	for _, d := range durations {
 		total += d
 	}
-
-	minD := durations[0]
-	maxD := durations[count-1]
-	mean := total / int64(count)
+	dist := distribution{
+		count: count,
+		total: total,
+		min:   durations[0],
+		max:   durations[count-1],
+		mean:  total / int64(count),
+	}
+	for _, d := range durations {
+		if d != 0 {
+			break
+		}
+		dist.zeros++
+	}
 
 	// Median
-	var median int64
 	if count%2 == 0 {
-		median = (durations[count/2-1] + durations[count/2]) / 2
+		dist.median = (durations[count/2-1] + durations[count/2]) / 2
 	} else {
-		median = durations[count/2]
+		dist.median = durations[count/2]
 	}
 
 	// Percentiles (with bounds checking)
-	p95Idx := int(float64(count-1) * 0.95)
-	p99Idx := int(float64(count-1) * 0.99)
-	p95 := durations[p95Idx]
-	p99 := durations[p99Idx]
+	dist.p95 = durations[int(float64(count-1)*0.95)]
+	dist.p99 = durations[int(float64(count-1)*0.99)]
 
 	// Standard deviation
 	var variance float64
-	meanF := float64(mean)
+	meanF := float64(dist.mean)
 	for _, d := range durations {
 		diff := float64(d) - meanF
 		variance += diff * diff
 	}
 	variance /= float64(count)
-	stdDev := int64(math.Sqrt(variance))
-
-	// Build output
-	var sb strings.Builder
-	sb.WriteString("\n" + titleStyle.Render("🎯 Function Micro-Benchmark") + "\n\n")
-	sb.WriteString(fmt.Sprintf("  Function: %s\n", funcStyle.Render(name)))
-	sb.WriteString(fileStyle.Render("  "+strings.Repeat("─", 60)) + "\n")
-
-	sb.WriteString(fmt.Sprintf("  Invocations:     %s\n", argsStyle.Render(fmt.Sprintf("%d", count))))
-	sb.WriteString(fmt.Sprintf("  Total Time:      %s\n\n", fastStyle.Render(formatDuration(total))))
-
-	sb.WriteString(headerStyle.Render("  📊 Timing Distribution") + "\n")
-	sb.WriteString(fileStyle.Render("  "+strings.Repeat("─", 60)) + "\n")
-
-	sb.WriteString(fmt.Sprintf("    Min:           %s\n", fastStyle.Render(formatDuration(minD))))
-	sb.WriteString(fmt.Sprintf("    Max:           %s\n", colorDuration(maxD)))
-	sb.WriteString(fmt.Sprintf("    Mean:          %s\n", colorDuration(mean)))
-	sb.WriteString(fmt.Sprintf("    Median:        %s\n", colorDuration(median)))
-	sb.WriteString(fmt.Sprintf("    P95:           %s\n", colorDuration(p95)))
-	sb.WriteString(fmt.Sprintf("    P99:           %s\n", colorDuration(p99)))
-	sb.WriteString(fmt.Sprintf("    Std Dev:       %s\n", fastStyle.Render(formatDuration(stdDev))))
+	dist.stdDev = int64(math.Sqrt(variance))
+	return dist
+}
 
-	sb.WriteString("\n")
-	fmt.Print(sb.String())
+// entryLocation returns "file:line", followed by the goroutine label when
+// it comes from pprof labels rather than the bare goroutine ID.
+func entryLocation(e Entry) string {
+	loc := fmt.Sprintf("%s:%d", e.File, e.Line)
+	if e.GoroutineLabel != "" && e.GoroutineLabel != fmt.Sprintf("g%d", e.GID) {
+		loc += " " + e.GoroutineLabel
+	}
+	return loc
 }
 
 // colorDuration formats duration with color based on thresholds.
@@ -450,63 +1261,109 @@ func truncate(s string, max int) string {
 	return s[:max-1] + "…"
 }
 
+// nameColumn pads or truncates name to the SetSummaryWidth column.
+func nameColumn(name string) string {
+	w := int(summaryNameWidth.Load())
+	return fmt.Sprintf("%-*s", w, truncate(name, w))
+}
+
+// nameColumnLeft is nameColumn keeping the end of long names (truncateLeft).
+func nameColumnLeft(name string) string {
+	w := int(summaryNameWidth.Load())
+	return fmt.Sprintf("%-*s", w, truncateLeft(name, w))
+}
+
+// summaryRule returns the line under a summary table header, as wide as the
+// tables.
+func summaryRule() string {
+	return fileStyle.Render("  "+strings.Repeat("─", 32+int(summaryNameWidth.Load()))) + "\n"
+}
+
+// truncateLeft is like truncate but keeps the end of s, which is the more
+// specific part of an import path.
+func truncateLeft(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return "…" + s[len(s)-max+1:]
+}
+
 // TraceOnPanic buffers traces silently and only outputs them when a panic occurs.
 // This is useful for debugging - keep tracing enabled but silent until something goes wrong.
 // Use with defer:
 //
 //	defer trace.TraceOnPanic("functionName", args...)()
 func TraceOnPanic(name string, args ...any) func(...any) {
-	d := atomic.AddInt32(&depth, 1)
-	start := nanotime()
 	gid := getGID()
-	_, file, line, _ := runtime.Caller(1)
+	if isPrinting(gid) || filteredOut(gid, name, args) || overCallLimit(name) {
+		// Called from within trace output (see printing), filtered out or past
+		// the call limit
+		return func(...any) {
+			if r := recover(); r != nil {
+				panic(r)
+			}
+		}
+	}
+	d := atomic.AddInt32(&depth, 1)
+	label := goroutineLabel(gid)
+	pc, file, line, _ := runtime.Caller(1)
 	if idx := strings.LastIndex(file, "/"); idx >= 0 {
 		file = file[idx+1:]
 	}
+	pkg := funcPackage(pc)
 
-	indent := strings.Repeat("  ", int(d-1))
+	indent := indentFor(d)
 	argsStr := ""
 	if len(args) > 0 {
+		beginPrinting(gid)
 		argsStr = formatArgs(args)
+		endPrinting(gid)
 	}
 
 	// Push entry onto this goroutine's stack
-	entryMsg := fmt.Sprintf("%s→ %s(%s) [%s:%d g%d]", indent, name, argsStr, file, line, gid)
+	entryMsg := fmt.Sprintf("%s→ %s(%s) [%s:%d %s]", indent, name, argsStr, file, line, label)
 	panicMu.Lock()
 	panicStacks[gid] = append(panicStacks[gid], entryMsg)
 	panicMu.Unlock()
 
+	// Started last so formatting the buffered entry isn't charged to the call
+	start := clock()
+	firstTraceNs.CompareAndSwap(0, start)
+
 	return func(returns ...any) {
-		end := nanotime()
+		end := clock()
 		dur := end - start
+		returns = resolveResults(returns)
 
 		if r := recover(); r != nil {
 			// Panic detected - dump this goroutine's call stack (only once)
 			panicMu.Lock()
 			if !panicPrinted.Load() {
 				panicPrinted.Store(true)
-				fmt.Fprintln(os.Stderr, "\n"+panicStyle.Render("💥 PANIC DETECTED - Trace leading to panic:")+"\n")
+				printErr("\n%s\n\n", panicStyle.Render("💥 PANIC DETECTED - Trace leading to panic:"))
 				if stack, exists := panicStacks[gid]; exists {
 					for _, msg := range stack {
-						fmt.Fprintln(os.Stderr, msg)
+						printErr("%s\n", msg)
 					}
 				}
-				fmt.Fprintln(os.Stderr, "")
+				printErr("\n")
 			}
 			panicMu.Unlock()
 
 			// Print the panic exit
+			beginPrinting(gid)
 			printPanic(indent, name, dur, r)
 
 			// Store in traces for analysis
-			mu.Lock()
-			traces = append(traces, Entry{
+			e := Entry{
 				Name: name, Args: args, Returns: returns,
 				Depth: d, StartNs: start, EndNs: end, Duration: dur,
-				GID: gid, File: file, Line: line,
+				GID: gid, GoroutineLabel: label, Package: pkg, File: file, Line: line,
 				Panicked: true, PanicVal: r,
-			})
-			mu.Unlock()
+			}
+			sendToCollector(e)
+			endPrinting(gid)
+			record(e)
 
 			atomic.AddInt32(&depth, -1)
 			panic(r) // re-throw
@@ -525,14 +1382,44 @@ func TraceOnPanic(name string, args ...any) func(...any) {
 		panicMu.Unlock()
 
 		// Store in traces for analysis
-		mu.Lock()
-		traces = append(traces, Entry{
+		e := Entry{
 			Name: name, Args: args, Returns: returns,
 			Depth: d, StartNs: start, EndNs: end, Duration: dur,
-			GID: gid, File: file, Line: line,
-		})
-		mu.Unlock()
+			GID: gid, GoroutineLabel: label, Package: pkg, File: file, Line: line,
+		}
+		beginPrinting(gid)
+		sendToCollector(e)
+		endPrinting(gid)
+		record(e)
 
 		atomic.AddInt32(&depth, -1)
+		checkSlow(e)
+	}
+}
+
+// PrintPanicStacks writes the call stacks that TraceOnPanic has buffered for
+// each goroutine to stderr. TraceOnPanic prints the stack of the first panic
+// of the run as it unwinds; a later panic that escapes a goroutine crashes
+// the process without it. Call PrintPanicStacks from a recover at the top
+// of the goroutine, before re-panicking, to get the stacks out first:
+//
+//	go func() {
+//		defer func() {
+//			if r := recover(); r != nil {
+//				trace.PrintPanicStacks()
+//				panic(r)
+//			}
+//		}()
+//		work()
+//	}()
+func PrintPanicStacks() {
+	panicMu.Lock()
+	defer panicMu.Unlock()
+	gids := slices.Sorted(maps.Keys(panicStacks))
+	for _, gid := range gids {
+		printErr("\n%s\n\n", panicStyle.Render(fmt.Sprintf("💥 Trace of goroutine %d:", gid)))
+		for _, msg := range panicStacks[gid] {
+			printErr("%s\n", msg)
+		}
 	}
 }
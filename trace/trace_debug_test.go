@@ -1,8 +1,30 @@
 package trace
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/charmbracelet/lipgloss"
 )
 
 func TestTraceDebug_RecordsAndSummarizes(t *testing.T) {
@@ -50,3 +72,2440 @@ func TestTraceDebug_RecordsAndSummarizes(t *testing.T) {
 		t.Fatalf("expected traces reset, got %d", got)
 	}
 }
+
+func TestTraceDebug_ArgDepthLimitsNestedArgs(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetArgDepth(1)
+	defer SetArgDepth(0)
+
+	type inner struct {
+		Values []int
+	}
+	type outer struct {
+		ID    int
+		Inner *inner
+		Tags  map[string]int
+	}
+	arg := outer{ID: 7, Inner: &inner{Values: []int{1, 2, 3}}, Tags: map[string]int{"a": 1}}
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("nested", arg)()
+		}()
+	})
+	if !strings.Contains(out, "nested({7 &... ...})") {
+		t.Fatalf("expected nested values to be summarized, got %q", out)
+	}
+
+	SetArgDepth(3)
+	out = captureOutput(t, func() {
+		func() {
+			defer Trace("nested", arg)()
+		}()
+	})
+	if !strings.Contains(out, "nested({7 &{[1 2 3]} map[a:1]})") {
+		t.Fatalf("expected fully expanded values, got %q", out)
+	}
+}
+
+func TestTraceDebug_ArgDepthFormatsStringersAndErrors(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetArgDepth(2)
+	defer SetArgDepth(0)
+
+	when := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	type job struct {
+		At  time.Time
+		Err error
+	}
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("run", when, errors.New("disk full"), job{when, errors.New("late")})()
+		}()
+	})
+	want := fmt.Sprintf("run(%v, disk full, {%v late})", when, when)
+	if !strings.Contains(out, want) {
+		t.Fatalf("expected %q, got %q", want, out)
+	}
+}
+
+func TestTraceDebug_MemProfileRecordsSamples(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	stop := StartMemProfile(time.Millisecond)
+	captureOutput(t, func() {
+		func() {
+			defer Trace("alloc")()
+			buf := make([][]byte, 0, 64)
+			for range 64 {
+				buf = append(buf, make([]byte, 64<<10))
+				time.Sleep(100 * time.Microsecond)
+			}
+			_ = buf
+		}()
+	})
+	stop()
+
+	if got := len(GetMemSamples()); got < 2 {
+		t.Fatalf("expected at least 2 memory samples, got %d", got)
+	}
+
+	out := captureOutput(t, func() {
+		PrintSummary()
+	})
+	if !strings.Contains(out, "Memory") || !strings.Contains(out, "samples") {
+		t.Fatalf("expected memory section in summary, got %q", out)
+	}
+}
+
+func TestTraceDebug_TracksGoroutineCount(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	SetTrackGoroutineCount(true)
+	defer SetTrackGoroutineCount(false)
+
+	release := make(chan struct{})
+	defer close(release)
+	for range 5 {
+		go func() { <-release }()
+	}
+	out := captureOutput(t, func() {
+		func() { defer Trace("spawn")() }()
+		PrintSummary()
+	})
+
+	m := regexp.MustCompile(`🧵 (\d+) goroutines max\s+(\d+) min\s+[\d.]+ avg \((\d+) samples\)`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("expected goroutine counts in summary, got %q", out)
+	}
+	hi, _ := strconv.Atoi(m[1])
+	lo, _ := strconv.Atoi(m[2])
+	if hi-lo < 5 {
+		t.Fatalf("expected max to include the 5 spawned goroutines over min, got max %d min %d", hi, lo)
+	}
+}
+
+func TestTraceDebug_CollectorStreamsNDJSON(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 16)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	network, addr := parseCollectorAddr("tcp:" + ln.Addr().String())
+	if err := DialCollector(network, addr); err != nil {
+		t.Fatalf("DialCollector: %v", err)
+	}
+	defer CloseCollector()
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("remote", 42)()
+		}()
+	})
+	if strings.Contains(out, "remote") {
+		t.Fatalf("expected no local output while collecting, got %q", out)
+	}
+
+	var got jsonEntry
+	select {
+	case line := <-lines:
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("unmarshal %q: %v", line, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for collector line")
+	}
+	if got.Name != "remote" || len(got.Args) != 1 || got.Args[0] != "42" {
+		t.Fatalf("unexpected streamed entry: %+v", got)
+	}
+
+	// Dropping the connection must fall back to local printing
+	(<-accepted).Close()
+	out = captureOutput(t, func() {
+		for i := 0; i < 100 && collecting.Load(); i++ {
+			func() {
+				defer Trace("fallback")()
+			}()
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if collecting.Load() {
+		t.Fatal("expected collector to be dropped after connection closed")
+	}
+	if !strings.Contains(out, "← fallback") {
+		t.Fatalf("expected local output after fallback, got %q", out)
+	}
+}
+
+func TestTraceDebug_GoroutineLabelFromPprof(t *testing.T) {
+	if !profLabelsSupported {
+		t.Skip("pprof labels are not readable in this build")
+	}
+	Reset()
+	SetColorize(false)
+
+	out := captureOutput(t, func() {
+		pprof.Do(context.Background(), pprof.Labels("worker", "3", "pool", "io"), func(context.Context) {
+			defer Trace("labeled")()
+		})
+		func() {
+			defer Trace("unlabeled")()
+		}()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %d", len(traces))
+	}
+	if got := traces[0].GoroutineLabel; got != "pool=io,worker=3" {
+		t.Fatalf("expected pprof labels, got %q", got)
+	}
+	if got, want := traces[1].GoroutineLabel, fmt.Sprintf("g%d", traces[1].GID); got != want {
+		t.Fatalf("expected fallback label %q, got %q", want, got)
+	}
+	if !strings.Contains(out, "pool=io,worker=3]") {
+		t.Fatalf("expected label in live output, got %q", out)
+	}
+}
+
+func TestTraceDebug_CollapseRecursion(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetCollapseRecursion(true)
+	defer SetCollapseRecursion(false)
+
+	var fib func(n int) int
+	fib = func(n int) int {
+		defer Trace("fib", n)()
+		if n < 2 {
+			return n
+		}
+		return fib(n-1) + fib(n-2)
+	}
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("main")()
+			fib(5)
+			fib(1)
+		}()
+	})
+
+	want := "→ main() [trace_debug_test.go:"
+	if !strings.HasPrefix(out, want) {
+		t.Fatalf("expected main's entry first, got %q", out)
+	}
+	if n := strings.Count(out, "→ fib("); n != 2 {
+		t.Fatalf("expected only the outermost fib calls printed, got %d in %q", n, out)
+	}
+	if !strings.Contains(out, "    ↻ fib (recursion depth 5)\n  ← fib ") {
+		t.Fatalf("expected the recursion collapsed into one line before the outer exit, got %q", out)
+	}
+	if strings.Count(out, "recursion depth") != 1 {
+		t.Fatalf("expected no recursion line for a call that didn't recurse, got %q", out)
+	}
+
+	calls := 0
+	for _, e := range GetTraces() {
+		if e.Name == "fib" {
+			calls++
+		}
+	}
+	if calls != 16 {
+		t.Fatalf("expected every fib call recorded, got %d", calls)
+	}
+}
+
+func TestTraceDebug_FoldRepeatsCollapsesLoops(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetFoldRepeats(true)
+	defer SetFoldRepeats(false)
+
+	tick := func(i int) {
+		defer Trace("tick", i)()
+		func() {
+			defer Trace("inner")()
+		}()
+	}
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("loop")()
+			for i := range 5 {
+				tick(i)
+			}
+		}()
+		flushFold()
+	})
+
+	if got := strings.Count(out, "→ tick"); got != 1 {
+		t.Fatalf("expected 1 printed tick entry, got %d in %q", got, out)
+	}
+	if got := strings.Count(out, "→ inner"); got != 1 {
+		t.Fatalf("expected callees of folded repeats to be hidden, got %d in %q", got, out)
+	}
+	if !strings.Contains(out, "↻ tick ×5") {
+		t.Fatalf("expected folded line for tick, got %q", out)
+	}
+	if idx := strings.Index(out, "← loop"); idx < strings.Index(out, "↻ tick") {
+		t.Fatalf("expected folded line before the parent's exit, got %q", out)
+	}
+
+	count := 0
+	for _, e := range GetTraces() {
+		if e.Name == "tick" {
+			count++
+		}
+	}
+	if count != 5 {
+		t.Fatalf("expected all 5 tick calls recorded, got %d", count)
+	}
+}
+
+func TestTraceDebug_AnnotateRecordsMarker(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("handle")()
+			Annotate("request 42 start")
+		}()
+	})
+
+	if !strings.Contains(out, "  --- request 42 start ---") {
+		t.Fatalf("expected indented marker line, got %q", out)
+	}
+	annotations := GetAnnotations()
+	if len(annotations) != 1 || annotations[0].Message != "request 42 start" {
+		t.Fatalf("expected 1 recorded annotation, got %+v", annotations)
+	}
+	traces := GetTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected annotation not to be recorded as an entry, got %d entries", len(traces))
+	}
+	if a := annotations[0]; a.TimeNs < traces[0].StartNs || a.TimeNs > traces[0].EndNs {
+		t.Fatalf("expected marker time within the enclosing call")
+	}
+
+	Reset()
+	if len(GetAnnotations()) != 0 {
+		t.Fatal("expected annotations to be cleared by Reset")
+	}
+}
+
+func TestTraceDebug_RelativeTimeIncreases(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetRelativeTime(true)
+	defer SetRelativeTime(false)
+
+	out := captureOutput(t, func() {
+		for range 3 {
+			func() {
+				defer Trace("step")()
+			}()
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	var stamps []float64
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "→ step") {
+			continue
+		}
+		var secs float64
+		if _, err := fmt.Sscanf(line, "+%fs", &secs); err != nil {
+			t.Fatalf("expected relative timestamp prefix in %q: %v", line, err)
+		}
+		stamps = append(stamps, secs)
+	}
+	if len(stamps) != 3 {
+		t.Fatalf("expected 3 timestamped entry lines, got %d in %q", len(stamps), out)
+	}
+	if stamps[0] != 0 {
+		t.Fatalf("expected first entry at +0.000s, got %v", stamps[0])
+	}
+	for i := 1; i < len(stamps); i++ {
+		if stamps[i] <= stamps[i-1] {
+			t.Fatalf("expected increasing timestamps, got %v", stamps)
+		}
+	}
+}
+
+func TestTraceDebug_SummaryGroupsByPackage(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	captureOutput(t, func() {
+		func() {
+			defer Trace("local")()
+		}()
+	})
+	if got, want := GetTraces()[0].Package, "github.com/napolitain/gotrace/trace"; got != want {
+		t.Fatalf("expected package %q, got %q", want, got)
+	}
+
+	record(Entry{Name: "Query", Package: "example.com/app/db", Duration: 5_000_000})
+	record(Entry{Name: "Query", Package: "example.com/app/db", Duration: 3_000_000})
+	record(Entry{Name: "Render", Package: "example.com/app/web", Duration: 1_000_000})
+
+	out := captureOutput(t, func() {
+		PrintSummary()
+	})
+	idx := strings.Index(out, "Time by Package")
+	if idx < 0 {
+		t.Fatalf("expected per-package section, got %q", out)
+	}
+	section := out[idx:]
+	dbIdx, webIdx := strings.Index(section, "example.com/app/db"), strings.Index(section, "example.com/app/web")
+	if dbIdx < 0 || webIdx < 0 || dbIdx > webIdx {
+		t.Fatalf("expected db before web in package rollup, got %q", section)
+	}
+	if !strings.Contains(section, "8.00ms") {
+		t.Fatalf("expected db total of 8.00ms, got %q", section)
+	}
+
+	// Aggregated calls count towards their package like the function table
+	SetAggregateOnly(true)
+	defer SetAggregateOnly(false)
+	record(Entry{Name: "Render", Package: "example.com/app/web", Duration: 10_000_000})
+	out = captureOutput(t, func() {
+		PrintSummary()
+	})
+	_, section, _ = strings.Cut(out, "Time by Package")
+	if !regexp.MustCompile(`example\.com/app/web\s+2\s+11\.00ms`).MatchString(section) {
+		t.Fatalf("expected web's aggregated call in its rollup, got %q", section)
+	}
+}
+
+func TestTraceDebug_PackageOfQualifiedNames(t *testing.T) {
+	tests := map[string]string{
+		"main.main":                           "main",
+		"main.main.func1":                     "main",
+		"github.com/me/app/util.Helper":       "github.com/me/app/util",
+		"github.com/me/app/util.(*T).Method":  "github.com/me/app/util",
+		"example.com/v2.pkg/sub.(*T).M.func2": "example.com/v2.pkg/sub",
+	}
+	for in, want := range tests {
+		if got := packageOf(in); got != want {
+			t.Errorf("packageOf(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTraceDebug_PortableTagBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping build in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not in PATH")
+	}
+
+	cmd := exec.Command(goBin, "vet", "-tags", "portable", ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("portable build failed: %v\n%s", err, out)
+	}
+}
+
+// fakeClock replaces the trace clock with one that advances by step on every read.
+func fakeClock(t *testing.T, step time.Duration) {
+	t.Helper()
+	var now int64
+	old := clock
+	clock = func() int64 {
+		now += int64(step)
+		return now
+	}
+	t.Cleanup(func() { clock = old })
+}
+
+func TestTraceDebug_ExitOnSlow(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, 50*time.Millisecond)
+	SetExitOnSlow(20 * time.Millisecond)
+	defer SetExitOnSlow(0)
+
+	exitCode := -1
+	oldExit := exitFunc
+	exitFunc = func(code int) { exitCode = code }
+	defer func() { exitFunc = oldExit }()
+
+	captureOutput(t, func() {
+		func() {
+			defer Trace("slow")()
+		}()
+	})
+	if exitCode != 3 {
+		t.Fatalf("expected exit code 3 for slow call, got %d", exitCode)
+	}
+
+	SetPanicOnSlow(true)
+	defer SetPanicOnSlow(false)
+	var slowErr *SlowCallError
+	captureOutput(t, func() {
+		defer func() {
+			slowErr, _ = recover().(*SlowCallError)
+		}()
+		func() {
+			defer Trace("slow")()
+		}()
+	})
+	if slowErr == nil || slowErr.Entry.Name != "slow" {
+		t.Fatalf("expected SlowCallError panic for slow, got %v", slowErr)
+	}
+	if !strings.Contains(slowErr.Error(), "exceeding limit of 20.00ms") {
+		t.Fatalf("unexpected error message: %s", slowErr.Error())
+	}
+
+	SetExitOnSlow(time.Second)
+	exitCode = -1
+	captureOutput(t, func() {
+		func() {
+			defer Trace("fast")()
+		}()
+	})
+	if exitCode != -1 {
+		t.Fatalf("expected no exit for call under the limit, got %d", exitCode)
+	}
+}
+
+func TestTraceDebug_AggregateOnlyApproximatesPercentiles(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetAggregateOnly(true)
+	defer func() {
+		SetAggregateOnly(false)
+		Reset()
+	}()
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	durations := make([]int64, 10_000)
+	for i := range durations {
+		durations[i] = 1_000 + rng.Int64N(100_000_000)
+		record(Entry{Name: "work", Duration: durations[i], File: "work.go", Line: 1})
+	}
+
+	if got := len(GetTraces()); got != 0 {
+		t.Fatalf("expected no stored traces in aggregate-only mode, got %d", got)
+	}
+
+	exact := exactDistribution(slices.Clone(durations))
+	approx := aggregates["work"].distribution()
+	if approx.count != exact.count || approx.total != exact.total || approx.min != exact.min || approx.max != exact.max {
+		t.Fatalf("expected exact count/total/min/max, got %+v want %+v", approx, exact)
+	}
+	for _, q := range []struct {
+		name          string
+		approx, exact int64
+	}{
+		{"median", approx.median, exact.median},
+		{"p95", approx.p95, exact.p95},
+		{"p99", approx.p99, exact.p99},
+		{"stddev", approx.stdDev, exact.stdDev},
+	} {
+		if relErr := math.Abs(float64(q.approx-q.exact)) / float64(q.exact); relErr > 0.02 {
+			t.Errorf("%s: approx %d vs exact %d (%.2f%% error)", q.name, q.approx, q.exact, relErr*100)
+		}
+	}
+
+	out := captureOutput(t, func() {
+		PrintSummary()
+		PrintFunctionStats("work")
+	})
+	if !strings.Contains(out, "10000 total calls") {
+		t.Fatalf("expected call count in summary, got %q", out)
+	}
+	if !strings.Contains(out, "approximate percentiles") {
+		t.Fatalf("expected approximate percentile note, got %q", out)
+	}
+}
+
+func TestTraceDebug_FunctionStatsWarnsOnZeroDurations(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	var entries []Entry
+	for i := range 10 {
+		d := int64(0)
+		if i >= 8 {
+			d = 1_000
+		}
+		entries = append(entries, Entry{Name: "tiny", Duration: d}, Entry{Name: "steady", Duration: 5_000})
+	}
+	AddEntries(entries)
+
+	out := captureOutput(t, func() { PrintFunctionStats("tiny") })
+	if !strings.Contains(out, "8 of 10 calls (80%) measured 0ns") || !strings.Contains(out, "Time a loop of many calls") {
+		t.Fatalf("expected a clock resolution warning, got %q", out)
+	}
+	if out := captureOutput(t, func() { PrintFunctionStats("steady") }); strings.Contains(out, "measured 0ns") {
+		t.Fatalf("expected no warning without zero durations, got %q", out)
+	}
+}
+
+func TestTraceDebug_SummaryReportsOverhead(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	if overheadNs < 0 {
+		t.Fatalf("expected non-negative calibrated overhead, got %d", overheadNs)
+	}
+	if got := len(GetTraces()); got != 0 {
+		t.Fatalf("expected calibration calls not to be recorded, got %d", got)
+	}
+
+	captureOutput(t, func() {
+		for range 3 {
+			func() {
+				defer Trace("work")()
+			}()
+		}
+	})
+	out := captureOutput(t, func() {
+		PrintSummary()
+	})
+	want := fmt.Sprintf("estimated tracing overhead (3 calls × %s", formatDuration(overheadNs))
+	if !strings.Contains(out, want) {
+		t.Fatalf("expected overhead line %q, got %q", want, out)
+	}
+	if strings.Contains(out, "~-") {
+		t.Fatalf("expected non-negative overhead, got %q", out)
+	}
+}
+
+func TestTraceDebug_DumpOnExitPrintsOnce(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	oldExit := exitFunc
+	exitCode := -1
+	exitFunc = func(code int) { exitCode = code }
+	defer func() {
+		exitFunc = oldExit
+		dumpOnExit.Store(false)
+	}()
+
+	out := captureOutput(t, func() {
+		func() {
+			defer DumpOnExit()()
+			func() {
+				defer Trace("early")()
+			}()
+		}()
+		Exit(2)
+	})
+
+	if got := strings.Count(out, "GoTrace Summary"); got != 1 {
+		t.Fatalf("expected summary printed exactly once, got %d in %q", got, out)
+	}
+	if !strings.Contains(out, "early") {
+		t.Fatalf("expected traced call in summary, got %q", out)
+	}
+	if exitCode != 2 {
+		t.Fatalf("expected Exit to forward code 2, got %d", exitCode)
+	}
+}
+
+func TestTraceDebug_OnExitRunsRegisteredFuncs(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	var ran []string
+	OnExit(func() { ran = append(ran, "json") })
+	OnExit(func() {
+		ran = append(ran, "chrome")
+		PrintSummary() // Must not run the hooks again
+	})
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("work")()
+		}()
+		PrintSummary()
+	})
+
+	if !slices.Equal(ran, []string{"json", "chrome"}) {
+		t.Fatalf("expected both hooks to run once in order, got %v", ran)
+	}
+	if !strings.Contains(out, "GoTrace Summary") {
+		t.Fatalf("expected the summary before the hooks, got %q", out)
+	}
+
+	Reset()
+	ran = nil
+	captureOutput(t, PrintSummary)
+	if len(ran) != 0 {
+		t.Fatalf("expected Reset to drop the hooks, got %v", ran)
+	}
+}
+
+func TestTraceDebug_ExportImportJSONRoundTrip(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	captureOutput(t, func() {
+		func() {
+			defer Method("outer", 1, "a")()
+			func() {
+				done := Trace("inner")
+				done(42)
+			}()
+		}()
+	})
+
+	var buf strings.Builder
+	if err := ExportJSON(&buf); err != nil {
+		t.Fatalf("ExportJSON: %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Fatalf("expected header and 2 entry lines, got %d: %q", got, buf.String())
+	}
+
+	entries, err := ImportJSON(strings.NewReader(buf.String() + "\n"))
+	if err != nil {
+		t.Fatalf("ImportJSON: %v", err)
+	}
+	want := GetTraces()
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.Name != w.Name || e.Depth != w.Depth || e.StartNs != w.StartNs || e.Duration != w.Duration || e.GID != w.GID || e.Line != w.Line || e.Receiver != w.Receiver {
+			t.Fatalf("entry %d mismatch: got %+v, want %+v", i, e, w)
+		}
+	}
+	if entries[0].Name != "inner" || !slices.Equal(entries[0].Returns, []any{"42"}) {
+		t.Fatalf("expected inner returning \"42\", got %+v", entries[0])
+	}
+	if !slices.Equal(entries[1].Args, []any{"1", "a"}) || !entries[1].Receiver {
+		t.Fatalf("expected outer args restored as strings after its receiver, got %+v", entries[1])
+	}
+
+	if _, err := ImportJSON(strings.NewReader("{\"name\":\"ok\"}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected line 2 parse error, got %v", err)
+	}
+}
+
+func TestTraceDebug_SetTimeUnitFixesFormatting(t *testing.T) {
+	defer SetTimeUnit(0)
+
+	SetTimeUnit(time.Microsecond)
+	for ns, want := range map[int64]string{500: "0.50µs", 1_500_000: "1500.00µs", 2_000_000_000: "2000000.00µs"} {
+		if got := formatDuration(ns); got != want {
+			t.Errorf("formatDuration(%d) in µs = %q, want %q", ns, got, want)
+		}
+	}
+
+	SetTimeUnit(time.Millisecond)
+	if got := formatDuration(250_000); got != "0.25ms" {
+		t.Errorf("formatDuration(250000) in ms = %q, want 0.25ms", got)
+	}
+
+	SetTimeUnit(0)
+	if got := formatDuration(1_500_000); got != "1.50ms" {
+		t.Errorf("expected auto-scaling after reset, got %q", got)
+	}
+}
+
+func TestTraceDebug_ColorEnvControlsOutput(t *testing.T) {
+	Reset()
+	defer lipgloss.SetColorProfile(lipgloss.ColorProfile())
+	defer SetColorize(false)
+
+	run := func(env map[string]string) string {
+		for _, k := range []string{"GOTRACE_COLOR", "NO_COLOR", "FORCE_COLOR"} {
+			t.Setenv(k, env[k])
+		}
+		applyColorEnv()
+		return captureOutput(t, func() { Trace("colored")() })
+	}
+	hasColor := func(out string) bool { return strings.Contains(out, "\x1b[") }
+
+	if out := run(map[string]string{"GOTRACE_COLOR": "always", "NO_COLOR": "1"}); !hasColor(out) {
+		t.Fatalf("expected GOTRACE_COLOR=always to color piped output despite NO_COLOR, got %q", out)
+	}
+	if out := run(map[string]string{"GOTRACE_COLOR": "never", "FORCE_COLOR": "1"}); hasColor(out) {
+		t.Fatalf("expected GOTRACE_COLOR=never to disable color despite FORCE_COLOR, got %q", out)
+	}
+	if out := run(map[string]string{"NO_COLOR": "1"}); hasColor(out) {
+		t.Fatalf("expected NO_COLOR to disable color, got %q", out)
+	}
+}
+
+func TestTraceDebug_SetSummaryWidthWidensNameColumn(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	defer SetSummaryWidth(0)
+
+	name := "github.com/me/app/internal/store.Cache.Lookup"
+	run := func() string {
+		out := captureOutput(t, func() {
+			Trace(name)()
+			PrintSummary()
+		})
+		_, summary, _ := strings.Cut(out, "GoTrace Summary")
+		return summary
+	}
+
+	if out := run(); strings.Contains(out, name) || !strings.Contains(out, name[:27]+"…") {
+		t.Fatalf("expected the name cut at the default 28 columns, got %q", out)
+	}
+
+	Reset()
+	SetSummaryWidth(60)
+	out := run()
+	if !strings.Contains(out, name+strings.Repeat(" ", 60-len(name))) {
+		t.Fatalf("expected the full name padded to 60 columns, got %q", out)
+	}
+	if !strings.Contains(out, strings.Repeat("─", 92)) {
+		t.Fatalf("expected the table rules to widen with the column, got %q", out)
+	}
+}
+
+func TestTraceDebug_SetSummaryMinCountHidesRareCalls(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetSummaryMinCount(3)
+	defer SetSummaryMinCount(0)
+
+	out := captureOutput(t, func() {
+		Trace("setup")()
+		Trace("config")()
+		for range 5 {
+			Trace("handle")()
+		}
+		PrintSummary()
+	})
+	_, freq, _ := strings.Cut(out, "Call Frequency")
+	freq, _, found := strings.Cut(freq, "(2 functions called fewer than 3 times not shown)")
+	if !found {
+		t.Fatalf("expected a note about the 2 hidden functions, got %q", out)
+	}
+	if !strings.Contains(freq, "handle") {
+		t.Fatalf("expected the frequently called function listed, got %q", freq)
+	}
+	if strings.Contains(freq, "setup") || strings.Contains(freq, "config") {
+		t.Fatalf("expected the one-off calls left out of the frequency table, got %q", freq)
+	}
+}
+
+func TestTraceDebug_GroupByReceiverCountsPerInstance(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetSummaryWidth(60)
+	SetGroupByReceiver(true)
+	defer func() {
+		SetSummaryWidth(0)
+		SetGroupByReceiver(false)
+	}()
+
+	type Calculator struct{ total int }
+	a, b := &Calculator{}, &Calculator{}
+	out := captureOutput(t, func() {
+		for i := range 5 {
+			c := a
+			if i >= 3 {
+				c = b
+			}
+			func() {
+				defer Method("Calculator.Add", c, i)()
+				c.total += i // Changing state must not split an instance's row
+			}()
+		}
+		Trace("helper", 1)()
+		// A dotted function name isn't a method; its first arg stays an arg
+		Trace("strconv.Itoa", a)()
+		PrintSummary()
+	})
+	_, freq, _ := strings.Cut(out, "Call Frequency")
+
+	for _, want := range []struct {
+		recv  *Calculator
+		calls int
+	}{{a, 3}, {b, 2}} {
+		row := regexp.MustCompile(regexp.QuoteMeta(fmt.Sprintf("Calculator.Add@%p", want.recv)) + `\s+(\d+)`).FindStringSubmatch(freq)
+		if row == nil || row[1] != strconv.Itoa(want.calls) {
+			t.Fatalf("expected %d calls on %p, got %v in %q", want.calls, want.recv, row, freq)
+		}
+	}
+	if !regexp.MustCompile(`helper\s+1 `).MatchString(freq) || !regexp.MustCompile(`strconv\.Itoa\s+1 `).MatchString(freq) {
+		t.Fatalf("expected plain functions in one row, got %q", freq)
+	}
+	if traces := GetTraces(); !traces[0].Receiver || traces[len(traces)-1].Receiver {
+		t.Fatal("expected only Method entries to be marked as having a receiver")
+	}
+}
+
+func TestTraceDebug_SetDurationPrecision(t *testing.T) {
+	defer SetDurationPrecision(2)
+
+	tests := []struct {
+		digits int
+		ns     int64
+		want   string
+	}{
+		{0, 12_345_678, "12ms"},
+		{1, 12_345_678, "12.3ms"},
+		{4, 12_345_678, "12.3457ms"},
+		{3, 1_500, "1.500µs"},
+		{3, 999, "999ns"},
+		{-1, 2_500_000_000, "2s"},
+	}
+	for _, tt := range tests {
+		SetDurationPrecision(tt.digits)
+		if got := formatDuration(tt.ns); got != tt.want {
+			t.Errorf("precision %d: formatDuration(%d) = %q, want %q", tt.digits, tt.ns, got, tt.want)
+		}
+	}
+
+	SetDurationPrecision(2)
+	if got := formatDuration(1_500_000); got != "1.50ms" {
+		t.Errorf("expected 2 decimals by default, got %q", got)
+	}
+}
+
+func TestTraceDebug_SummaryShowsUntracedSelfTime(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetThresholds(1_000_000, 10_000_000)
+
+	// handler spends 16ms in traced callees and 24ms elsewhere, e.g. in
+	// functions left out by --pattern
+	AddEntries([]Entry{
+		{Name: "handler", StartNs: 0, EndNs: 40_000_000, Duration: 40_000_000, GID: 1, Depth: 1},
+		{Name: "query", StartNs: 2_000_000, EndNs: 12_000_000, Duration: 10_000_000, GID: 1, Depth: 2},
+		{Name: "render", StartNs: 20_000_000, EndNs: 26_000_000, Duration: 6_000_000, GID: 1, Depth: 2},
+	})
+	out := captureOutput(t, PrintSummary)
+
+	_, section, ok := strings.Cut(out, "Untraced Self Time")
+	if !ok {
+		t.Fatalf("expected an untraced self time table, got %q", out)
+	}
+	lines := strings.Split(section, "\n")
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^  handler\s+24\.00ms\s+60\.0% of its time$`),
+		regexp.MustCompile(`^  query\s+10\.00ms\s+100\.0% of its time$`),
+		regexp.MustCompile(`^  render\s+6\.00ms\s+100\.0% of its time$`),
+	}
+	if len(lines) < 2+len(want) {
+		t.Fatalf("expected %d rows, got %q", len(want), section)
+	}
+	for i, re := range want {
+		if !re.MatchString(lines[2+i]) {
+			t.Errorf("row %d: expected %s, got %q", i, re, lines[2+i])
+		}
+	}
+}
+
+func TestTraceDebug_ExportHotPathsKeepsOnlyHotEntries(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetThresholds(1_000_000, 10_000_000)
+
+	AddEntries([]Entry{
+		{Name: "fast", Args: []any{1}, Duration: 2_000_000, GID: 1, Depth: 1},
+		{Name: "hot", Args: []any{"a", 2}, Duration: 25_000_000, GID: 1, Depth: 1, File: "main.go", Line: 7, WaitReason: "IO wait", Receiver: true},
+		{Name: "tooFast", Duration: 500, GID: 2, Depth: 1},
+	})
+
+	var js strings.Builder
+	if err := ExportHotPaths(&js, FormatJSON); err != nil {
+		t.Fatalf("ExportHotPaths json: %v", err)
+	}
+	entries, err := ImportJSON(strings.NewReader(js.String()))
+	if err != nil {
+		t.Fatalf("ImportJSON: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "hot" || entries[0].Duration != 25_000_000 {
+		t.Fatalf("expected only the hot entry in JSON, got %+v", entries)
+	}
+
+	var csvOut strings.Builder
+	if err := ExportHotPaths(&csvOut, FormatCSV); err != nil {
+		t.Fatalf("ExportHotPaths csv: %v", err)
+	}
+	want := "name,args,returns,depth,start_ns,end_ns,duration_ns,gid,label,package,file,line,panicked,panic,wait,goroutine,receiver\n" +
+		"hot,\"a, 2\",,1,0,0,25000000,1,,,main.go,7,false,,IO wait,false,true\n"
+	if csvOut.String() != want {
+		t.Fatalf("unexpected CSV:\n%s\nwant:\n%s", csvOut.String(), want)
+	}
+
+	if err := ExportHotPaths(io.Discard, "xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestTraceDebug_ExportJSONHeaderVersion(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	captureOutput(t, func() {
+		Trace("work")()
+	})
+
+	var buf strings.Builder
+	if err := ExportJSON(&buf); err != nil {
+		t.Fatalf("ExportJSON: %v", err)
+	}
+	first, _, _ := strings.Cut(buf.String(), "\n")
+	var header struct {
+		Format  string `json:"format"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(first), &header); err != nil {
+		t.Fatalf("header line is not JSON: %v (%q)", err, first)
+	}
+	if header.Format != "gotrace.entries" || header.Version != 2 {
+		t.Fatalf("expected gotrace.entries version 2, got %+v", header)
+	}
+
+	v1 := `{"format":"gotrace.entries","version":1}` + "\n" + `{"name":"work","depth":1,"duration_ns":5}` + "\n"
+	if entries, err := ImportJSON(strings.NewReader(v1)); err != nil || len(entries) != 1 {
+		t.Fatalf("expected ImportJSON to read version 1, got %v (%v)", entries, err)
+	}
+
+	future := `{"format":"gotrace.entries","version":99}` + "\n"
+	if _, err := ImportJSON(strings.NewReader(future)); err == nil {
+		t.Fatal("expected ImportJSON to reject a newer format version")
+	}
+}
+
+func TestTraceDebug_GoroutineRecordsLifetime(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	// The leaky goroutine is let go, and waited for, once the test is done
+	release, leaked := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		<-leaked
+	})
+	out := captureOutput(t, func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer Goroutine("go worker#1")()
+			time.Sleep(20 * time.Millisecond)
+		}()
+		started := make(chan struct{})
+		go func() {
+			defer close(leaked)
+			defer Goroutine("go leaky#1")()
+			close(started)
+			<-release
+		}()
+		<-started
+		wg.Wait()
+		PrintSummary()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 1 || traces[0].Name != "go worker#1" || !traces[0].Goroutine {
+		t.Fatalf("expected one goroutine lifetime entry, got %+v", traces)
+	}
+	if traces[0].Duration < int64(20*time.Millisecond) {
+		t.Fatalf("expected the lifetime to span the goroutine's work, got %s", formatDuration(traces[0].Duration))
+	}
+	_, section, ok := strings.Cut(out, "Goroutine Lifetimes")
+	if !ok {
+		t.Fatalf("expected a goroutine lifetimes table, got %q", out)
+	}
+	if !regexp.MustCompile(`go worker#1\s+1 `).MatchString(section) ||
+		!regexp.MustCompile(`go leaky#1\s+1 still running`).MatchString(section) ||
+		!strings.Contains(section, "1 goroutine(s) still running, the oldest for ") {
+		t.Fatalf("expected finished and still running goroutines listed, got %q", section)
+	}
+}
+
+func TestTraceDebug_StopwatchTimesLoopIterations(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, time.Microsecond)
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("run")()
+			for range 3 {
+				sw := Stopwatch("iteration")
+				sw.Stop()
+				sw.Stop()
+			}
+		}()
+		PrintSummary()
+	})
+
+	var iterations []Entry
+	for _, e := range GetTraces() {
+		if e.Name == "iteration" {
+			iterations = append(iterations, e)
+		}
+	}
+	if len(iterations) != 3 {
+		t.Fatalf("expected one entry per iteration despite repeated Stop, got %d", len(iterations))
+	}
+	for _, e := range iterations {
+		if e.Depth != 2 || e.File != "trace_debug_test.go" || e.Duration <= 0 {
+			t.Fatalf("expected a timed entry nested under run at the caller's location, got %+v", e)
+		}
+	}
+	if !strings.Contains(out, "iteration") || !strings.Contains(out, "Call Frequency") {
+		t.Fatalf("expected the stopwatch in the summary, got %q", out)
+	}
+}
+
+func TestTraceDebug_RegionRecordsNestedSpan(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("handler")()
+			func() {
+				defer Region("parse-headers")()
+				time.Sleep(time.Millisecond)
+			}()
+		}()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %d", len(traces))
+	}
+	region, handler := traces[0], traces[1]
+	if region.Name != "parse-headers" || region.Depth != handler.Depth+1 {
+		t.Fatalf("expected region nested under handler, got %+v and %+v", region, handler)
+	}
+	if region.File != "trace_debug_test.go" {
+		t.Fatalf("expected region location in the caller's file, got %q", region.File)
+	}
+	if region.Duration < int64(time.Millisecond) {
+		t.Fatalf("expected region to time the block, got %s", formatDuration(region.Duration))
+	}
+	if !strings.Contains(out, "  → parse-headers") {
+		t.Fatalf("expected indented region entry line, got %q", out)
+	}
+
+	Reset()
+	captureOutput(t, func() {
+		defer func() { recover() }()
+		defer Region("boom")()
+		panic("bad header")
+	})
+	if traces := GetTraces(); len(traces) != 1 || !traces[0].Panicked {
+		t.Fatalf("expected panicking region to be recorded, got %+v", traces)
+	}
+}
+
+func TestTraceDebug_SummaryListsRecoveredPanics(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	parse := func(input string) {
+		defer func() { recover() }()
+		defer Trace("parse", input)()
+		if input == "" {
+			panic("empty input")
+		}
+	}
+	out := captureOutput(t, func() {
+		parse("ok")
+		parse("")
+		parse("")
+		PrintSummary()
+	})
+
+	_, summary, _ := strings.Cut(out, "💥 Panics")
+	if summary == "" {
+		t.Fatalf("expected a Panics section, got %q", out)
+	}
+	fields := strings.Fields(strings.SplitN(strings.TrimSpace(summary), "\n", 3)[1])
+	if len(fields) < 3 || fields[0] != "parse" || fields[1] != "2" || !strings.Contains(summary, "empty input") {
+		t.Fatalf("expected parse with 2 panics and its value, got %q", summary)
+	}
+
+	Reset()
+	out = captureOutput(t, func() {
+		parse("ok")
+		PrintSummary()
+	})
+	if strings.Contains(out, "💥 Panics") {
+		t.Fatalf("expected no Panics section without panics, got %q", out)
+	}
+}
+
+func TestTraceDebug_SetMaxLineWidthTruncatesLiveLines(t *testing.T) {
+	Reset()
+	defer SetMaxLineWidth(0)
+
+	long := strings.Repeat("x", 200)
+	for _, color := range []bool{false, true} {
+		SetColorize(color)
+		SetMaxLineWidth(40)
+		out := captureOutput(t, func() {
+			func() {
+				defer Trace("outer")()
+				Trace("inner", long)()
+			}()
+		})
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			if w := lipgloss.Width(line); w > 40 {
+				t.Fatalf("color=%v: expected at most 40 columns, got %d in %q", color, w, line)
+			}
+		}
+		if !strings.Contains(out, "…") {
+			t.Fatalf("color=%v: expected truncated line to end with an ellipsis, got %q", color, out)
+		}
+	}
+
+	SetColorize(false)
+	SetMaxLineWidth(0)
+	out := captureOutput(t, func() { Trace("inner", long)() })
+	if !strings.Contains(out, long) {
+		t.Fatalf("expected no truncation by default, got %q", out)
+	}
+}
+
+func TestTraceDebug_BufferFlushDrainsGoroutineBuffers(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetBufferFlushSize(4)
+	defer SetBufferFlushSize(0)
+
+	countBuffers := func() int {
+		n := 0
+		buffers.Range(func(_, _ any) bool { n++; return true })
+		return n
+	}
+	run := func(goroutines, calls int) {
+		captureOutput(t, func() {
+			var wg sync.WaitGroup
+			for range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range calls {
+						Trace("work")()
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+
+	// Full batches flush themselves and leave no buffer behind
+	run(50, 4)
+	if n := countBuffers(); n != 0 {
+		t.Fatalf("expected no buffers after full batches, got %d", n)
+	}
+
+	run(50, 3)
+	if n := countBuffers(); n != 50 {
+		t.Fatalf("expected one pending buffer per goroutine, got %d", n)
+	}
+	Flush()
+	if n := countBuffers(); n != 0 {
+		t.Fatalf("expected Flush to drain the buffers of exited goroutines, got %d", n)
+	}
+	if got := len(GetTraces()); got != 50*4+50*3 {
+		t.Fatalf("expected every entry kept, got %d", got)
+	}
+}
+
+func TestTraceDebug_BufferFlushSizeKeepsAllEntries(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetBufferFlushSize(16)
+	defer SetBufferFlushSize(0)
+
+	const workers, calls = 8, 100
+	captureOutput(t, func() {
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range calls {
+					Trace("work")()
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	mu.Lock()
+	pending := len(traces)
+	mu.Unlock()
+	if pending >= workers*calls {
+		t.Fatalf("expected some entries to still be buffered before Flush, got %d stored", pending)
+	}
+
+	traces := GetTraces()
+	if len(traces) != workers*calls {
+		t.Fatalf("expected %d entries after flush, got %d", workers*calls, len(traces))
+	}
+	perGID := make(map[uint64]int)
+	for _, e := range traces {
+		perGID[e.GID]++
+	}
+	for gid, n := range perGID {
+		if n != calls {
+			t.Fatalf("goroutine %d: expected %d entries, got %d", gid, calls, n)
+		}
+	}
+}
+
+func BenchmarkTraceDebug_Record(b *testing.B) {
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("flush=%d", size), func(b *testing.B) {
+			Reset()
+			SetBufferFlushSize(size)
+			defer SetBufferFlushSize(0)
+			b.RunParallel(func(pb *testing.PB) {
+				e := Entry{Name: "work", GID: getGID()}
+				for pb.Next() {
+					record(e)
+				}
+			})
+			b.StopTimer()
+			Reset()
+		})
+	}
+}
+
+func TestTraceDebug_ErrorReturnsAreHighlightedAndSummarized(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	open := func(name string) (err error) {
+		done := Trace("open", name)
+		defer func() { done(err) }()
+		if name == "missing" {
+			return fmt.Errorf("open %s: no such file", name)
+		}
+		return nil
+	}
+	out := captureOutput(t, func() {
+		open("ok")
+		open("missing")
+		open("ok")
+		PrintSummary()
+	})
+
+	if !strings.Contains(out, "← open → open missing: no such file") {
+		t.Fatalf("expected error return in exit line, got %q", out)
+	}
+	_, summary, _ := strings.Cut(out, "Functions Returning Errors")
+	if summary == "" {
+		t.Fatalf("expected an errors section, got %q", out)
+	}
+	fields := strings.Fields(strings.SplitN(strings.TrimSpace(summary), "\n", 3)[1])
+	if len(fields) < 3 || fields[0] != "open" || fields[1] != "1/3" || !strings.Contains(summary, "no such file") {
+		t.Fatalf("expected open with 1/3 error returns and the error, got %q", summary)
+	}
+
+	if !isError(fmt.Errorf("x")) || isError(nil) || isError("text") {
+		t.Fatal("isError misclassifies values")
+	}
+}
+
+func TestTraceDebug_SetFlatPrefixesDepth(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetFlat(true)
+	defer SetFlat(false)
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("outer")()
+			func() {
+				defer Trace("inner")()
+				Annotate("step")
+			}()
+		}()
+	})
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	want := []string{"[1] → outer", "[2] → inner", "[3] --- step ---", "[2] ← inner", "[1] ← outer"}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %q", len(want), out)
+	}
+	for i, line := range lines {
+		if strings.HasPrefix(line, " ") || !strings.HasPrefix(line, want[i]) {
+			t.Fatalf("line %d: expected left-aligned %q, got %q", i, want[i], line)
+		}
+	}
+}
+
+// reentrant is an argument whose instrumented String method traces itself
+// with itself as an argument, so formatting it re-enters Trace.
+type reentrant struct{}
+
+func (r reentrant) String() string {
+	defer Trace("reentrant.String", r)()
+	return "reentrant"
+}
+
+func TestTraceDebug_ReentrantCallsFromOutputAreNotTraced(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	out := captureOutput(t, func() {
+		func(r reentrant) {
+			defer Trace("use", r)()
+		}(reentrant{})
+		TraceOnPanic("safe", reentrant{})()
+	})
+
+	if !strings.Contains(out, "→ use(reentrant)") {
+		t.Fatalf("expected the argument to be formatted via String, got %q", out)
+	}
+	names := make([]string, 0)
+	for _, e := range GetTraces() {
+		names = append(names, e.Name)
+	}
+	if !slices.Equal(names, []string{"use", "safe"}) {
+		t.Fatalf("expected only use and safe to be traced, got %v", names)
+	}
+
+	// Outside trace output the method is traced as usual
+	Reset()
+	captureOutput(t, func() { _ = reentrant{}.String() })
+	if got := len(GetTraces()); got != 1 {
+		t.Fatalf("expected a direct String call to be traced once, got %d", got)
+	}
+}
+
+func TestTraceDebug_SummaryFileKeepsLiveOutputSeparate(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	path := filepath.Join(t.TempDir(), "summary.txt")
+	SetSummaryFile(path)
+	defer SetSummaryFile("")
+
+	out := captureOutput(t, func() {
+		Trace("work")()
+		PrintSummary()
+	})
+
+	if !strings.Contains(out, "→ work") || strings.Contains(out, "GoTrace Summary") {
+		t.Fatalf("expected only live lines on stdout, got %q", out)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read summary file: %v", err)
+	}
+	summary := string(content)
+	if !strings.Contains(summary, "GoTrace Summary") || !strings.Contains(summary, "work") {
+		t.Fatalf("expected the summary in the file, got %q", summary)
+	}
+	if strings.Contains(summary, "→ work") || strings.Contains(summary, "\x1b[") {
+		t.Fatalf("expected no live lines or color codes in the file, got %q", summary)
+	}
+}
+
+func TestTraceDebug_SummaryTopNPrintsOnlySlowest(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetSummaryTopN(2)
+	defer SetSummaryTopN(0)
+
+	for _, name := range []string{"alpha", "beta", "gamma", "delta"} {
+		Trace(name)()
+	}
+	summary := SnapshotSummary()
+
+	if !strings.Contains(summary, "Top 2 Slowest Calls") || strings.Contains(summary, "Call Frequency") {
+		t.Fatalf("expected only the top 2 table, got %q", summary)
+	}
+	rows := 0
+	for _, line := range strings.Split(summary, "\n") {
+		if strings.Contains(line, "[trace_debug_test.go:") {
+			rows++
+		}
+	}
+	if rows != 2 {
+		t.Fatalf("expected 2 rows, got %d in %q", rows, summary)
+	}
+}
+
+func TestTraceDebug_ResultsReadsNamedResultsAtExit(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	split := func(sum int) (x, y int) {
+		defer Trace("split", sum)(Results(&x, &y))
+		x = sum * 4 / 9
+		y = sum - x
+		return
+	}
+	fail := func() (n int, err error) {
+		defer Trace("fail")(Results(&n, &err))
+		return 7, errors.New("boom")
+	}
+
+	captureOutput(t, func() {
+		split(18)
+		fail()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces, got %d", len(traces))
+	}
+	if got := fmt.Sprint(traces[0].Returns...); got != "8 10" {
+		t.Fatalf("expected the final named results 8 10, got %q", got)
+	}
+	if got := fmt.Sprint(traces[1].Returns...); got != "7 boom" {
+		t.Fatalf("expected values set by the return statement, got %q", got)
+	}
+}
+
+// slowString takes a while to format, standing in for heavy live output.
+type slowString struct{}
+
+func (slowString) String() string {
+	time.Sleep(20 * time.Millisecond)
+	return "slow"
+}
+
+func TestTraceDebug_EntryOutputNotChargedToCall(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	captureOutput(t, func() {
+		Trace("format", slowString{})()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected 1 trace, got %d", len(traces))
+	}
+	if d := time.Duration(traces[0].Duration); d >= 10*time.Millisecond {
+		t.Fatalf("expected formatting the entry line to be excluded, got %v", d)
+	}
+}
+
+func TestTraceDebug_PrintPanicStacksBeforeGoroutineCrash(t *testing.T) {
+	if os.Getenv("GOTRACE_TEST_CRASH") == "1" {
+		SetColorize(false)
+		// A recovered panic uses up TraceOnPanic's own dump
+		func() {
+			defer func() { _ = recover() }()
+			defer TraceOnPanic("first")()
+			panic("recovered")
+		}()
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					PrintPanicStacks()
+					panic(r)
+				}
+			}()
+			func(n int) {
+				defer TraceOnPanic("worker", n)()
+				panic("unrecovered")
+			}(7)
+		}()
+		select {}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTraceDebug_PrintPanicStacksBeforeGoroutineCrash$")
+	cmd.Env = append(os.Environ(), "GOTRACE_TEST_CRASH=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the goroutine panic to crash the process, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "→ worker(7)") || !strings.Contains(string(out), "panic: unrecovered") {
+		t.Fatalf("expected the worker's trace before the crash, got:\n%s", out)
+	}
+}
+
+func TestTraceDebug_SummaryShowsWallClockAndConcurrency(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	// g1 runs a for 100ns with b nested inside; g2 overlaps it with c
+	entries := []Entry{
+		{Name: "a", Depth: 1, StartNs: 1000, EndNs: 1100, Duration: 100, GID: 1},
+		{Name: "b", Depth: 2, StartNs: 1010, EndNs: 1050, Duration: 40, GID: 1},
+		{Name: "c", Depth: 1, StartNs: 1050, EndNs: 1150, Duration: 100, GID: 2},
+	}
+	captureOutput(t, func() {
+		Replay(entries, 0)
+	})
+	summary := SnapshotSummary()
+
+	if !strings.Contains(summary, "150ns wall clock") {
+		t.Fatalf("expected the 150ns span of the traces as wall clock, got %q", summary)
+	}
+	if !strings.Contains(summary, "1.33x concurrency") {
+		t.Fatalf("expected 200ns of busy time over 150ns wall, got %q", summary)
+	}
+}
+
+func TestTraceDebug_PanicInUserDeferAttributedToFunction(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	cleanup := func() {
+		defer Trace("cleanup")()
+		panic("cleanup failed")
+	}
+	work := func() {
+		// The trace defer comes first, so it runs after the user's defers
+		defer Trace("work")()
+		defer cleanup()
+	}
+	tidy := func() {
+		defer Trace("tidy")()
+		defer func() { _ = recover() }()
+		defer cleanup()
+	}
+
+	captureOutput(t, func() {
+		func() {
+			defer func() { _ = recover() }()
+			work()
+		}()
+		tidy()
+	})
+
+	byName := make(map[string][]Entry)
+	for _, e := range GetTraces() {
+		byName[e.Name] = append(byName[e.Name], e)
+	}
+	w := byName["work"]
+	if len(w) != 1 || !w[0].Panicked || w[0].PanicVal != "cleanup failed" {
+		t.Fatalf("expected work to record its deferred call's panic, got %+v", w)
+	}
+	if c := byName["cleanup"]; len(c) != 2 || !c[0].Panicked || c[0].Depth != w[0].Depth+1 {
+		t.Fatalf("expected cleanup traced as panicking inside work, got %+v", c)
+	}
+	if td := byName["tidy"]; len(td) != 1 || td[0].Panicked {
+		t.Fatalf("expected tidy's own recover to leave it not panicked, got %+v", td)
+	}
+}
+
+func TestTraceDebug_ChromeTraceNamesProcess(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetProcessName("api-server")
+	defer SetProcessName("")
+
+	captureOutput(t, func() {
+		Trace("handle", 42)()
+	})
+	var buf strings.Builder
+	if err := ExportChromeTrace(&buf); err != nil {
+		t.Fatalf("ExportChromeTrace: %v", err)
+	}
+
+	var out struct {
+		TraceEvents []struct {
+			Name  string         `json:"name"`
+			Phase string         `json:"ph"`
+			PID   int            `json:"pid"`
+			Args  map[string]any `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal([]byte(buf.String()), &out); err != nil {
+		t.Fatalf("invalid trace JSON: %v\n%s", err, buf.String())
+	}
+	var named, call bool
+	for _, ev := range out.TraceEvents {
+		if ev.PID != os.Getpid() {
+			t.Fatalf("expected every event under pid %d, got %+v", os.Getpid(), ev)
+		}
+		if ev.Phase == "M" && ev.Name == "process_name" && ev.Args["name"] == "api-server" {
+			named = true
+		}
+		if ev.Phase == "X" && ev.Name == "handle" {
+			call = true
+		}
+	}
+	if !named || !call {
+		t.Fatalf("expected a process_name metadata event and the handle call, got %s", buf.String())
+	}
+}
+
+func TestTraceDebug_ExportPerfetto(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	AddEntries([]Entry{
+		{Name: "main", GID: 1, StartNs: 1_000, EndNs: 9_000, Duration: 8_000},
+		// Durations that disagree with EndNs-StartNs, as added or imported
+		// entries can have, must not stretch or shrink the slices
+		{Name: "load", GID: 1, Depth: 1, StartNs: 2_000, EndNs: 5_000, Duration: 2_500},
+		{Name: "worker", GID: 7, StartNs: 3_000, EndNs: 4_000, Duration: 600, Panicked: true, PanicVal: "boom"},
+		{Name: "tick", GID: 1, Depth: 1, StartNs: 6_000, EndNs: 6_000},
+	})
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := ExportPerfetto(path); err != nil {
+		t.Fatalf("ExportPerfetto: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		TraceEvents []struct {
+			Name  string   `json:"name"`
+			Phase string   `json:"ph"`
+			TS    float64  `json:"ts"`
+			Dur   *float64 `json:"dur"`
+			TID   uint64   `json:"tid"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("invalid trace JSON: %v\n%s", err, data)
+	}
+	tracks := make(map[uint64]bool)
+	calls, panics := 0, 0
+	for _, ev := range out.TraceEvents {
+		switch {
+		case ev.Phase == "M" && ev.Name == "thread_name":
+			tracks[ev.TID] = true
+		case ev.Phase == "X":
+			calls++
+			if ev.Dur == nil {
+				t.Errorf("expected every slice to carry a dur, even a zero one, got none for %s", ev.Name)
+				continue
+			}
+			if ev.Name == "load" && (ev.TS != 2 || *ev.Dur != 3) {
+				t.Errorf("expected load at 2µs for 3µs from StartNs/EndNs, not its 2.5µs Duration, got ts=%v dur=%v", ev.TS, *ev.Dur)
+			}
+			if ev.Name == "worker" && *ev.Dur != 1 {
+				t.Errorf("expected worker to last 1µs from StartNs/EndNs, not its 0.6µs Duration, got dur=%v", *ev.Dur)
+			}
+		case ev.Phase == "i":
+			panics++
+			if ev.TID != 7 || ev.TS != 4 {
+				t.Errorf("expected the panic marked at the end of worker on track 7, got %+v", ev)
+			}
+		}
+	}
+	if len(tracks) != 2 || !tracks[1] || !tracks[7] {
+		t.Errorf("expected one track per goroutine (1 and 7), got %v", tracks)
+	}
+	if calls != 4 || panics != 1 {
+		t.Errorf("expected 4 slices and 1 panic event, got %d and %d in %s", calls, panics, data)
+	}
+}
+
+func TestTraceDebug_ExportHTML(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, time.Millisecond)
+
+	captureOutput(t, func() {
+		func() {
+			defer Trace("handle")()
+			Trace("query<db>")()
+			Trace("query<db>")()
+		}()
+	})
+	var buf strings.Builder
+	if err := ExportHTML(&buf); err != nil {
+		t.Fatalf("ExportHTML: %v", err)
+	}
+	out := buf.String()
+
+	if !strings.HasPrefix(out, "<!DOCTYPE html>") || !strings.Contains(out, "</html>") {
+		t.Fatalf("expected a complete HTML document, got:\n%s", out)
+	}
+	for _, tag := range []string{"html", "body", "table", "tr", "td", "div", "script"} {
+		if open, closed := strings.Count(out, "<"+tag+">")+strings.Count(out, "<"+tag+" "), strings.Count(out, "</"+tag+">"); open != closed {
+			t.Errorf("unbalanced <%s>: %d opened, %d closed", tag, open, closed)
+		}
+	}
+	if strings.Count(out, `<table class="sortable">`) != 2 {
+		t.Errorf("expected sortable slowest-calls and frequency tables, got:\n%s", out)
+	}
+	if strings.Contains(out, "query<db>") || !strings.Contains(out, "query&lt;db&gt;") {
+		t.Errorf("expected function names to be escaped, got:\n%s", out)
+	}
+	// query is nested under handle in the flame graph
+	if !strings.Contains(out, `<div class="bar" title="handle`) || !regexp.MustCompile(`title="handle[^"]*">handle</div><div class="kids"><div class="node"[^>]*><div class="bar" title="query&lt;db&gt;`).MatchString(out) {
+		t.Errorf("expected query nested under handle in the flame graph, got:\n%s", out)
+	}
+}
+
+func TestTraceDebug_MergeRunsOffsetsGIDs(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	shard := func(durations ...int64) io.Reader {
+		lines := []string{`{"format":"gotrace.entries","version":1}`}
+		for i, d := range durations {
+			lines = append(lines, fmt.Sprintf(`{"name":"handle","depth":1,"start_ns":0,"end_ns":%d,"duration_ns":%d,"gid":%d,"label":"g%d"}`, d, d, i+1, i+1))
+		}
+		return strings.NewReader(strings.Join(lines, "\n") + "\n")
+	}
+	entries, err := MergeRuns(shard(1000, 2000), shard(3000))
+	if err != nil {
+		t.Fatalf("MergeRuns: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 merged entries, got %d", len(entries))
+	}
+	var gids []uint64
+	for _, e := range entries {
+		gids = append(gids, e.GID)
+	}
+	if !slices.Equal(gids, []uint64{1, 2, 3}) || entries[2].GoroutineLabel != "g3" {
+		t.Fatalf("expected the second run's goroutine offset to g3, got %+v", entries)
+	}
+
+	AddEntries(entries)
+	out := captureOutput(t, func() {
+		PrintSummary()
+	})
+	if !regexp.MustCompile(`handle\s+3\s`).MatchString(out) {
+		t.Fatalf("expected one summary over both runs, got %q", out)
+	}
+
+	if _, err := MergeRuns(shard(1), strings.NewReader("not json\n")); err == nil || !strings.Contains(err.Error(), "run 2") {
+		t.Fatalf("expected an error naming the bad run, got %v", err)
+	}
+}
+
+func TestTraceDebug_WarnsOnTraceLockContention(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetMonitorContention(true)
+	defer SetMonitorContention(false)
+
+	// Uncontended recording doesn't warn
+	out := captureOutput(t, func() {
+		for range 32 {
+			Trace("idle")()
+		}
+		PrintSummary()
+	})
+	if strings.Contains(out, "trace lock") {
+		t.Fatalf("expected no contention warning, got %q", out)
+	}
+
+	// Simulate contention by holding the lock while a call records
+	Reset()
+	out = captureOutput(t, func() {
+		mu.Lock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			Trace("worker")()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		mu.Unlock()
+		<-done
+		PrintSummary()
+	})
+	if !strings.Contains(out, "waiting on the trace lock") || !strings.Contains(out, "SetAggregateOnly") {
+		t.Fatalf("expected a contention warning in the summary, got %q", out)
+	}
+}
+
+func TestTraceDebug_EntryFilterSkipsCalls(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetEntryFilter(func(name string, args []any) bool {
+		Trace("inside-filter")() // Not traced, and must not recurse
+		return name != "handle" || args[0] == 7
+	})
+	defer SetEntryFilter(nil)
+
+	out := captureOutput(t, func() {
+		Trace("handle", 1)()
+		Trace("handle", 7)()
+		Trace("other")()
+	})
+
+	var got []string
+	for _, e := range GetTraces() {
+		got = append(got, fmt.Sprintf("%s%v", e.Name, e.Args))
+	}
+	if !slices.Equal(got, []string{"handle[7]", "other[]"}) {
+		t.Fatalf("expected only handle(7) and other to be recorded, got %v", got)
+	}
+	if strings.Contains(out, "handle(1)") || strings.Contains(out, "inside-filter") {
+		t.Fatalf("expected filtered calls not to be printed, got %q", out)
+	}
+
+	// A panic still passes through a filtered call, which prints nothing
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Fatalf("expected the panic to propagate, got %v", r)
+		}
+	}()
+	defer Trace("handle", 2)()
+	panic("boom")
+}
+
+func TestTraceDebug_PrintSlowTreesCollapsesFastCalls(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, time.Millisecond)
+
+	captureOutput(t, func() {
+		for range 5 {
+			func() {
+				defer Trace("fastRequest")()
+				Trace("cacheHit")()
+			}()
+		}
+		func() {
+			defer Trace("slowRequest")()
+			Trace("auth")()
+			Trace("auth")()
+			func() {
+				defer Trace("query")()
+				for range 20 {
+					Trace("scan")()
+				}
+			}()
+		}()
+	})
+
+	out := captureOutput(t, func() {
+		PrintSlowTrees(10 * time.Millisecond)
+	})
+	if strings.Contains(out, "fastRequest") || strings.Contains(out, "cacheHit") {
+		t.Fatalf("expected fast trees to be left out, got:\n%s", out)
+	}
+	slowAt, queryAt := strings.Index(out, "slowRequest"), strings.Index(out, "    query")
+	if slowAt < 0 || queryAt < slowAt {
+		t.Fatalf("expected query expanded under slowRequest, got:\n%s", out)
+	}
+	if !strings.Contains(out, "(…) 2 fast calls") || !strings.Contains(out, "(…) 20 fast calls") {
+		t.Fatalf("expected the auth and scan calls collapsed, got:\n%s", out)
+	}
+	if strings.Contains(out, "auth") || strings.Contains(out, "scan") {
+		t.Fatalf("expected fast calls not to be printed by name, got:\n%s", out)
+	}
+}
+
+func TestTraceDebug_CapturesWaitReasonOfBlockedCall(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetThresholds(1_000_000, 10_000_000)
+	SetCaptureWaitReason(true)
+	defer SetCaptureWaitReason(false)
+
+	ch := make(chan int)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ch <- 1
+	}()
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("waitForValue")()
+			<-ch
+		}()
+		PrintSummary()
+	})
+
+	traces := GetTraces()
+	if len(traces) != 1 || traces[0].WaitReason != "chan receive" {
+		t.Fatalf("expected the blocked call to record a chan receive wait, got %+v", traces)
+	}
+	if !strings.Contains(out, "⏳ chan receive") {
+		t.Fatalf("expected the wait reason next to the slow call in the summary, got %q", out)
+	}
+}
+
+func TestTraceDebug_WaitSamplesBoundedUnderLongLivedRoot(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetCaptureWaitReason(true)
+	defer SetCaptureWaitReason(false)
+
+	held := func(gid uint64) int {
+		waitMu.Lock()
+		defer waitMu.Unlock()
+		return len(waitSamples[gid])
+	}
+	gid := getGID()
+	captureOutput(t, func() {
+		setup := Stopwatch("setup")
+		buf := make([]byte, 64<<10)
+		buf = sampleWaits(buf)
+		func() {
+			defer Trace("main")()
+			// Stopping the earlier watch leaves main the oldest open call, so
+			// the sample taken before main started is dropped
+			setup.Stop()
+			if n := held(gid); n != 0 {
+				t.Errorf("expected samples before main to be dropped, got %d", n)
+			}
+			for range 3 * maxWaitSamples {
+				buf = sampleWaits(buf)
+			}
+			if n := held(gid); n == 0 || n >= 2*maxWaitSamples {
+				t.Errorf("expected at most %d samples under a long-lived call, got %d", 2*maxWaitSamples, n)
+			}
+		}()
+	})
+	if n := held(gid); n != 0 {
+		t.Fatalf("expected the samples dropped once the outermost call exits, got %d", n)
+	}
+}
+
+func TestTraceDebug_MaxCallsPerFuncBoundsTrace(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetMaxCallsPerFunc(3)
+	defer SetMaxCallsPerFunc(0)
+
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("main")()
+			for i := range 10 {
+				Trace("step", i)()
+			}
+		}()
+		PrintSummary()
+	})
+
+	var steps []any
+	for _, e := range GetTraces() {
+		if e.Name == "step" {
+			steps = append(steps, e.Args[0])
+		}
+	}
+	if !slices.Equal(steps, []any{0, 1, 2}) {
+		t.Fatalf("expected only the first 3 steps recorded, got %v", steps)
+	}
+	if strings.Contains(out, "step(3)") {
+		t.Fatalf("expected calls past the limit not to be printed, got %q", out)
+	}
+	if !strings.Contains(out, "7 calls past the first 3 per function not traced: step (7)") {
+		t.Fatalf("expected the skipped calls to be counted in the summary, got %q", out)
+	}
+}
+
+func TestTraceDebug_MaxLiveLinesStopsPrinting(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetMaxLiveLines(3)
+	defer SetMaxLiveLines(0)
+
+	out := captureOutput(t, func() {
+		for i := 0; i < 5; i++ {
+			Trace("loop", i)()
+		}
+	})
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[3], "output truncated after 3 lines") {
+		t.Fatalf("expected 3 lines and one notice, got %q", out)
+	}
+	if got := len(GetTraces()); got != 5 {
+		t.Fatalf("expected all 5 calls recorded, got %d", got)
+	}
+}
+
+var _ TestingT = testing.TB(nil)
+
+// fakeT records the failures reported through TestingT.
+type fakeT struct {
+	errors []string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...any) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestTraceDebug_AssertHelpers(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, 5*time.Millisecond)
+
+	captureOutput(t, func() {
+		for i := 0; i < 3; i++ {
+			Trace("fetch", i)()
+		}
+	})
+
+	ok := &fakeT{}
+	AssertCalled(ok, "fetch", 3)
+	AssertMaxDuration(ok, "fetch", 10*time.Millisecond)
+	AssertCalled(ok, "missing", 0)
+	if len(ok.errors) != 0 {
+		t.Fatalf("expected passing assertions, got %q", ok.errors)
+	}
+
+	failed := &fakeT{}
+	AssertCalled(failed, "fetch", 2)
+	AssertCalled(failed, "fecth", 1)
+	AssertMaxDuration(failed, "fetch", time.Millisecond)
+	AssertMaxDuration(failed, "missing", time.Second)
+	want := []string{
+		"expected fetch to be called 2 times, got 3",
+		"expected fecth to be called 1 times, got 0 (recorded: fetch)",
+		"3 of 3 calls to fetch took longer than 1ms; slowest took 5ms at trace_debug_test.go:",
+		"expected missing to finish within 1s, but it was never called (recorded: fetch)",
+	}
+	if len(failed.errors) != len(want) {
+		t.Fatalf("expected %d failures, got %q", len(want), failed.errors)
+	}
+	for i, w := range want {
+		if !strings.Contains(failed.errors[i], w) {
+			t.Errorf("failure %d = %q, want it to contain %q", i, failed.errors[i], w)
+		}
+	}
+}
+
+func TestTraceDebug_ThemeRecolorsStyles(t *testing.T) {
+	defer SetTheme(Theme{})
+
+	path := filepath.Join(t.TempDir(), "theme.json")
+	if err := os.WriteFile(path, []byte(`{"hot": "#00FF00", "func": "39"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultHot, defaultArgs := hotStyle.GetForeground(), argsStyle.GetForeground()
+	if err := LoadTheme(path); err != nil {
+		t.Fatalf("LoadTheme: %v", err)
+	}
+
+	if got := hotStyle.GetForeground(); got != lipgloss.Color("#00FF00") || got == defaultHot {
+		t.Fatalf("expected the hot color from the theme, got %v", got)
+	}
+	if got := funcStyle.GetForeground(); got != lipgloss.Color("39") {
+		t.Fatalf("expected the func color from the theme, got %v", got)
+	}
+	if got := argsStyle.GetForeground(); got != defaultArgs {
+		t.Fatalf("expected missing entries to keep the default, got %v", got)
+	}
+	if !hotStyle.GetBold() {
+		t.Fatal("expected recoloring to keep the rest of the style")
+	}
+
+	SetTheme(Theme{})
+	if got := hotStyle.GetForeground(); got != defaultHot {
+		t.Fatalf("expected SetTheme(Theme{}) to restore the default, got %v", got)
+	}
+
+	os.WriteFile(path, []byte(`{"hott": "#00FF00"}`), 0644)
+	if err := LoadTheme(path); err == nil || !strings.Contains(err.Error(), "hott") {
+		t.Fatalf("expected an unknown style name to be rejected, got %v", err)
+	}
+}
+
+func TestTraceDebug_SetOutputRedirectsOutput(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	var out, errOut strings.Builder
+	SetOutput(&out)
+	SetErrorOutput(&errOut)
+	defer func() {
+		SetOutput(nil)
+		SetErrorOutput(nil)
+	}()
+
+	stdout := captureOutput(t, func() {
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer Trace("worker", i)()
+			}()
+		}
+		wg.Wait()
+		func() {
+			defer func() { recover() }()
+			defer TraceOnPanic("explode")()
+			panic("boom")
+		}()
+		PrintSummary()
+	})
+
+	if stdout != "" {
+		t.Fatalf("expected nothing on stdout, got %q", stdout)
+	}
+	if !strings.Contains(out.String(), "GoTrace Summary") {
+		t.Fatalf("expected the summary in the writer, got %q", out.String())
+	}
+	for i := range 8 {
+		if !strings.Contains(out.String(), fmt.Sprintf("worker(%d)", i)) {
+			t.Fatalf("expected the live line of worker %d intact, got %q", i, out.String())
+		}
+	}
+	if !strings.Contains(errOut.String(), "PANIC DETECTED") || !strings.Contains(errOut.String(), "explode") {
+		t.Fatalf("expected the panic dump in the error writer, got %q", errOut.String())
+	}
+}
+
+func TestTraceDebug_FailOnHotExitsAfterSummary(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	fakeClock(t, 20*time.Millisecond)
+	SetThresholds(1_000_000, 10_000_000)
+	SetFailOnHot(true)
+	defer SetFailOnHot(false)
+
+	exitCode := -1
+	oldExit := exitFunc
+	exitFunc = func(code int) { exitCode = code }
+	defer func() { exitFunc = oldExit }()
+
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	out := captureOutput(t, func() {
+		func() {
+			defer Trace("slowQuery")()
+		}()
+		PrintSummary()
+	})
+	w.Close()
+	os.Stderr = oldStderr
+	stderr, _ := io.ReadAll(r)
+
+	if exitCode != 4 {
+		t.Fatalf("expected exit code 4 for a hot call, got %d", exitCode)
+	}
+	if !strings.Contains(out, "GoTrace Summary") {
+		t.Fatalf("expected the summary before failing, got %q", out)
+	}
+	if !strings.Contains(string(stderr), "FAIL ON HOT") || !strings.Contains(string(stderr), "slowQuery 20.00ms") {
+		t.Fatalf("expected the offending function on stderr, got %q", stderr)
+	}
+
+	// Fast runs pass
+	Reset()
+	fakeClock(t, time.Microsecond)
+	exitCode = -1
+	captureOutput(t, func() {
+		func() {
+			defer Trace("fastQuery")()
+		}()
+		PrintSummary()
+	})
+	if exitCode != -1 {
+		t.Fatalf("expected no exit without hot calls, got %d", exitCode)
+	}
+}
+
+func TestTraceDebug_ImportJSONInternsRepeatedStrings(t *testing.T) {
+	Reset()
+	var buf strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&buf, `{"name":"handler.Serve","file":"server.go","line":12,"gid":7,"label":"g7","start_ns":%d,"end_ns":%d}`+"\n", i*10, i*10+5)
+	}
+	entries, err := ImportJSON(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("ImportJSON: %v", err)
+	}
+	for _, e := range entries[1:] {
+		if unsafe.StringData(e.Name) != unsafe.StringData(entries[0].Name) ||
+			unsafe.StringData(e.File) != unsafe.StringData(entries[0].File) ||
+			unsafe.StringData(e.GoroutineLabel) != unsafe.StringData(entries[0].GoroutineLabel) {
+			t.Fatalf("expected imported entries to share their strings, got %+v", entries)
+		}
+	}
+}
+
+func TestTraceDebug_RecordedEntriesShareStrings(t *testing.T) {
+	Reset()
+	SetColorize(false)
+
+	captureOutput(t, func() {
+		for i := range 3 {
+			func() {
+				defer Region(fmt.Sprintf("batch-%d", i%1))()
+			}()
+		}
+	})
+	entries := GetTraces()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for _, e := range entries[1:] {
+		if unsafe.StringData(e.Name) != unsafe.StringData(entries[0].Name) ||
+			unsafe.StringData(e.File) != unsafe.StringData(entries[0].File) ||
+			unsafe.StringData(e.GoroutineLabel) != unsafe.StringData(entries[0].GoroutineLabel) {
+			t.Fatalf("expected recorded entries to share their strings, got %+v", entries)
+		}
+	}
+}
+
+// BenchmarkTraceDebug_RecordRepeatedNames records a repetitive workload
+// whose names are built per call, and reports the heap its strings still
+// hold per entry: with interning, only the first copy of each stays alive.
+func BenchmarkTraceDebug_RecordRepeatedNames(b *testing.B) {
+	Reset()
+	defer Reset()
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	i := 0
+	for b.Loop() {
+		record(Entry{Name: fmt.Sprintf("handler.Serve/%d", i%8), File: "server.go", GID: 1, GoroutineLabel: gidLabel(1)})
+		i++
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// Leave out the entries themselves, which are kept either way
+	held := int64(after.HeapAlloc-before.HeapAlloc) - int64(cap(traces))*int64(unsafe.Sizeof(Entry{}))
+	b.ReportMetric(float64(held)/float64(b.N), "string-B/op")
+}
+
+func TestTraceDebug_KeepSlowestOnly(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetKeepSlowestOnly(true)
+	defer SetKeepSlowestOnly(false)
+
+	out := captureOutput(t, func() {
+		for _, d := range []int64{3_000_000, 9_000_000, 1_000_000} {
+			record(Entry{Name: "query", Duration: d, StartNs: d, EndNs: 2 * d, Args: []any{d}})
+		}
+		record(Entry{Name: "render", Duration: 500, StartNs: 1, EndNs: 501})
+		PrintFunctionStats("query")
+	})
+
+	traces := GetTraces()
+	if len(traces) != 2 {
+		t.Fatalf("expected one entry per function, got %+v", traces)
+	}
+	for _, e := range traces {
+		if e.Name == "query" && e.Duration != 9_000_000 {
+			t.Fatalf("expected the slowest query to be kept, got %+v", e)
+		}
+	}
+	if strings.Contains(out, "P95") || !strings.Contains(out, "Invocations:     3") {
+		t.Fatalf("expected counts without percentiles, got %q", out)
+	}
+
+	summary := SnapshotSummary()
+	if !strings.Contains(summary, "unique functions") || !regexp.MustCompile(`query\s+3\s+13\.00ms`).MatchString(summary) {
+		t.Fatalf("expected the summary to report all 3 calls of query, got %q", summary)
+	}
+}
+
+func TestTraceDebug_WrapErrorAddsCallPath(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetErrorPaths(true)
+	defer SetErrorPaths(false)
+	errTimeout := errors.New("timeout")
+
+	query := func() error {
+		defer Trace("db.Query")()
+		return WrapError(errTimeout)
+	}
+	serve := func() error {
+		defer Trace("handler.Serve")()
+		// Wrapping again as the error travels up keeps the innermost path
+		return WrapError(query())
+	}
+	var err error
+	captureOutput(t, func() {
+		err = serve()
+	})
+
+	if err == nil || err.Error() != "handler.Serve → db.Query: timeout" {
+		t.Fatalf("expected the call path in the message, got %v", err)
+	}
+	if !errors.Is(err, errTimeout) {
+		t.Fatal("expected the wrapped error to unwrap to the original")
+	}
+	if WrapError(nil) != nil {
+		t.Fatal("expected nil to stay nil")
+	}
+	if got := WrapError(errTimeout); got != errTimeout {
+		t.Fatalf("expected err unchanged outside traced calls, got %v", got)
+	}
+
+	var panicErr error
+	func() {
+		defer TraceOnPanic("job")()
+		panicErr = WrapError(errTimeout)
+	}()
+	if panicErr.Error() != "job: timeout" {
+		t.Fatalf("expected the TraceOnPanic path, got %v", panicErr)
+	}
+}
+
+func TestTraceDebug_CallStacksOnlyKeptWhenNeeded(t *testing.T) {
+	Reset()
+	SetColorize(false)
+	SetErrorPaths(false)
+	stacks := func() int {
+		n := 0
+		callStacks.Range(func(_, _ any) bool { n++; return true })
+		return n
+	}
+
+	captureOutput(t, func() {
+		func() { defer Trace("untracked")() }()
+	})
+	if n := stacks(); n != 0 {
+		t.Fatalf("expected no call stacks without error paths, got %d", n)
+	}
+
+	SetErrorPaths(true)
+	defer SetErrorPaths(false)
+	var path []string
+	captureOutput(t, func() {
+		func() { defer Trace("first")() }()
+		func() {
+			defer Trace("outer")()
+			// A Watch stopped from another goroutine only removes itself
+			w := Stopwatch("timer")
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				w.Stop()
+			}()
+			<-done
+			func() {
+				defer Trace("inner")()
+				path = callPath()
+			}()
+		}()
+	})
+	if strings.Join(path, " → ") != "outer → inner" {
+		t.Fatalf("expected the path outer → inner, got %v", path)
+	}
+	// The emptied stack stays for the goroutine's next top-level call
+	if n := stacks(); n != 1 {
+		t.Fatalf("expected the emptied stack to be kept, got %d stacks", n)
+	}
+	sweepStacks()
+	if n := stacks(); n != 0 {
+		t.Fatalf("expected the sweep to drop the empty stack, got %d", n)
+	}
+}
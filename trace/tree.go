@@ -0,0 +1,107 @@
+package trace
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// callNode is one call in a reconstructed call tree.
+type callNode struct {
+	e        Entry
+	children []*callNode
+}
+
+// buildCallTrees reconstructs the call trees of entries, in start order. A
+// call's parent is the innermost call on the same goroutine whose span
+// contains it.
+func buildCallTrees(entries []Entry) []*callNode {
+	sorted := slices.Clone(entries)
+	slices.SortFunc(sorted, func(a, b Entry) int {
+		return cmp.Or(cmp.Compare(a.GID, b.GID), cmp.Compare(a.StartNs, b.StartNs), cmp.Compare(b.Duration, a.Duration))
+	})
+
+	var roots, stack []*callNode
+	for i, e := range sorted {
+		if i > 0 && e.GID != sorted[i-1].GID {
+			stack = stack[:0]
+		}
+		for len(stack) > 0 && (stack[len(stack)-1].e.EndNs < e.EndNs || stack[len(stack)-1].e.StartNs > e.StartNs) {
+			stack = stack[:len(stack)-1]
+		}
+		n := &callNode{e: e}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, n)
+		} else {
+			roots = append(roots, n)
+		}
+		stack = append(stack, n)
+	}
+	slices.SortStableFunc(roots, func(a, b *callNode) int { return cmp.Compare(a.e.StartNs, b.e.StartNs) })
+	return roots
+}
+
+// PrintSlowTrees prints the call trees whose root took at least threshold,
+// such as one slow request among many fast ones. Within them, calls under
+// the threshold are collapsed into a "(…)" line per run of siblings, so
+// only the path the time went down is expanded.
+func PrintSlowTrees(threshold time.Duration) {
+	Flush()
+	mu.Lock()
+	roots := buildCallTrees(traces)
+	mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("\n" + headerStyle.Render(fmt.Sprintf("🐢 Slow Call Trees (≥ %s)", formatDuration(int64(threshold)))) + "\n")
+	sb.WriteString(summaryRule())
+	slow := 0
+	for _, root := range roots {
+		if root.e.Duration >= int64(threshold) {
+			writeSlowTree(&sb, root, 1, int64(threshold))
+			slow++
+		}
+	}
+	if slow == 0 {
+		sb.WriteString(fileStyle.Render("  No call trees over the threshold") + "\n")
+	}
+	printOut("%s", sb.String())
+}
+
+// writeSlowTree appends n, its slow children expanded and its fast
+// children collapsed, indented for level.
+func writeSlowTree(sb *strings.Builder, n *callNode, level int, threshold int64) {
+	indent := strings.Repeat("  ", level)
+	var styledDur string
+	switch {
+	case n.e.Duration >= hotThresholdNs.Load():
+		styledDur = hotStyle.Render(formatDuration(n.e.Duration))
+	case n.e.Duration >= warnThresholdNs.Load():
+		styledDur = warmStyle.Render(formatDuration(n.e.Duration))
+	default:
+		styledDur = fastStyle.Render(formatDuration(n.e.Duration))
+	}
+	sb.WriteString(fmt.Sprintf("%s%s %s  %s\n", indent, funcStyle.Render(n.e.Name), styledDur,
+		fileStyle.Render(fmt.Sprintf("[%s %s]", entryLocation(n.e), n.e.GoroutineLabel))))
+
+	var fastCalls int
+	var fastTotal int64
+	flushFast := func() {
+		if fastCalls > 0 {
+			sb.WriteString(fileStyle.Render(fmt.Sprintf("%s  (…) %d fast calls, %s", indent, fastCalls, formatDuration(fastTotal))) + "\n")
+			fastCalls, fastTotal = 0, 0
+		}
+	}
+	for _, c := range n.children {
+		if c.e.Duration < threshold {
+			fastCalls++
+			fastTotal += c.e.Duration
+			continue
+		}
+		flushFast()
+		writeSlowTree(sb, c, level+1, threshold)
+	}
+	flushFast()
+}
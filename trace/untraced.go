@@ -0,0 +1,72 @@
+package trace
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// untracedStat is the time a function spent outside its traced callees.
+type untracedStat struct {
+	name            string
+	total, untraced int64
+}
+
+// untracedStats returns, per function, the part of its calls' durations
+// not covered by traced children: its own code plus any uninstrumented
+// callees. Most untraced time first. Callers must hold mu.
+func untracedStats() []untracedStat {
+	byName := make(map[string]*untracedStat)
+	var walk func(nodes []*callNode)
+	walk = func(nodes []*callNode) {
+		for _, n := range nodes {
+			untraced := n.e.Duration
+			for _, c := range n.children {
+				untraced -= c.e.Duration
+			}
+			s, ok := byName[n.e.Name]
+			if !ok {
+				s = &untracedStat{name: n.e.Name}
+				byName[n.e.Name] = s
+			}
+			s.total += n.e.Duration
+			s.untraced += max(untraced, 0)
+			walk(n.children)
+		}
+	}
+	walk(buildCallTrees(traces))
+
+	stats := make([]untracedStat, 0, len(byName))
+	for _, s := range byName {
+		stats = append(stats, *s)
+	}
+	slices.SortFunc(stats, func(a, b untracedStat) int {
+		return cmp.Or(cmp.Compare(b.untraced, a.untraced), cmp.Compare(a.name, b.name))
+	})
+	return stats
+}
+
+// writeUntracedSummary appends the functions with the most time outside
+// traced callees, and its share of their time, to show where a partial
+// instrumentation has blind spots. Callers must hold mu.
+func writeUntracedSummary(sb *strings.Builder) {
+	stats := untracedStats()
+	if len(stats) == 0 {
+		return
+	}
+	sb.WriteString("\n" + headerStyle.Render("🕳  Untraced Self Time (not in traced callees)") + "\n")
+	sb.WriteString(summaryRule())
+	for _, s := range stats[:min(len(stats), 10)] {
+		pct := 0.0
+		if s.total > 0 {
+			pct = 100 * float64(s.untraced) / float64(s.total)
+		}
+		pad := strings.Repeat(" ", max(0, 12-utf8.RuneCountInString(formatDuration(s.untraced))))
+		sb.WriteString(fmt.Sprintf("  %s %s%s  %s\n",
+			funcStyle.Render(nameColumn(s.name)),
+			pad, colorDuration(s.untraced),
+			argsStyle.Render(fmt.Sprintf("%5.1f%% of its time", pct))))
+	}
+}
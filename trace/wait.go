@@ -0,0 +1,175 @@
+package trace
+
+import (
+	"bytes"
+	"cmp"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// waitSampleInterval is how often SetCaptureWaitReason samples.
+const waitSampleInterval = 5 * time.Millisecond
+
+// maxWaitSamples is how many samples are kept per goroutine, about 5s
+// worth; a longer call gets its reason from the latest ones, so a traced
+// main doesn't hold a sample per interval for the whole run.
+const maxWaitSamples = 1024
+
+// waitSample is one goroutine status seen by the wait reason sampler.
+type waitSample struct {
+	ns     int64
+	status string
+}
+
+var (
+	waitMu      sync.Mutex
+	waitStop    chan struct{}           // Non-nil while the sampler runs
+	waitCapture atomic.Bool             // Whether finish looks up samples
+	waitSamples map[uint64][]waitSample // Goroutines with open traced calls only
+)
+
+// SetCaptureWaitReason starts or stops sampling the status of goroutines in
+// traced calls ("running", "chan receive", "IO wait", ...) from
+// runtime.Stack. A call that exits at or above the warn threshold gets the
+// status sampled most often during it as its WaitReason, shown next to it
+// in the summary, which tells CPU-bound slowness from time spent blocked.
+// Each sample stops the world to dump every goroutine, so this is off by
+// default.
+func SetCaptureWaitReason(enabled bool) {
+	waitMu.Lock()
+	defer waitMu.Unlock()
+	if enabled == (waitStop != nil) {
+		return
+	}
+	if !enabled {
+		close(waitStop)
+		waitStop = nil
+		waitCapture.Store(false)
+		updateStackTracking()
+		waitSamples = nil
+		return
+	}
+	done := make(chan struct{})
+	waitStop = done
+	waitSamples = make(map[uint64][]waitSample)
+	waitCapture.Store(true)
+	updateStackTracking()
+	go func() {
+		ticker := time.NewTicker(waitSampleInterval)
+		defer ticker.Stop()
+		buf := make([]byte, 64<<10)
+		for {
+			select {
+			case <-ticker.C:
+				buf = sampleWaits(buf)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// sampleWaits records the status of every goroutine with an open traced
+// call, and returns buf, grown if the dump didn't fit.
+func sampleWaits(buf []byte) []byte {
+	n := runtime.Stack(buf, true)
+	for n == len(buf) {
+		buf = make([]byte, 2*len(buf))
+		n = runtime.Stack(buf, true)
+	}
+	now := clock()
+	waitMu.Lock()
+	defer waitMu.Unlock()
+	if waitSamples == nil {
+		return buf
+	}
+	for _, block := range bytes.Split(buf[:n], []byte("\n\n")) {
+		gid, status, ok := parseGoroutineHeader(block)
+		if !ok {
+			continue
+		}
+		if innermostSpan(gid) != nil {
+			samples := append(waitSamples[gid], waitSample{now, status})
+			if len(samples) >= 2*maxWaitSamples {
+				// Dropped in batches so each sample costs O(1)
+				samples = append(samples[:0], samples[len(samples)-maxWaitSamples:]...)
+			}
+			waitSamples[gid] = samples
+		}
+	}
+	return buf
+}
+
+// parseGoroutineHeader reads the ID and status from the first line of a
+// runtime.Stack goroutine dump, "goroutine 7 [chan receive, 2 minutes]:".
+func parseGoroutineHeader(block []byte) (gid uint64, status string, ok bool) {
+	line, _, _ := bytes.Cut(block, []byte("\n"))
+	rest, found := bytes.CutPrefix(line, []byte("goroutine "))
+	if !found {
+		return 0, "", false
+	}
+	id, rest, found := bytes.Cut(rest, []byte(" ["))
+	if !found {
+		return 0, "", false
+	}
+	gid, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	rest, _, _ = bytes.Cut(rest, []byte("]"))
+	rest, _, _ = bytes.Cut(rest, []byte(","))
+	return gid, string(rest), true
+}
+
+// takeWaitReason returns the status sampled most often on the goroutine of
+// s since it started, or "" if there were no samples. Samples taken before
+// the goroutine's oldest open traced call are dropped, all of them once its
+// outermost call exits.
+func takeWaitReason(s *span, slow bool) string {
+	waitMu.Lock()
+	defer waitMu.Unlock()
+	samples := waitSamples[s.gid]
+	if len(samples) == 0 {
+		return ""
+	}
+	reason := ""
+	if slow {
+		counts := make(map[string]int)
+		for _, w := range samples[samplesSince(samples, s.start):] {
+			counts[w.status]++
+			if c := cmp.Compare(counts[w.status], counts[reason]); c > 0 || c == 0 && w.status < reason {
+				reason = w.status
+			}
+		}
+	}
+	if outer := outermostSpan(s.gid); outer == nil {
+		delete(waitSamples, s.gid)
+	} else if keep := samplesSince(samples, outer.start); keep > 0 {
+		n := copy(samples, samples[keep:])
+		waitSamples[s.gid] = samples[:n]
+	}
+	return reason
+}
+
+// samplesSince returns the index of the first of samples, which are in time
+// order, taken at or after ns.
+func samplesSince(samples []waitSample, ns int64) int {
+	i, _ := slices.BinarySearchFunc(samples, ns, func(w waitSample, ns int64) int {
+		return cmp.Compare(w.ns, ns)
+	})
+	return i
+}
+
+// resetWaitSamples drops the samples taken so far; a running sampler keeps
+// going.
+func resetWaitSamples() {
+	waitMu.Lock()
+	if waitSamples != nil {
+		clear(waitSamples)
+	}
+	waitMu.Unlock()
+}